@@ -0,0 +1,198 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/semconv"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// Keys from the OpenTelemetry semantic conventions for Kubernetes where there is one,
+// otherwise the ones the OpenTelemetry Collector uses for Kubernetes Events.
+const (
+	keyNodeName    = attribute.Key("k8s.node.name") // not in the semconv package we use
+	keyObjectKind  = attribute.Key("k8s.object.kind")
+	keyObjectName  = attribute.Key("k8s.object.name")
+	keyObjectUID   = attribute.Key("k8s.object.uid")
+	keyEventName   = attribute.Key("k8s.event.name")
+	keyEventUID    = attribute.Key("k8s.event.uid")
+	keyEventReason = attribute.Key("k8s.event.reason")
+	keyEventCount  = attribute.Key("k8s.event.count")
+	keyGeneration  = attribute.Key("k8s.object.generation")
+)
+
+// Pod -> ReplicaSet -> Deployment is the usual chain; stop if something loops
+const maxOwnerChainSize = 5
+
+// Kinds that have their own name and uid keys in the semantic conventions
+var semconvKinds = map[string]string{
+	"Pod":         "pod",
+	"ReplicaSet":  "replicaset",
+	"Deployment":  "deployment",
+	"StatefulSet": "statefulset",
+	"DaemonSet":   "daemonset",
+	"Job":         "job",
+	"CronJob":     "cronjob",
+	"Node":        "node",
+	"Namespace":   "namespace",
+}
+
+// k8s.<kind>.name and k8s.<kind>.uid, for kinds in the semantic conventions.
+// In legacy mode we also used k8s.<kind>.name for every other kind.
+func (r *EventWatcher) kindAttributes(kind, name string, uid types.UID) []attribute.KeyValue {
+	prefix, found := semconvKinds[kind]
+	if !found {
+		if r.LegacyAttributes {
+			return []attribute.KeyValue{attribute.String("k8s."+strings.ToLower(kind)+".name", name)}
+		}
+		return nil
+	}
+	attrs := []attribute.KeyValue{attribute.String("k8s."+prefix+".name", name)}
+	if uid != "" {
+		attrs = append(attrs, attribute.String("k8s."+prefix+".uid", string(uid)))
+	}
+	return attrs
+}
+
+// Attributes for the object an event or span is about, and the chain of owners above it as far as we know it.
+func (r *EventWatcher) objectAttributes(ref objectReference, uid types.UID) []attribute.KeyValue {
+	if info, found := r.objects.get(ref); found && uid == "" {
+		uid = info.uid
+	}
+	attrs := []attribute.KeyValue{
+		keyObjectKind.String(ref.Kind),
+		keyObjectName.String(ref.Name),
+	}
+	if uid != "" {
+		attrs = append(attrs, keyObjectUID.String(string(uid)))
+	}
+	if ref.Namespace != "" {
+		attrs = append(attrs, semconv.K8SNamespaceNameKey.String(ref.Namespace))
+	}
+	attrs = append(attrs, r.kindAttributes(ref.Kind, ref.Name, uid)...)
+	if r.LegacyAttributes {
+		attrs = append(attrs, attribute.String("kind", ref.Kind))
+	}
+	for i := 0; i < maxOwnerChainSize; i++ {
+		info, found := r.objects.get(ref)
+		if !found || info.owner.Blank() {
+			break
+		}
+		attrs = append(attrs, r.kindAttributes(info.owner.Kind, info.owner.Name, info.ownerUID)...)
+		ref = info.owner
+	}
+	return attrs
+}
+
+// Look up a string value, or blank if not there
+func stringAttribute(attrs []attribute.KeyValue, key attribute.Key) string {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+// Attributes describing the Event itself
+func (r *EventWatcher) eventAttributes(event *corev1.Event) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if event.Reason != "" {
+		attrs = append(attrs, keyEventReason.String(event.Reason))
+	}
+	if event.Name != "" {
+		attrs = append(attrs, keyEventName.String(event.Name))
+	}
+	if event.UID != "" {
+		attrs = append(attrs, keyEventUID.String(string(event.UID)))
+	}
+	if r.LegacyAttributes {
+		if event.Reason != "" {
+			attrs = append(attrs, attribute.String("reason", event.Reason))
+		}
+		if event.Name != "" {
+			attrs = append(attrs, attribute.String("eventID", event.Namespace+"/"+event.Name))
+		}
+	}
+	return attrs
+}
+
+// The count of a repeating event; both keys in legacy mode.
+func (r *EventWatcher) countAttributes(count int32) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{keyEventCount.Int64(int64(count))}
+	if r.LegacyAttributes {
+		attrs = append(attrs, attribute.Int64("count", int64(count)))
+	}
+	return attrs
+}
+
+// What we know about an object we fetched, so we can fill in its owners and labels without fetching them again.
+type objectInfo struct {
+	uid             types.UID
+	owner           objectReference // the controlling owner, if any
+	ownerUID        types.UID
+	ownerAPIVersion string
+	labels          map[string]string // for the object selector filter
+	projected       map[string]string // attribute name -> value, for labels and annotations we copy onto spans
+	lastSeen        time.Time
+}
+
+// objectStore remembers the objects kspan has fetched, by reference
+type objectStore struct {
+	sync.Mutex
+	projections []Projection
+	info        map[objectReference]objectInfo
+}
+
+func newObjectStore(projections []Projection) *objectStore {
+	return &objectStore{
+		projections: projections,
+		info:        make(map[objectReference]objectInfo),
+	}
+}
+
+// Remember an object; we only follow the controlling owner, or the first if none is marked as controller.
+func (s *objectStore) note(obj runtime.Object) {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	info := objectInfo{uid: m.GetUID(), labels: m.GetLabels(), lastSeen: mtime.Now()}
+	owners := m.GetOwnerReferences()
+	for i, o := range owners {
+		if i == 0 || (o.Controller != nil && *o.Controller) {
+			info.owner = refFromOwner(o, m.GetNamespace())
+			info.ownerUID = o.UID
+			info.ownerAPIVersion = o.APIVersion
+		}
+	}
+	info.projected = project(s.projections, m)
+	s.Lock()
+	defer s.Unlock()
+	s.info[refFromObject(m)] = info
+}
+
+func (s *objectStore) get(ref objectReference) (objectInfo, bool) {
+	s.Lock()
+	defer s.Unlock()
+	info, found := s.info[ref]
+	return info, found
+}
+
+func (s *objectStore) expire(threshold time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for k, v := range s.info {
+		if v.lastSeen.Before(threshold) {
+			delete(s.info, k)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package events
+
+import (
+	"testing"
+
+	o "github.com/onsi/gomega"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+func TestSemanticConventionAttributes(t *testing.T) {
+	g := o.NewWithT(t)
+
+	for _, legacy := range []bool{false, true} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		r.ClusterName = "test-cluster"
+		r.LegacyAttributes = legacy
+
+		replayRollout(t, ctx, r)
+		r.stop()
+
+		var scheduled *tracesdk.SpanSnapshot
+		for _, span := range exporter.SpanSnapshot {
+			if span.Name == "Pod.Scheduled" {
+				scheduled = span
+			}
+		}
+		g.Expect(scheduled).NotTo(o.BeNil())
+		attrs := scheduled.Attributes
+		// The owner chain is filled in from the objects fetched while mapping the events
+		g.Expect(attributeValue(attrs, "k8s.pod.name")).To(o.Equal("hello-world-6b9d85fbd6-klpv2"))
+		g.Expect(attributeValue(attrs, "k8s.pod.uid")).To(o.Equal("deb2b4f7-e312-44dd-bd06-7c00d0f5695a"))
+		g.Expect(attributeValue(attrs, "k8s.replicaset.name")).To(o.Equal("hello-world-6b9d85fbd6"))
+		g.Expect(attributeValue(attrs, "k8s.replicaset.uid")).To(o.Equal("b2fcb2a4-ed25-49dc-87de-db6cf8ec7a00"))
+		g.Expect(attributeValue(attrs, "k8s.deployment.name")).To(o.Equal("hello-world"))
+		g.Expect(attributeValue(attrs, "k8s.deployment.uid")).To(o.Equal("4ecf82fc-0f0a-44e0-9469-cebbb07f7a31"))
+		g.Expect(attributeValue(attrs, "k8s.namespace.name")).To(o.Equal("default"))
+		g.Expect(attributeValue(attrs, keyObjectKind)).To(o.Equal("Pod"))
+		g.Expect(attributeValue(attrs, keyEventReason)).To(o.Equal("Scheduled"))
+		g.Expect(attributeValue(scheduled.Resource.Attributes(), semconv.K8SClusterNameKey)).To(o.Equal("test-cluster"))
+
+		if legacy {
+			g.Expect(attributeValue(attrs, "kind")).To(o.Equal("Pod"))
+			g.Expect(attributeValue(attrs, "reason")).To(o.Equal("Scheduled"))
+			g.Expect(attributeValue(attrs, "eventID")).NotTo(o.BeEmpty())
+		} else {
+			g.Expect(attributeValue(attrs, "kind")).To(o.BeEmpty())
+			g.Expect(attributeValue(attrs, "reason")).To(o.BeEmpty())
+		}
+	}
+}
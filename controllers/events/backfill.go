@@ -0,0 +1,126 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// Events per page when listing for backfill
+const backfillPageSize = 500
+
+// Runs backfill once this replica is sending spans: at once without leader election, otherwise when
+// leaderRunnable is elected, so a standby doesn't mark the old Events handled without sending them.
+type backfillRunnable struct {
+	r      *EventWatcher
+	reader client.Reader
+}
+
+func (b backfillRunnable) Start(stop <-chan struct{}) error {
+	b.run(stop)
+	<-stop
+	return nil
+}
+
+func (b backfillRunnable) run(stop <-chan struct{}) {
+	defer close(b.r.backfilled)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := b.r.backfill(ctx, b.reader); err != nil {
+		b.r.Log.Error(err, "backfill")
+	}
+}
+
+// Live events wait for backfill, so they find the history they belong to.
+func (r *EventWatcher) waitForBackfill() {
+	if r.backfilled != nil {
+		<-r.backfilled
+	}
+}
+
+// List the Events still in the API server from within Backfill of startup, that Reconcile would
+// ignore as too old, and handle them in time order as if they were happening now.
+// The correlation clock is set from each event, and whatever the ticker would do runs as it goes along;
+// mtime is left alone, as the ticker and sharding go on reading it meanwhile.
+func (r *EventWatcher) backfill(ctx context.Context, reader client.Reader) error {
+	start := mtime.Now()
+	var events []*corev1.Event
+	var list corev1.EventList
+	opts := []client.ListOption{client.Limit(backfillPageSize)}
+	for {
+		if err := reader.List(ctx, &list, opts...); err != nil {
+			return errors.Wrap(err, "unable to list events for backfill")
+		}
+		for i := range list.Items {
+			ev := &list.Items[i]
+			t := eventTime(ev)
+			// Anything more recent comes to Reconcile
+			if win, _ := r.recent.windows.forEvent(ev); t.Before(start.Add(-r.Backfill)) || !t.Before(r.startTime.Add(-win.Recent)) {
+				continue
+			}
+			events = append(events, ev.DeepCopy())
+		}
+		if list.Continue == "" {
+			break
+		}
+		opts = []client.ListOption{client.Limit(backfillPageSize), client.Continue(list.Continue)}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return eventBefore(events[i], events[j]) })
+	r.Log.Info("backfilling", "events", len(events), "since", start.Add(-r.Backfill))
+
+	// The whole backfill is one turn on the correlation goroutine, so no tick comes in while we drive the clock.
+	return r.correlate(ctx, func() {
+		defer func() { r.clock.replaying = time.Time{} }()
+		tickInterval := r.recent.windows.tickInterval()
+		var lastTick time.Time
+		for _, ev := range events {
+			t := eventTime(ev)
+			if lastTick.IsZero() {
+				lastTick = t
+			}
+			for ; !lastTick.Add(tickInterval).After(t); lastTick = lastTick.Add(tickInterval) {
+				r.clock.replaying = lastTick.Add(tickInterval)
+				r.tick(ctx)
+			}
+			r.clock.replaying = t
+			r.processEvent(ctx, ev)
+			backfillEventsNum.Inc()
+		}
+		// Back to the real time, and send out everything that has finished
+		r.clock.replaying = time.Time{}
+		r.tick(ctx)
+	})
+}
+
+// Event times are only to the second, so for events in the same second go by resourceVersion,
+// which is the order the API server stored them. It is meant to be opaque, but is a number from etcd.
+func eventBefore(a, b *corev1.Event) bool {
+	ta, tb := eventTime(a), eventTime(b)
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return storedBefore(a, b)
+}
+
+func storedBefore(a, b *corev1.Event) bool {
+	ra, errA := strconv.ParseUint(a.ResourceVersion, 10, 64)
+	rb, errB := strconv.ParseUint(b.ResourceVersion, 10, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return ra < rb
+}
@@ -0,0 +1,131 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestBackfill(t *testing.T) {
+	g := o.NewWithT(t)
+
+	objs := rolloutObjects(t)
+	// The Events are in the API server in no particular order
+	events := rolloutEvents(t)
+	for _, index := range []int{8, 0, 6, 1, 2, 3, 4, 5, 7} {
+		objs = append(objs, events[index])
+	}
+	threshold := rolloutThreshold(t)
+
+	// kspan starts up a while after the rollout
+	mtime.NowForce(threshold.Add(10 * time.Minute))
+	defer mtime.NowReset()
+	_, r, exporter, _ := newTestEventWatcher(objs...)
+	defer r.stop()
+	r.Backfill = time.Hour
+
+	g.Expect(r.backfill(context.Background(), r.Client)).To(o.Succeed())
+	g.Expect(exporter.dump()).To(o.Equal(rolloutTrace))
+	g.Expect(r.pending).To(o.BeEmpty())
+	g.Expect(r.outgoing.byRef).To(o.BeEmpty())
+
+	// The clock is left as it was
+	g.Expect(mtime.Now()).To(o.Equal(threshold.Add(10 * time.Minute)))
+
+	// Nothing is older than the backfill period, or recent enough for Reconcile to handle
+	_, r2, exporter2, _ := newTestEventWatcher(objs...)
+	defer r2.stop()
+	r2.Backfill = time.Minute
+	backfilled := testutil.ToFloat64(backfillEventsNum)
+	g.Expect(r2.backfill(context.Background(), r2.Client)).To(o.Succeed())
+	g.Expect(testutil.ToFloat64(backfillEventsNum)).To(o.Equal(backfilled))
+	g.Expect(exporter2.SpanSnapshot).To(o.BeEmpty())
+}
+
+// With leader election, backfill waits until we are elected, so the spans it makes are sent.
+func TestBackfillWithLeaderElection(t *testing.T) {
+	g := o.NewWithT(t)
+
+	objs := rolloutObjects(t)
+	for _, event := range rolloutEvents(t) {
+		objs = append(objs, event)
+	}
+	threshold := rolloutThreshold(t)
+	mtime.NowForce(threshold.Add(10 * time.Minute))
+	defer mtime.NowReset()
+
+	_, r, exporter, _ := newTestEventWatcher(objs...)
+	defer r.stop()
+	r.Backfill = time.Hour
+	r.LeaderElection = true
+	r.setLeader(false)
+	r.handled = newHandledEvents(r.clock)
+	r.backfilled = make(chan struct{})
+
+	stop := make(chan struct{})
+	started := make(chan error, 1)
+	go func() {
+		started <- leaderRunnable{r: r, backfill: &backfillRunnable{r: r, reader: r.Client}}.Start(stop)
+	}()
+	<-r.backfilled
+	g.Expect(r.isLeader()).To(o.BeTrue())
+	g.Expect(exporter.dump()).To(o.Equal(rolloutTrace))
+	close(stop)
+	g.Expect(<-started).To(o.Succeed())
+}
+
+// Backfill only moves the correlation clock; the ticker and shard renewal carry on alongside it at the real time.
+func TestBackfillAlongsideTickerAndShards(t *testing.T) {
+	g := o.NewWithT(t)
+
+	objs := rolloutObjects(t)
+	for _, event := range rolloutEvents(t) {
+		objs = append(objs, event)
+	}
+	now := rolloutThreshold(t).Add(10 * time.Minute)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	ctx, r, exporter, log := newTestEventWatcher(objs...)
+	defer r.stop()
+	r.Backfill = time.Hour
+	shards := newShards(Sharding{Identity: "kspan-a", Namespace: "kspan", Group: "kspan"}, r.Client, r.Client, log)
+
+	// What the ticker does off the correlation goroutine, and the shard Lease renewal, until backfill is done
+	done := make(chan struct{})
+	errs := make(chan error, 2)
+	alongside := func(f func() error) {
+		for {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+			if err := f(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+	go alongside(func() error { r.prefetchPending(ctx, r.olderPendingThreshold(mtime.Now())); return nil })
+	go alongside(func() error { return shards.sync(ctx) })
+	err := r.backfill(ctx, r.Client)
+	close(done)
+	g.Expect(<-errs).To(o.Succeed())
+	g.Expect(<-errs).To(o.Succeed())
+	g.Expect(err).To(o.Succeed())
+	g.Expect(exporter.dump()).To(o.Equal(rolloutTrace))
+
+	var lease coordinationv1.Lease
+	g.Expect(r.Client.Get(ctx, client.ObjectKey{Namespace: "kspan", Name: shards.leaseName()}, &lease)).To(o.Succeed())
+	g.Expect(lease.Spec.RenewTime.Time).To(o.BeTemporally("==", now))
+	g.Expect(shards.members).To(o.Equal([]string{"kspan-a"}))
+}
@@ -0,0 +1,485 @@
+package events
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+const (
+	defaultCheckpointInterval = 30 * time.Second
+	checkpointVersion         = 1
+	// Key in the ConfigMap's binaryData; the checkpoint is gzipped to stay under the size limit
+	checkpointKey = "checkpoint.json.gz"
+)
+
+// Checkpoint saves what we are in the middle of, so a restarted kspan carries on the same traces
+// and sends the spans it was holding. Set File or ConfigMap.
+type Checkpoint struct {
+	File      string
+	ConfigMap types.NamespacedName
+	Interval  time.Duration
+}
+
+// Everything we save. Series and held tail-sampled traces are not saved; repeats start a new series after a restart.
+type checkpointState struct {
+	Version int
+	Time    time.Time
+	Recent  []checkpointRecent
+	Spans   []checkpointSpan
+	Pending []*corev1.Event
+	Handled map[types.UID]string // resourceVersion by Event UID
+}
+
+type checkpointRecent struct {
+	Actor, Object objectReference
+	LastUsed      time.Time
+	Span, Parent  checkpointContext
+	Source        string `json:",omitempty"`
+}
+
+type checkpointContext struct {
+	TraceID, SpanID string `json:",omitempty"`
+	TraceFlags      byte   `json:",omitempty"`
+}
+
+type checkpointSpan struct {
+	Ref           *objectReference `json:",omitempty"` // set if held in byRef
+	Context       checkpointContext
+	Parent        string `json:",omitempty"`
+	Kind          trace.SpanKind
+	Name          string
+	Start, End    time.Time
+	Attributes    []checkpointAttribute
+	Links         []checkpointLink  `json:",omitempty"`
+	Events        []checkpointEvent `json:",omitempty"`
+	StatusCode    codes.Code
+	StatusMessage string `json:",omitempty"`
+	RemoteParent  bool
+	Resource      []checkpointAttribute
+}
+
+type checkpointLink struct {
+	Context    checkpointContext
+	Attributes []checkpointAttribute
+}
+
+type checkpointEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []checkpointAttribute
+}
+
+// Attribute values lose their type in JSON, so keep it alongside
+type checkpointAttribute struct {
+	Key   string
+	Type  string
+	Value interface{}
+}
+
+func toCheckpointContext(sc trace.SpanContext) checkpointContext {
+	var c checkpointContext
+	if sc.HasTraceID() {
+		c.TraceID = sc.TraceID().String()
+	}
+	if sc.HasSpanID() {
+		c.SpanID = sc.SpanID().String()
+	}
+	c.TraceFlags = sc.TraceFlags()
+	return c
+}
+
+func (c checkpointContext) spanContext() trace.SpanContext {
+	config := trace.SpanContextConfig{TraceFlags: c.TraceFlags}
+	config.TraceID, _ = trace.TraceIDFromHex(c.TraceID) // blank gives the zero ID, which is what we saved
+	config.SpanID, _ = trace.SpanIDFromHex(c.SpanID)
+	return trace.NewSpanContext(config)
+}
+
+func toCheckpointAttributes(attrs []attribute.KeyValue) []checkpointAttribute {
+	ret := make([]checkpointAttribute, 0, len(attrs))
+	for _, kv := range attrs {
+		a := checkpointAttribute{Key: string(kv.Key), Type: kv.Value.Type().String()}
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			a.Value = kv.Value.AsBool()
+		case attribute.INT64:
+			a.Value = kv.Value.AsInt64()
+		case attribute.FLOAT64:
+			a.Value = kv.Value.AsFloat64()
+		default: // kspan doesn't make arrays, but keep anything else in its printed form
+			a.Type = attribute.STRING.String()
+			a.Value = kv.Value.Emit()
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+func fromCheckpointAttributes(attrs []checkpointAttribute) []attribute.KeyValue {
+	ret := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		key := attribute.Key(a.Key)
+		switch v := a.Value.(type) {
+		case bool:
+			ret = append(ret, key.Bool(v))
+		case float64: // JSON numbers come back as float64
+			if a.Type == attribute.INT64.String() {
+				ret = append(ret, key.Int64(int64(v)))
+			} else {
+				ret = append(ret, key.Float64(v))
+			}
+		case string:
+			ret = append(ret, key.String(v))
+		}
+	}
+	return ret
+}
+
+func toCheckpointSpan(ref *objectReference, span *tracesdk.SpanSnapshot) checkpointSpan {
+	c := checkpointSpan{
+		Ref:           ref,
+		Context:       toCheckpointContext(span.SpanContext),
+		Kind:          span.SpanKind,
+		Name:          span.Name,
+		Start:         span.StartTime,
+		End:           span.EndTime,
+		Attributes:    toCheckpointAttributes(span.Attributes),
+		StatusCode:    span.StatusCode,
+		StatusMessage: span.StatusMessage,
+		RemoteParent:  span.HasRemoteParent,
+	}
+	if span.ParentSpanID.IsValid() {
+		c.Parent = span.ParentSpanID.String()
+	}
+	if span.Resource != nil {
+		c.Resource = toCheckpointAttributes(span.Resource.Attributes())
+	}
+	for _, l := range span.Links {
+		c.Links = append(c.Links, checkpointLink{Context: toCheckpointContext(l.SpanContext), Attributes: toCheckpointAttributes(l.Attributes)})
+	}
+	for _, ev := range span.MessageEvents {
+		c.Events = append(c.Events, checkpointEvent{Name: ev.Name, Time: ev.Time, Attributes: toCheckpointAttributes(ev.Attributes)})
+	}
+	return c
+}
+
+func (c checkpointSpan) span() *tracesdk.SpanSnapshot {
+	span := &tracesdk.SpanSnapshot{
+		SpanContext:     c.Context.spanContext(),
+		SpanKind:        c.Kind,
+		Name:            c.Name,
+		StartTime:       c.Start,
+		EndTime:         c.End,
+		Attributes:      fromCheckpointAttributes(c.Attributes),
+		StatusCode:      c.StatusCode,
+		StatusMessage:   c.StatusMessage,
+		HasRemoteParent: c.RemoteParent,
+		Resource:        resource.NewWithAttributes(fromCheckpointAttributes(c.Resource)...),
+	}
+	span.ParentSpanID, _ = trace.SpanIDFromHex(c.Parent)
+	for _, l := range c.Links {
+		span.Links = append(span.Links, trace.Link{SpanContext: l.Context.spanContext(), Attributes: fromCheckpointAttributes(l.Attributes)})
+	}
+	for _, ev := range c.Events {
+		span.MessageEvents = append(span.MessageEvents, trace.Event{Name: ev.Name, Time: ev.Time, Attributes: fromCheckpointAttributes(ev.Attributes)})
+	}
+	return span
+}
+
+// Take a copy of our state; each part is locked in turn, so it may be a little inconsistent, which is no worse than a restart.
+func (r *EventWatcher) snapshot() *checkpointState {
+	state := &checkpointState{Version: checkpointVersion, Time: mtime.Now(), Handled: map[types.UID]string{}}
+
+	for k, v := range r.recent.backend.all() {
+		state.Recent = append(state.Recent, checkpointRecent{
+			Actor:    k.actor,
+			Object:   k.object,
+			LastUsed: v.lastUsed,
+			Span:     toCheckpointContext(v.spanContext),
+			Parent:   toCheckpointContext(v.parentContext),
+			Source:   v.source,
+		})
+	}
+
+	r.outgoing.Lock()
+	held := make(map[trace.SpanID]bool, len(r.outgoing.byRef))
+	for k, span := range r.outgoing.byRef {
+		ref := k
+		state.Spans = append(state.Spans, toCheckpointSpan(&ref, span))
+		held[span.SpanContext.SpanID()] = true
+	}
+	for k, span := range r.outgoing.bySpanID { // already sent, but kept for parent chains
+		if !held[k] {
+			state.Spans = append(state.Spans, toCheckpointSpan(nil, span))
+		}
+	}
+	r.outgoing.Unlock()
+
+	r.Lock()
+	for _, ev := range r.pending {
+		state.Pending = append(state.Pending, ev.DeepCopy())
+	}
+	r.Unlock()
+	// Events waiting to be put in order come back as pending
+	if r.reorder != nil {
+		for _, item := range r.reorder.items {
+			state.Pending = append(state.Pending, item.event.DeepCopy())
+		}
+	}
+
+	if r.handled != nil {
+		r.handled.Lock()
+		for k, v := range r.handled.versions {
+			state.Handled[k] = v.resourceVersion
+		}
+		r.handled.Unlock()
+	}
+	return state
+}
+
+// Put back saved state. Anything that would have expired while we were down goes on the next tick.
+func (r *EventWatcher) restore(state *checkpointState) {
+	for _, c := range state.Recent {
+		r.recent.restore(actionReference{actor: c.Actor, object: c.Object}, recentInfo{
+			lastUsed:      c.LastUsed,
+			spanContext:   c.Span.spanContext(),
+			parentContext: c.Parent.spanContext(),
+			source:        c.Source,
+		})
+	}
+
+	r.outgoing.Lock()
+	for _, c := range state.Spans {
+		span := c.span()
+		if c.Ref != nil {
+			r.outgoing.byRef[*c.Ref] = span
+		}
+		r.outgoing.bySpanID[span.SpanContext.SpanID()] = span
+	}
+	r.outgoing.Unlock()
+
+	for _, event := range state.Pending { // how long they waited before doesn't count
+		r.notePending(context.Background(), event)
+	}
+	r.Lock()
+	r.pending = append(state.Pending, r.pending...)
+	r.shedPending()
+	// Events from while we were down are not too old to handle, unless we were down for so long that
+	// nothing we remember from then would still be recent
+	since := state.Time
+	if earliest := r.now().Add(-r.recent.windows.longestExpire()); since.Before(earliest) {
+		since = earliest
+	}
+	if since.Before(r.startTime) {
+		r.startTime = since
+	}
+	r.Unlock()
+
+	if r.handled != nil {
+		r.handled.Lock()
+		for k, v := range state.Handled {
+			r.handled.versions[k] = handledVersion{resourceVersion: v, lastSeen: mtime.Now()}
+		}
+		r.handled.Unlock()
+	}
+}
+
+func encodeCheckpoint(state *checkpointState) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(state); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCheckpoint(data []byte) (*checkpointState, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var state checkpointState
+	if err := json.NewDecoder(zr).Decode(&state); err != nil {
+		return nil, err
+	}
+	if state.Version != checkpointVersion {
+		return nil, errors.Errorf("checkpoint version %d not supported", state.Version)
+	}
+	return &state, nil
+}
+
+// Where checkpoints are kept; load returns nil if there isn't one yet.
+type checkpointStore interface {
+	load(ctx context.Context) ([]byte, error)
+	save(ctx context.Context, data []byte) error
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+func (f fileCheckpointStore) load(ctx context.Context) ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Write then rename, so a crash part-way through doesn't leave half a checkpoint.
+func (f fileCheckpointStore) save(ctx context.Context, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+type configMapCheckpointStore struct {
+	name   types.NamespacedName
+	client client.Client
+	reader client.Reader // read directly, rather than caching every ConfigMap in the cluster
+}
+
+func (c configMapCheckpointStore) load(ctx context.Context) ([]byte, error) {
+	var cm corev1.ConfigMap
+	err := c.reader.Get(ctx, c.name, &cm)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.BinaryData[checkpointKey], nil
+}
+
+func (c configMapCheckpointStore) save(ctx context.Context, data []byte) error {
+	var cm corev1.ConfigMap
+	err := c.reader.Get(ctx, c.name, &cm)
+	if isNotFound(err) {
+		cm = corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: c.name.Namespace, Name: c.name.Name},
+			BinaryData: map[string][]byte{checkpointKey: data},
+		}
+		return c.client.Create(ctx, &cm)
+	}
+	if err != nil {
+		return err
+	}
+	if cm.BinaryData == nil {
+		cm.BinaryData = map[string][]byte{}
+	}
+	cm.BinaryData[checkpointKey] = data
+	return c.client.Update(ctx, &cm)
+}
+
+func (r *EventWatcher) newCheckpointStore(c client.Client, reader client.Reader) checkpointStore {
+	if r.Checkpoint.File != "" {
+		return fileCheckpointStore{path: r.Checkpoint.File}
+	}
+	name := r.Checkpoint.ConfigMap
+	if r.Sharding != nil { // each replica has different state
+		name.Name += "-" + r.Sharding.Identity
+	}
+	return configMapCheckpointStore{name: name, client: c, reader: reader}
+}
+
+func (r *EventWatcher) saveCheckpoint(ctx context.Context, store checkpointStore) error {
+	var state *checkpointState
+	if err := r.correlate(ctx, func() { state = r.snapshot() }); err != nil {
+		return err
+	}
+	data, err := encodeCheckpoint(state)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode checkpoint")
+	}
+	err = store.save(ctx, data)
+	if err != nil {
+		checkpointsNum.WithLabelValues("error").Inc()
+		return errors.Wrap(err, "unable to save checkpoint")
+	}
+	checkpointsNum.WithLabelValues("saved").Inc()
+	checkpointBytes.Set(float64(len(data)))
+	return nil
+}
+
+func (r *EventWatcher) loadCheckpoint(ctx context.Context, store checkpointStore) error {
+	data, err := store.load(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to load checkpoint")
+	}
+	if data == nil {
+		return nil
+	}
+	state, err := decodeCheckpoint(data)
+	if err != nil {
+		return errors.Wrap(err, "unable to decode checkpoint")
+	}
+	if err := r.correlate(ctx, func() { r.restore(state) }); err != nil {
+		return err
+	}
+	checkpointsNum.WithLabelValues("restored").Inc()
+	r.Log.Info("restored checkpoint", "time", state.Time, "recent", len(state.Recent), "spans", len(state.Spans), "pending", len(state.Pending))
+	return nil
+}
+
+// Saves a checkpoint every interval; the last one is saved by shutdown, after everything held has been sent.
+type checkpointRunnable struct {
+	r        *EventWatcher
+	store    checkpointStore
+	interval time.Duration
+}
+
+// Runs on every replica, though only the leader saves.
+func (c checkpointRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+func (c checkpointRunnable) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+		if !c.r.isLeader() { // a standby would overwrite the leader's checkpoint
+			continue
+		}
+		if err := c.r.saveCheckpoint(context.Background(), c.store); err != nil {
+			c.r.Log.Error(err, "checkpoint")
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package events
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestCheckpointRestore(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+
+	dir, err := ioutil.TempDir("", "kspan-checkpoint")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer os.RemoveAll(dir)
+	store := fileCheckpointStore{path: filepath.Join(dir, "checkpoint")}
+
+	// Before any checkpoint is saved, there is nothing to restore
+	ctx, before, beforeExporter := newRolloutTestEventWatcher(t)
+	defer before.stop()
+	g.Expect(before.loadCheckpoint(ctx, store)).To(o.Succeed())
+	before.handled = newHandledEvents(before.clock)
+
+	events := rolloutEvents(t)
+	for _, event := range events {
+		g.Expect(before.handleEvent(ctx, event)).To(o.Succeed())
+		before.handled.note(event)
+	}
+	g.Expect(before.checkOlderPending(ctx, threshold)).To(o.Succeed())
+	sentBefore := len(beforeExporter.SpanSnapshot)
+	g.Expect(before.outgoing.byRef).NotTo(o.BeEmpty())
+	g.Expect(before.saveCheckpoint(ctx, store)).To(o.Succeed())
+
+	// A new instance picks up where the first one left off
+	_, after, afterExporter := newRolloutTestEventWatcher(t)
+	defer after.stop()
+	after.handled = newHandledEvents(after.clock)
+	g.Expect(after.loadCheckpoint(ctx, store)).To(o.Succeed())
+	g.Expect(after.recent.backend.all()).To(o.HaveLen(len(before.recent.backend.all())))
+	g.Expect(after.outgoing.byRef).To(o.HaveLen(len(before.outgoing.byRef)))
+
+	// Events it already handled are not handled again
+	g.Expect(after.handled.note(events[0])).To(o.BeFalse())
+
+	g.Expect(after.handleEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))).To(o.Succeed())
+	after.flushOutgoing(ctx, threshold.Add(time.Minute))
+
+	// The spans held at the checkpoint go out from the new instance, along with the new one in the same trace
+	before.flushOutgoing(ctx, threshold.Add(time.Minute))
+	g.Expect(afterExporter.SpanSnapshot).To(o.HaveLen(len(beforeExporter.SpanSnapshot) - sentBefore + 1))
+	traceID := rolloutTraceID(t)
+	for _, span := range afterExporter.SpanSnapshot {
+		g.Expect(span.SpanContext.TraceID()).To(o.Equal(traceID), span.Name)
+	}
+	g.Expect(afterExporter.dump()).To(o.ContainElement(o.ContainSubstring("Pod.BackOff")))
+}
+
+// Recent activity saved in a checkpoint keeps only the time it had left, in either backend.
+func TestCheckpointRestoresAgedRecent(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+	dir, err := ioutil.TempDir("", "kspan-checkpoint")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer os.RemoveAll(dir)
+	defer mtime.NowReset()
+
+	backends := map[string]func(logr.Logger) recentBackend{
+		"memory": func(logr.Logger) recentBackend { return newMemoryRecentBackend() },
+		"redis": func(log logr.Logger) recentBackend {
+			return newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log)
+		},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			g := o.NewWithT(t)
+			store := fileCheckpointStore{path: filepath.Join(dir, name)}
+			withBackend := func() *EventWatcher {
+				_, r, _, log := newTestEventWatcher()
+				r.recent = newRecentInfoStore(r.Windows, backend(log), r.clock)
+				return r
+			}
+			key := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2"}}
+			spanContext := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}})
+
+			now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+			expires := now.Add(withBackend().recent.window(key, recentInfo{}).Expire)
+			advance := func(r *EventWatcher, d time.Duration) {
+				r.recent.backend.flush()
+				now = now.Add(d)
+				mtime.NowForce(now)
+				mr.FastForward(d)
+				r.recent.expire()
+			}
+			mtime.NowForce(now)
+
+			before := withBackend()
+			defer before.stop()
+			before.recent.store(key, "", trace.SpanContext{}, spanContext)
+			// Saved a minute later, and loaded into an empty store two minutes after that
+			advance(before, time.Minute)
+			g.Expect(before.saveCheckpoint(context.Background(), store)).To(o.Succeed())
+			mr.FlushAll()
+
+			after := withBackend()
+			defer after.stop()
+			advance(after, 2*time.Minute)
+			g.Expect(after.loadCheckpoint(context.Background(), store)).To(o.Succeed())
+
+			// It lasts until it would have expired had we never stopped, and no longer
+			advance(after, expires.Sub(now)-time.Second)
+			got, found := after.recent.peek(key)
+			g.Expect(found).To(o.BeTrue())
+			g.Expect(got.spanContext).To(o.Equal(spanContext))
+			advance(after, 2*time.Second)
+			_, found = after.recent.peek(key)
+			g.Expect(found).To(o.BeFalse())
+		})
+	}
+}
+
+// Coming back long after a checkpoint, we don't go back to handle events from all that time.
+func TestCheckpointStale(t *testing.T) {
+	g := o.NewWithT(t)
+	dir, err := ioutil.TempDir("", "kspan-checkpoint")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer os.RemoveAll(dir)
+	store := fileCheckpointStore{path: filepath.Join(dir, "checkpoint")}
+	defer mtime.NowReset()
+
+	saved := rolloutThreshold(t)
+	mtime.NowForce(saved)
+	ctx, before, _ := newRolloutTestEventWatcher(t)
+	defer before.stop()
+	g.Expect(before.saveCheckpoint(ctx, store)).To(o.Succeed())
+
+	// Loaded a minute later, events from while we were down are handled
+	mtime.NowForce(saved.Add(time.Minute))
+	_, soon, _ := newRolloutTestEventWatcher(t)
+	defer soon.stop()
+	g.Expect(soon.loadCheckpoint(ctx, store)).To(o.Succeed())
+	g.Expect(soon.startTime).To(o.Equal(saved))
+
+	// Loaded a day later, only those still recent enough to matter
+	now := saved.Add(24 * time.Hour)
+	mtime.NowForce(now)
+	_, after, _ := newRolloutTestEventWatcher(t)
+	defer after.stop()
+	g.Expect(after.loadCheckpoint(ctx, store)).To(o.Succeed())
+	earliest := now.Add(-after.recent.windows.longestExpire())
+	g.Expect(after.startTime).To(o.Equal(earliest))
+	g.Expect(after.tooOld(rolloutBackOff(saved.Add(time.Minute)))).To(o.BeTrue())
+	g.Expect(after.tooOld(rolloutBackOff(now.Add(-time.Minute)))).To(o.BeFalse())
+}
+
+func TestCheckpointAttributes(t *testing.T) {
+	g := o.NewWithT(t)
+	attrs := []attribute.KeyValue{
+		keyObjectKind.String("Pod"),
+		keyEventCount.Int64(3),
+		attribute.Bool("flag", true),
+		attribute.Float64("ratio", 0.5),
+	}
+	data, err := encodeCheckpoint(&checkpointState{Version: checkpointVersion, Spans: []checkpointSpan{{Attributes: toCheckpointAttributes(attrs)}}})
+	g.Expect(err).NotTo(o.HaveOccurred())
+	state, err := decodeCheckpoint(data)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(fromCheckpointAttributes(state.Spans[0].Attributes)).To(o.Equal(attrs))
+}
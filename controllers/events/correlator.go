@@ -0,0 +1,222 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// Everything that reads or changes correlation state - recent activity, pending events, spans waiting
+// to go out - runs on one goroutine, in the order it arrives, so one event's look-then-store can't
+// interleave with another's. Workers do the slow part beforehand, fetching the Event and the objects
+// it refers to, as many at a time as Workers says; the ticker does the same for pending events it is
+// about to give up on.
+
+var errStopped = errors.New("event watcher stopped")
+
+// The time as correlation sees it: mtime.Now(), except while backfill replays old Events at their own
+// times. Only set and read on the correlation goroutine, so everything else keeps the real time.
+type correlationClock struct {
+	replaying time.Time
+}
+
+func (c *correlationClock) now() time.Time {
+	if c == nil || c.replaying.IsZero() {
+		return mtime.Now()
+	}
+	return c.replaying
+}
+
+// The time on the correlation goroutine; see correlationClock.
+func (r *EventWatcher) now() time.Time {
+	return r.clock.now()
+}
+
+func (r *EventWatcher) runCorrelator() {
+	defer close(r.correlatorDone)
+	defer func() { r.recent.backend.close() }() // nothing else writes to it
+	for {
+		select {
+		case f := <-r.work:
+			f()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// correlate runs f on the correlation goroutine, and waits for it to finish, or for ctx to be done.
+// If ctx is done first f may still be running, so nothing it sets can be used.
+// Anything already running there must call what it needs directly, not via correlate.
+func (r *EventWatcher) correlate(ctx context.Context, f func()) error {
+	finished := make(chan struct{})
+	select {
+	case r.work <- func() { defer close(finished); f() }:
+	case <-r.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// What we got when we fetched an object ahead of correlation; errors are kept so they are not retried.
+type prefetchedObject struct {
+	obj runtime.Object
+	err error
+}
+
+// Objects fetched ahead of correlation, by reference.
+type prefetchedObjects map[objectReference]prefetchedObject
+
+type prefetchKey struct{}
+
+// prefetch fetches the objects an event refers to - the involved object, its owners, the actor and
+// the Node it came from - and the recent activity on them, and returns a context carrying the objects, for getObject to use
+// on the correlation goroutine.
+func (r *EventWatcher) prefetch(ctx context.Context, event *corev1.Event) context.Context {
+	objs := make(prefetchedObjects)
+	keys := r.prefetchEvent(ctx, objs, event)
+	r.recent.prefetch(append(keys, objs.recentKeys()...))
+	return context.WithValue(ctx, prefetchKey{}, objs)
+}
+
+// Fetch what event refers to into objs, and return the keys for recent activity it names directly.
+func (r *EventWatcher) prefetchEvent(ctx context.Context, objs prefetchedObjects, event *corev1.Event) []actionReference {
+	r.prefetchNode(ctx, objs, eventSource(event))
+	ref, apiVersion, err := objectFromEvent(ctx, r.Client, event)
+	if err != nil {
+		return nil
+	}
+	r.prefetchObject(ctx, objs, apiVersion, ref.object.Kind, ref.object.Namespace, ref.object.Name)
+	if ref.actor.Name == "" {
+		return nil
+	}
+	r.prefetchObject(ctx, objs, event.InvolvedObject.APIVersion, ref.actor.Kind, ref.actor.Namespace, ref.actor.Name)
+	return []actionReference{ref, {object: ref.actor}}
+}
+
+// Fetch an object and its owners into objs, unless they are there already.
+func (r *EventWatcher) prefetchObject(ctx context.Context, objs prefetchedObjects, apiVersion, kind, namespace, name string) {
+	key := objectReference{Kind: kind, Namespace: lc(namespace), Name: lc(name)}
+	if _, done := objs[key]; done {
+		return
+	}
+	obj, err := r.getObject(ctx, apiVersion, kind, namespace, name)
+	objs[key] = prefetchedObject{obj: obj, err: err}
+	if err != nil {
+		return
+	}
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	for _, ownerRef := range m.GetOwnerReferences() {
+		r.prefetchObject(ctx, objs, ownerRef.APIVersion, ownerRef.Kind, m.GetNamespace(), ownerRef.Name)
+	}
+}
+
+// The keys for recent activity on each object we fetched, as candidatesFromObject will look them up.
+func (objs prefetchedObjects) recentKeys() []actionReference {
+	var keys []actionReference
+	for _, p := range objs {
+		if p.err == nil {
+			keys = append(keys, recentKeysFor(p.obj)...)
+		}
+	}
+	return keys
+}
+
+func prefetched(ctx context.Context, kind, namespace, name string) (prefetchedObject, bool) {
+	objs, ok := ctx.Value(prefetchKey{}).(prefetchedObjects)
+	if !ok {
+		return prefetchedObject{}, false
+	}
+	p, found := objs[objectReference{Kind: kind, Namespace: lc(namespace), Name: lc(name)}]
+	return p, found
+}
+
+// What we note about each pending event, on the correlation goroutine
+type pendingEntry struct {
+	since time.Time         // when it went into pending
+	objs  prefetchedObjects // what was fetched for it, on arrival or since
+}
+
+// A pending event is checked again against what was prefetched for it, on arrival or since.
+func (r *EventWatcher) pendingContext(ctx context.Context, event *corev1.Event) context.Context {
+	if entry, found := r.pendingEntries[event]; found && entry.objs != nil {
+		return context.WithValue(ctx, prefetchKey{}, entry.objs)
+	}
+	return ctx
+}
+
+// Note when an event went into pending, and keep what was prefetched for it, for when it is checked again.
+func (r *EventWatcher) notePending(ctx context.Context, event *corev1.Event) {
+	objs, _ := ctx.Value(prefetchKey{}).(prefetchedObjects)
+	r.pendingEntries[event] = pendingEntry{since: r.now(), objs: objs}
+}
+
+// Off the correlation goroutine, fetch again for the pending events that are due to be given up on,
+// as they will be walked further up their owners then.
+func (r *EventWatcher) prefetchPending(ctx context.Context, threshold time.Time) map[*corev1.Event]prefetchedObjects {
+	var due []*corev1.Event
+	r.Lock()
+	for _, event := range r.pending {
+		if r.olderPending(event, threshold) {
+			due = append(due, event)
+		}
+	}
+	r.Unlock()
+	if len(due) == 0 {
+		return nil
+	}
+	objs := make(prefetchedObjects) // shared, so common owners are fetched once
+	var keys []actionReference
+	for _, event := range due {
+		keys = append(keys, r.prefetchEvent(ctx, objs, event)...)
+	}
+	r.recent.prefetch(append(keys, objs.recentKeys()...))
+	ret := make(map[*corev1.Event]prefetchedObjects, len(due))
+	for _, event := range due {
+		ret[event] = objs
+	}
+	return ret
+}
+
+// On the correlation goroutine: use what prefetchPending fetched, and forget events no longer pending.
+func (r *EventWatcher) updatePendingObjects(fresh map[*corev1.Event]prefetchedObjects) {
+	r.Lock()
+	defer r.Unlock()
+	kept := make(map[*corev1.Event]pendingEntry, len(r.pending))
+	for _, event := range r.pending {
+		entry, found := r.pendingEntries[event]
+		if !found {
+			continue
+		}
+		if objs, found := fresh[event]; found {
+			entry.objs = objs
+		}
+		kept[event] = entry
+	}
+	r.pendingEntries = kept
+}
+
+// How long event has been pending, if it has.
+func (r *EventWatcher) pendingFor(event *corev1.Event) (time.Duration, bool) {
+	entry, found := r.pendingEntries[event]
+	if !found {
+		return 0, false
+	}
+	return r.now().Sub(entry.since), true
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// Lots of events for lots of objects, reconciled by several workers at once; run with -race.
+func TestConcurrentReconcile(t *testing.T) {
+	g := o.NewWithT(t)
+	const (
+		numDeployments = 20
+		eventsEach     = 10
+		workers        = 8
+	)
+	now := mtime.Now()
+	var objs []runtime.Object
+	var requests []ctrl.Request
+	for i := 0; i < numDeployments; i++ {
+		name := fmt.Sprintf("deploy-%d", i)
+		objs = append(objs, &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name), Generation: 1},
+		})
+		for j := 0; j < eventsEach; j++ {
+			eventName := fmt.Sprintf("%s.%d", name, j)
+			objs = append(objs, &corev1.Event{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: eventName, UID: types.UID(eventName)},
+				InvolvedObject: corev1.ObjectReference{
+					APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: name, UID: types.UID(name),
+				},
+				Reason:        "Tested",
+				Message:       eventName,
+				Source:        corev1.EventSource{Component: "tester"},
+				Type:          corev1.EventTypeNormal,
+				LastTimestamp: metav1.NewTime(now),
+			})
+			requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: eventName}})
+		}
+	}
+
+	ctx, r, exporter, _ := newTestEventWatcher(objs...)
+	defer r.stop()
+
+	// Failures are collected and checked here, as gomega must be called on the test goroutine
+	queue := make(chan ctrl.Request)
+	errs := make(chan error, len(requests))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				if _, err := r.Reconcile(req); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, req := range requests {
+		queue <- req
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		g.Expect(err).NotTo(o.HaveOccurred())
+	}
+
+	later := now.Add(time.Hour)
+	var err error
+	g.Expect(r.correlate(ctx, func() {
+		err = r.checkOlderPending(ctx, later)
+		r.flushOutgoing(ctx, later)
+	})).To(o.Succeed())
+	g.Expect(err).NotTo(o.HaveOccurred())
+
+	// Each Deployment has one trace, with one root span and a span for each event
+	roots := make(map[string]int)
+	spans := make(map[string]int)
+	for _, span := range exporter.SpanSnapshot {
+		g.Expect(span.Name).To(o.HavePrefix("Deployment."))
+		name := attributeValue(span.Attributes, keyObjectName)
+		g.Expect(span.SpanContext.TraceID()).To(o.Equal(generationToTraceID(types.UID(name), 1)), name)
+		if span.ParentSpanID.IsValid() {
+			spans[name]++
+		} else {
+			roots[name]++
+		}
+	}
+	g.Expect(roots).To(o.HaveLen(numDeployments))
+	g.Expect(spans).To(o.HaveLen(numDeployments))
+	for i := 0; i < numDeployments; i++ {
+		name := fmt.Sprintf("deploy-%d", i)
+		g.Expect(roots[name]).To(o.Equal(1), name)
+		g.Expect(spans[name]).To(o.Equal(eventsEach), name)
+	}
+}
+
+// Pending events are checked again against the objects fetched for them, not the API server,
+// whether those were fetched when the event arrived or ahead of the tick that gives up waiting.
+func TestPendingUsesPrefetched(t *testing.T) {
+	g := o.NewWithT(t)
+	for _, refetch := range []bool{false, true} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		for _, event := range rolloutEvents(t) {
+			g.Expect(r.handleEvent(r.prefetch(ctx, event), event)).To(o.Succeed())
+		}
+		g.Expect(r.pending).NotTo(o.BeEmpty())
+		if refetch {
+			for event, entry := range r.pendingEntries {
+				r.pendingEntries[event] = pendingEntry{since: entry.since}
+			}
+			r.updatePendingObjects(r.prefetchPending(ctx, rolloutThreshold(t)))
+			for _, entry := range r.pendingEntries {
+				g.Expect(entry.objs).NotTo(o.BeEmpty())
+			}
+		}
+
+		// Everything is gone from the API server by the time we look again
+		r.Client = fake.NewFakeClientWithScheme(r.scheme)
+		finishRollout(t, ctx, r, 0)
+		g.Expect(exporter.dump()).To(o.Equal(rolloutTrace), "refetch=%v", refetch)
+		r.stop()
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"strings"
 	"time"
 
-	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
 	"go.opentelemetry.io/otel/trace"
@@ -55,6 +54,7 @@ func objectFromEvent(ctx context.Context, client client.Client, event *corev1.Ev
 	ret := actionReference{
 		object: objRef,
 	}
+	// If we switch to an object named in the message we don't know its apiVersion; blank means look it up later.
 	apiVersion := event.InvolvedObject.APIVersion
 
 	// TODO: generalise these, take away source- and kind-specific checks
@@ -75,7 +75,7 @@ func objectFromEvent(ctx context.Context, client client.Client, event *corev1.Ev
 		}
 		ret.actor = ret.object
 		ret.object = objectReference{Kind: "Pod", Namespace: lc(ret.object.Namespace), Name: lc(name)}
-		apiVersion = "v1"
+		apiVersion = ""
 	case event.Source.Component == "statefulset-controller" && event.InvolvedObject.Kind == "StatefulSet":
 		// if we have a message like "create Pod ingester-3 in StatefulSet ingester successful"; extract the Pod name
 		name := extractWordAfter(event.Message, "Pod ")
@@ -84,32 +84,20 @@ func objectFromEvent(ctx context.Context, client client.Client, event *corev1.Ev
 		}
 		ret.actor = ret.object
 		ret.object = objectReference{Kind: "Pod", Namespace: lc(ret.object.Namespace), Name: lc(name)}
-		apiVersion = "v1"
+		apiVersion = ""
 	}
 
 	return ret, apiVersion, nil
 }
 
-func (r *EventWatcher) eventToSpan(event *corev1.Event, remoteContext trace.SpanContext) *tracesdk.SpanSnapshot {
+func (r *EventWatcher) eventToSpan(ctx context.Context, event *corev1.Event, c correlation) *tracesdk.SpanSnapshot {
 	// resource says which component the span is seen as coming from
-	res := r.getResource(eventSource(event))
+	res := r.getResource(ctx, eventSource(event))
 
-	attrs := []attribute.KeyValue{
-		attribute.String("kind", event.InvolvedObject.Kind),
-		attribute.String("k8s."+strings.ToLower(event.InvolvedObject.Kind)+".name", event.InvolvedObject.Name),
-	}
-
-	if event.Reason != "" {
-		attrs = append(attrs, attribute.String("reason", event.Reason))
-	}
-	if event.Message != "" {
-		attrs = append(attrs, attribute.String("message", event.Message)) // maybe this should be a log?
-	}
-	if event.Name != "" {
-		attrs = append(attrs, attribute.String("eventID", event.Namespace+"/"+event.Name))
-	}
-	if event.InvolvedObject.Namespace != "" {
-		attrs = append(attrs, attribute.String("k8s.namespace.name", event.InvolvedObject.Namespace))
+	attrs := append(r.objectAttributes(refFromObjRef(event.InvolvedObject), event.InvolvedObject.UID), r.eventAttributes(event)...)
+	attrs = append(attrs, r.projectedAttributes(refFromObjRef(event.InvolvedObject))...)
+	if c.rule != "" {
+		attrs = append(attrs, c.attributes()...)
 	}
 
 	statusCode := codes.Ok
@@ -117,25 +105,32 @@ func (r *EventWatcher) eventToSpan(event *corev1.Event, remoteContext trace.Span
 		statusCode = codes.Error
 	}
 
-	return &tracesdk.SpanSnapshot{
+	span := &tracesdk.SpanSnapshot{
 		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
-			TraceID: remoteContext.TraceID(),
+			TraceID: c.parent.TraceID(),
 			SpanID:  eventToSpanID(event),
 		}),
-		ParentSpanID:    remoteContext.SpanID(),
+		ParentSpanID:    c.parent.SpanID(),
 		SpanKind:        trace.SpanKindInternal,
 		Name:            fmt.Sprintf("%s.%s", event.InvolvedObject.Kind, event.Reason),
 		StartTime:       eventTime(event),
 		EndTime:         eventTime(event),
 		Attributes:      attrs,
+		Links:           c.links,
 		StatusCode:      statusCode,
 		HasRemoteParent: true,
 		Resource:        res,
 		//InstrumentationLibrary instrumentation.Library
 	}
+	r.addMessage(event, span)
+	if r.CollapseRepeats {
+		r.seriesSpan(event, span)
+	}
+	return span
 }
 
 // generate a spanID from an event.  The first time this event is issued has a span ID that can be derived from the event UID
+// (when repeats are collapsed, this is the count at the start of the series)
 func eventToSpanID(event *corev1.Event) trace.SpanID {
 	f := fnv.New64a()
 	_, _ = f.Write([]byte(event.UID))
@@ -170,10 +165,16 @@ func eventSource(event *corev1.Event) source {
 		return source{
 			name:     event.Source.Component,
 			instance: event.Source.Host,
+			node:     event.Source.Host,
 		}
 	}
-	return source{
+	s := source{
 		name:     event.ReportingController,
 		instance: event.ReportingInstance,
 	}
+	// Other controllers report e.g. their Pod name as the instance; only the kubelet's is a Node.
+	if s.name == "kubelet" {
+		s.node = s.instance
+	}
+	return s
 }
@@ -8,18 +8,21 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/prometheus/client_golang/prometheus"
 	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
-	"go.opentelemetry.io/otel/sdk/resource"
-	"go.opentelemetry.io/otel/semconv"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/metadata"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/weaveworks-experiments/kspan/pkg/mtime"
 )
@@ -31,39 +34,105 @@ var (
 // EventWatcher listens to Events
 type EventWatcher struct {
 	sync.Mutex
-	Client    client.Client
-	Log       logr.Logger
-	Exporter  tracesdk.SpanExporter
-	Capture   io.Writer
-	ticker    *time.Ticker
-	startTime time.Time
-	recent    *recentInfoStore
-	pending   []*corev1.Event
-	resources map[source]*resource.Resource
-	outgoing  *outgoing
-	scheme    *runtime.Scheme
+	Client   client.Client
+	Log      logr.Logger
+	Exporter tracesdk.SpanExporter
+	Capture  io.Writer
+
+	// ContainerSpans turns on watching Pods to make spans from container status
+	ContainerSpans bool
+	// Windows controls how long we wait for related events; defaults are used for anything not set
+	Windows Windows
+	// CollapseRepeats makes a repeating event into one span, sent when it has not repeated for RepeatQuietPeriod
+	CollapseRepeats   bool
+	RepeatQuietPeriod time.Duration
+	// ClusterName is added to every resource, if set
+	ClusterName string
+	// NodeLabels lists labels to copy from the Node onto resources for components running on a node, e.g. kubelet
+	NodeLabels []string
+	// Projections copy labels and annotations from the involved object onto spans; from its owners too if ProjectFromOwners
+	Projections       []Projection
+	ProjectFromOwners bool
+	// ResourceCacheSize and ResourceCacheTTL bound the cache of resources by source; zero means use the default
+	ResourceCacheSize int
+	ResourceCacheTTL  time.Duration
+	// LegacyAttributes adds the attribute keys used before we followed the OpenTelemetry conventions
+	LegacyAttributes bool
+	// Redactions are applied to spans and logs before they are sent, and to objects before they are captured
+	Redactions []RedactionRule
+	// Sampling decides which traces to send; nil means all of them. With TailSampling, every span is held
+	// until nothing more can join its trace, then the trace is sent if sampled or if anything in it failed.
+	Sampling     *SampleRates
+	TailSampling bool
+	// Filter says which Events to make spans from; Pods are filtered by its namespaces and object selector
+	Filter Filter
+	// PendingLimit bounds how many events we hold waiting to be mapped; ShedPolicy says which to drop when it is reached
+	PendingLimit int
+	ShedPolicy   ShedPolicy
+	// LeaderElection means another replica may be sending spans; until this one is elected it only
+	// watches, so it is ready to take over
+	LeaderElection bool
+	// Sharding, if set, splits namespaces between replicas so each only handles its own
+	Sharding *Sharding
+	// RedisStore, if set, keeps recent activity in Redis instead of memory, to share it between replicas
+	RedisStore *RedisStore
+	// Backfill, if set, handles Events from up to this long before startup that are still in the API server
+	Backfill time.Duration
+	// Checkpoint, if set, saves our state periodically and restores it at startup
+	Checkpoint *Checkpoint
+	// Workers is how many Events to fetch, along with the objects they refer to, at once;
+	// correlating them is always done one at a time
+	Workers int
+	// ReorderWindow, if set, holds each Event up to this long after it arrives before correlation, so
+	// Events that arrive out of order can be put back in the order they happened
+	ReorderWindow time.Duration
+	// ShutdownTimeout bounds how long we spend sending what we are holding when stopped
+	ShutdownTimeout time.Duration
+	// SelfExporter, if set, receives spans about kspan's own work on each Event: the lookups it made,
+	// what failed, and how long the Event was pending. It is shut down along with the watcher.
+	SelfExporter tracesdk.SpanExporter
+	// Metadata, if set, is used to look up owners and other objects through shared informers that only
+	// hold metadata, instead of fetching whole objects each time
+	Metadata metadata.Interface
+	// Messages says where to put Event messages; LogExporter receives them in MessageLog mode
+	Messages    MessageMode
+	LogExporter LogExporter
+
+	reorder         *reorderBuffer
+	work            chan func() // run in turn by the correlation goroutine, the only one that changes state
+	done            chan struct{}
+	correlatorDone  chan struct{} // closed when the correlation goroutine returns
+	stopOnce        sync.Once
+	flushed         chan struct{} // closed when shutdown has finished
+	checkpointStore checkpointStore
+	tracer          trace.Tracer
+	selfProvider    *sdktrace.TracerProvider
+	startTime       time.Time
+	clock           *correlationClock
+	recent          *recentInfoStore
+	pending         []*corev1.Event
+	pendingEntries  map[*corev1.Event]pendingEntry // on the correlation goroutine only
+	logs            logQueue
+	resources       *resourceCache
+	outgoing        *outgoing
+	scheme          *runtime.Scheme
+	kinds           *kindResolver
+	containerSpans  *seenSpans
+	sampler         *sampler
+	leader          int32 // accessed atomically; non-zero if we should send spans
+	handled         *handledEvents
+	shards          *shards
+	shardCache      *shardCache
+	backfilled      chan struct{} // closed once backfill is done, if we are to backfill
+	objects         *objectStore
+	metadata        *metadataCache
 }
 
 // Info about the source of an event, e.g. kubelet
 type source struct {
 	name     string
 	instance string
-}
-
-var (
-	totalEventsNum = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "kspan",
-			Subsystem: "events",
-			Name:      "total",
-			Help:      "The total number of events.",
-		},
-		[]string{"type", "involved_object", "reason"})
-)
-
-func init() {
-	// Register custom metrics with the global prometheus registry
-	metrics.Registry.MustRegister(totalEventsNum)
+	node     string // set when the instance is known to be a Node
 }
 
 // Reconcile gets called every time an Event changes
@@ -73,7 +142,7 @@ func (r *EventWatcher) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	// Fetch the Event object
 	var event corev1.Event
-	if err := r.Client.Get(ctx, req.NamespacedName, &event); err != nil {
+	if err := r.watchReader().Get(ctx, req.NamespacedName, &event); err != nil {
 		if isNotFound(err) {
 			// we get this on deleted events, which happen all the time; just ignore it.
 			return ctrl.Result{}, nil
@@ -82,24 +151,71 @@ func (r *EventWatcher) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
-	if eventTime(&event).Before(r.startTime.Add(-r.recent.recentWindow)) {
-		// too old - ignore
-		return ctrl.Result{}, nil
+	r.waitForBackfill()
+	r.receiveEvent(ctx, &event)
+	return ctrl.Result{}, nil
+}
+
+// Where Reconcile reads Events and Pods: our own cache when sharding, otherwise the manager's.
+func (r *EventWatcher) watchReader() client.Reader {
+	if r.shardCache != nil {
+		return r.shardCache
+	}
+	return r.Client
+}
+
+// Events from before we started, or before we took over their namespace from another replica,
+// are too old, less the window in which they may still have been waiting to be mapped.
+func (r *EventWatcher) tooOld(event *corev1.Event) bool {
+	notBefore := r.startTime
+	if since := r.shardCache.ownedSince(event.Namespace); since.After(notBefore) {
+		notBefore = since
+	}
+	win, _ := r.recent.windows.forEvent(event)
+	return eventTime(event).Before(notBefore.Add(-win.Recent))
+}
+
+// receiveEvent takes an Event from the leader's controller or the standby's informer.
+// It fetches what the Event refers to, then waits its turn for correlation.
+func (r *EventWatcher) receiveEvent(ctx context.Context, event *corev1.Event) {
+	if r.tooOld(event) {
+		// too old - ignore; backfill looks after these, if enabled
+		return
+	}
+	ctx = r.prefetch(ctx, event)
+	if err := r.correlate(ctx, func() { r.processEvent(ctx, event) }); err != nil {
+		r.Log.Error(err, "unable to handle event", "event", event.Namespace+"/"+event.Name)
+	}
+}
+
+// Everything we do with an Event that isn't too old, on the correlation goroutine; backfill comes in here too.
+func (r *EventWatcher) processEvent(ctx context.Context, event *corev1.Event) {
+	if r.handled != nil && !r.handled.note(event) {
+		// already handled on standby, or before a restart
+		return
 	}
 
-	r.captureObject(&event, "event")
+	r.captureObject(event, "event")
 
 	// Bump Prometheus metrics
 	totalEventsNum.WithLabelValues(event.Type, event.InvolvedObject.Kind, event.Reason).Inc()
 
-	adjustEventTime(&event, mtime.Now())
+	now := r.now()
+	adjustEventTime(event, now)
 
-	err := r.handleEvent(ctx, &event)
-	if err != nil {
-		log.Error(err, "unable to handle event")
+	if r.reorder == nil {
+		r.handleAndLog(ctx, event)
+		return
 	}
+	r.reorder.add(ctx, event, now)
+	r.releaseReordered(now.Add(-r.ReorderWindow))
+}
 
-	return ctrl.Result{}, nil
+func (r *EventWatcher) handleAndLog(ctx context.Context, event *corev1.Event) {
+	err := r.handleEvent(ctx, event)
+	if err != nil {
+		r.Log.Error(err, "unable to handle event", "event", event.Namespace+"/"+event.Name)
+	}
 }
 
 func isNotFound(err error) bool {
@@ -112,17 +228,32 @@ func isNotFound(err error) bool {
 
 // handleEvent is the meat of Reconcile, broken out for ease of testing.
 func (r *EventWatcher) handleEvent(ctx context.Context, event *corev1.Event) error {
+	ctx, selfSpan := r.startSelfSpan(ctx, "handleEvent", event)
+	defer selfSpan.End()
 	log := r.Log.WithValues("event", event.Namespace+"/"+event.Name)
 	log.Info("event", "kind", event.InvolvedObject.Kind, "reason", event.Reason, "source", event.Source.Component)
 
+	if r.filteredOut(ctx, event) {
+		selfSpan.AddEvent("filtered out")
+		return nil
+	}
+	if r.CollapseRepeats && r.addToSeries(ctx, event) {
+		selfSpan.AddEvent("added to series")
+		return nil
+	}
+
 	emitted, err := r.emitSpanFromEvent(ctx, log, event)
 	if err != nil {
+		selfSpan.RecordError(err)
 		if isNotFound(err) { // can't find something - suppress reporting because this happens often
 			err = nil
 		}
 		return err
 	}
+	selfSpan.SetAttributes(keySelfEmitted.Bool(emitted))
 	if emitted { // a new span may allow us to map one that was saved from earlier
+		_, windowName := r.recent.windows.forEvent(event)
+		windowEventsNum.WithLabelValues(windowName, "within").Inc()
 		err := r.checkPending(ctx)
 		if err != nil && !isNotFound(err) {
 			log.Error(err, "while checking pending events")
@@ -130,8 +261,11 @@ func (r *EventWatcher) handleEvent(ctx context.Context, event *corev1.Event) err
 	} else {
 		// keep this event pending for a bit, see if something shows up that will let us map it.
 		r.Lock()
-		r.pending = append(r.pending, event)
+		kept := r.addPending(event)
 		r.Unlock()
+		if kept {
+			r.notePending(ctx, event)
+		}
 	}
 	return nil
 }
@@ -139,7 +273,7 @@ func (r *EventWatcher) handleEvent(ctx context.Context, event *corev1.Event) err
 // If our rules tell us to map this event immediately to a context, do that.
 func mapEventDirectlyToContext(ctx context.Context, client client.Client, event *corev1.Event, involved runtime.Object) (success bool, remoteContext trace.SpanContext, err error) {
 	// The controller that issued this event has marked it as top-level
-	if event.Annotations["topLevelSpan"] == "true" {
+	if isTopLevelEvent(event) {
 		m, _ := meta.Accessor(involved)
 		remoteContext = trace.NewSpanContext(trace.SpanContextConfig{
 			TraceID: objectToTraceID(m),
@@ -149,137 +283,98 @@ func mapEventDirectlyToContext(ctx context.Context, client client.Client, event
 	return
 }
 
+func isTopLevelEvent(event *corev1.Event) bool {
+	return event.Annotations["topLevelSpan"] == "true"
+}
+
 // attempt to map an Event to one or more Spans; return true if a Span was emitted
 func (r *EventWatcher) emitSpanFromEvent(ctx context.Context, log logr.Logger, event *corev1.Event) (bool, error) {
+	ctx, selfSpan := r.startSelfSpan(ctx, "emitSpanFromEvent", event)
+	defer selfSpan.End()
 	ref, apiVersion, err := objectFromEvent(ctx, r.Client, event)
 	if err != nil {
+		selfSpan.RecordError(err)
 		return false, err
 	}
 
-	var remoteContext trace.SpanContext
-	var success bool
-	if ref.actor.Name != "" {
-		// See if we have a recent event matching exactly this ref, and use its parent if found
-		_, remoteContext, success = r.recent.lookupSpanContext(ref)
-		if !success {
-			// Try the owner on its own, and if found use that as the parent
-			remoteContext, _, success = r.recent.lookupSpanContext(actionReference{object: ref.actor})
-		}
-	}
-	var involved runtime.Object
-	if !success {
-		involved, err = getObject(ctx, r.Client, apiVersion, ref.object.Kind, ref.object.Namespace, ref.object.Name)
+	// Collect every candidate parent, then pick the best.
+	candidates := r.recent.candidatesFromRef(ref)
+	// If we already have a perfect match, don't go fetching objects.
+	if best, found := bestCandidate(candidates); !found || best.score < perfectScore || isTopLevelEvent(event) {
+		involved, err := r.getObject(ctx, apiVersion, ref.object.Kind, ref.object.Namespace, ref.object.Name)
 		if err == nil {
 			r.captureObject(involved, "initial")
 			// If our rules tell us to map this event immediately to a context, do that.
-			success, remoteContext, err = mapEventDirectlyToContext(ctx, r.Client, event, involved)
+			success, remoteContext, err := mapEventDirectlyToContext(ctx, r.Client, event, involved)
 			if err != nil {
 				return false, err
 			}
+			if success {
+				candidates = append(candidates, candidate{correlation: correlation{parent: remoteContext, rule: ruleDirect, score: relationWeights[ruleDirect]}})
+			}
+			// If the involved object (or its owner) maps to recent activity, make a span parented off that.
+			objCandidates, err := r.recent.candidatesFromObject(involved)
+			if err != nil {
+				return false, err
+			}
+			candidates = append(candidates, objCandidates...)
 		}
-	}
-	if !success {
-		// If the involved object (or its owner) maps to recent activity, make a span parented off that.
-		remoteContext, err = recentSpanContextFromObject(ctx, involved, r.recent)
-		if err != nil {
-			return false, err
-		}
-		success = remoteContext.HasTraceID()
-	}
-	if !success {
 		// If we have an actor distinct from the object, try the actor
 		if ref.actor.Name != "" {
-			involved, err = getObject(ctx, r.Client, event.InvolvedObject.APIVersion, ref.actor.Kind, ref.actor.Namespace, ref.actor.Name)
+			actor, err := r.getObject(ctx, event.InvolvedObject.APIVersion, ref.actor.Kind, ref.actor.Namespace, ref.actor.Name)
 			if err == nil {
-				r.captureObject(involved, "initial")
-				remoteContext, err = recentSpanContextFromObject(ctx, involved, r.recent)
+				r.captureObject(actor, "initial")
+				actorCandidates, err := r.recent.candidatesFromObject(actor)
 				if err != nil {
 					return false, err
 				}
-				success = remoteContext.HasTraceID()
+				candidates = append(candidates, indirect(actorCandidates)...)
 			}
 		}
 	}
+	c, success := r.recent.choose(candidates)
+	selfSpan.SetAttributes(keySelfCandidates.Int(len(candidates)), keySelfEmitted.Bool(success))
 	if !success {
 		return false, nil
 	}
+	selfSpan.SetAttributes(keySelfRule.String(c.rule))
 
 	// Send out a span from the event details
-	span := r.eventToSpan(event, remoteContext)
-	r.emitSpan(ctx, ref.object, span)
-	r.recent.store(ref, remoteContext, span.SpanContext)
+	r.fetchForProjection(ctx, event.InvolvedObject.APIVersion, refFromObjRef(event.InvolvedObject))
+	span := r.eventToSpan(ctx, event, c)
+	r.emitEventSpan(ctx, ref.object, event, span)
+	r.recent.store(ref, eventSource(event).name, c.parent, span.SpanContext)
 
 	return true, nil
 }
 
-func (r *EventWatcher) getResource(s source) *resource.Resource {
-	r.Lock()
-	defer r.Unlock()
-	res, found := r.resources[s]
-	if !found {
-		// Make a new resource and cache for later.  TODO: cache eviction
-		res = resource.NewWithAttributes(semconv.ServiceNameKey.String(s.name), semconv.ServiceInstanceIDKey.String(s.instance))
-		r.resources[s] = res
-	}
-	return res
-}
-
-func recentSpanContextFromObject(ctx context.Context, obj runtime.Object, recent *recentInfoStore) (trace.SpanContext, error) {
-	m, err := meta.Accessor(obj)
+func (r *EventWatcher) makeSpanContextFromObject(ctx context.Context, obj runtime.Object, eventTime time.Time) (correlation, error) {
+	// See if we have any recent relevant event
+	candidates, err := r.recent.candidatesFromObject(obj)
 	if err != nil {
-		return noTrace, err
+		return correlation{parent: noTrace}, err
 	}
-	// If no owners, this is a top-level object
-	if len(m.GetOwnerReferences()) == 0 {
-		objRef := refFromObject(m)
-		if spanContext, _, found := recent.lookupSpanContext(actionReference{object: objRef}); found {
-			return spanContext, nil
-		}
-	}
-	// See if we have any recent event for an owner
-	for _, ownerRef := range m.GetOwnerReferences() {
-		ref := actionReference{
-			actor:  refFromOwner(ownerRef, m.GetNamespace()),
-			object: refFromObject(m),
-		}
-		if spanContext, _, found := recent.lookupSpanContext(ref); found {
-			return spanContext, nil
-		}
-		// See if we can find a sibling event for the object on its own
-		if _, parentContext, found := recent.lookupSpanContext(actionReference{object: ref.object}); found {
-			return parentContext, nil
-		}
-		// Try the owner on its own; make that the parent if found
-		if spanContext, _, found := recent.lookupSpanContext(actionReference{object: ref.actor}); found {
-			return spanContext, nil
-		}
-	}
-	return noTrace, err
-}
-
-func (r *EventWatcher) makeSpanContextFromObject(ctx context.Context, obj runtime.Object, eventTime time.Time) (trace.SpanContext, error) {
-	// See if we have any recent relevant event
-	if sc, err := recentSpanContextFromObject(ctx, obj, r.recent); err != nil || sc.HasTraceID() {
-		return sc, err
+	if c, found := r.recent.choose(candidates); found {
+		return c, nil
 	}
 
 	m, err := meta.Accessor(obj)
 	if err != nil {
-		return noTrace, err
+		return correlation{parent: noTrace}, err
 	}
 	// If no recent event, recurse over owners
 	for _, ownerRef := range m.GetOwnerReferences() {
-		owner, err := getObject(ctx, r.Client, ownerRef.APIVersion, ownerRef.Kind, m.GetNamespace(), ownerRef.Name)
+		owner, err := r.getObject(ctx, ownerRef.APIVersion, ownerRef.Kind, m.GetNamespace(), ownerRef.Name)
 		if err != nil {
-			return noTrace, err
+			return correlation{parent: noTrace}, err
 		}
 		r.captureObject(owner, "initial")
-		remoteContext, err := r.makeSpanContextFromObject(ctx, owner, eventTime)
+		c, err := r.makeSpanContextFromObject(ctx, owner, eventTime)
 		if err != nil {
-			return noTrace, err
+			return correlation{parent: noTrace}, err
 		}
-		if remoteContext.HasTraceID() {
-			return remoteContext, nil
+		if c.parent.HasTraceID() {
+			return c, nil
 		}
 	}
 	// If no owners and no recent data, create a span based off this top-level object
@@ -290,49 +385,210 @@ func (r *EventWatcher) makeSpanContextFromObject(ctx context.Context, obj runtim
 		spanData, err := r.createTraceFromTopLevelObject(ctx, obj, eventTime)
 
 		if err != nil {
-			return noTrace, err
+			return correlation{parent: noTrace}, err
 		}
+		r.sampler.noteRoot(spanData)
 		r.emitSpan(ctx, ref.object, spanData)
-		r.recent.store(ref, noTrace, spanData.SpanContext)
-		return spanData.SpanContext, nil
+		r.recent.store(ref, "", noTrace, spanData.SpanContext)
+		return correlation{parent: spanData.SpanContext, rule: ruleNewTrace, score: relationWeights[ruleNewTrace]}, nil
 	}
-	return noTrace, nil
+	return correlation{parent: noTrace}, nil
 }
 
-func (r *EventWatcher) runTicker() {
-	// Need to check more often than the window, otherwise things will be too old.
-	r.ticker = time.NewTicker(r.recent.recentWindow / 2)
-	for range r.ticker.C {
-		err := r.checkOlderPending(context.Background(), mtime.Now().Add(-r.recent.recentWindow))
-		if err != nil {
-			r.Log.Error(err, "from checkOlderPending")
-		}
-		r.recent.expire()
-		r.flushOutgoing(context.Background(), mtime.Now().Add(-2*r.recent.recentWindow))
+// Pending events from before this have waited long enough as of now, at the default window.
+func (r *EventWatcher) olderPendingThreshold(now time.Time) time.Time {
+	return now.Add(-r.recent.windows.Default.Recent)
+}
+
+// Send out and throw away whatever has been held long enough, as of r.now().
+func (r *EventWatcher) tick(ctx context.Context) {
+	windows := r.recent.windows
+	now := r.now()
+	if r.reorder != nil {
+		r.releaseReordered(now.Add(-r.ReorderWindow))
+	}
+	err := r.checkOlderPending(ctx, r.olderPendingThreshold(now))
+	if err != nil {
+		r.Log.Error(err, "from checkOlderPending")
+	}
+	r.recent.expire()
+	podWindow, _ := windows.forSource("kubelet", "Pod")
+	r.containerSpans.expire(now.Add(-podWindow.Expire))
+	r.objects.expire(now.Add(-windows.Default.Expire))
+	r.resources.expire()
+	if r.metadata != nil {
+		r.metadata.prune()
+	}
+	r.outgoing.Lock()
+	held := r.outgoing.heldTraces()
+	for traceID := range r.outgoing.tail {
+		held[traceID] = struct{}{}
+	}
+	r.outgoing.Unlock()
+	r.sampler.expire(now.Add(-windows.longestExpire()), held)
+	if r.handled != nil {
+		r.handled.expire(now.Add(-windows.Default.Expire))
+	}
+	r.flushOutgoing(ctx, now.Add(-2*windows.Default.Recent))
+	if r.CollapseRepeats {
+		r.flushSeries(ctx, now.Add(-r.RepeatQuietPeriod))
+	}
+	if r.TailSampling {
+		r.flushTailTraces(ctx, now)
 	}
 }
 
-func (r *EventWatcher) initialize(scheme *runtime.Scheme) {
+func (r *EventWatcher) initialize(scheme *runtime.Scheme, mapper meta.RESTMapper) {
 	r.Lock()
 	r.startTime = mtime.Now()
+	r.clock = &correlationClock{}
 	r.scheme = scheme
-	r.recent = newRecentInfoStore()
-	r.resources = make(map[source]*resource.Resource)
+	r.kinds = newKindResolver(mapper)
+	var backend recentBackend
+	if r.RedisStore != nil {
+		backend = newRedisRecentBackend(*r.RedisStore, r.Log.WithName("redis"))
+	}
+	r.recent = newRecentInfoStore(r.Windows, backend, r.clock)
+	r.resources = newResourceCache(r.ResourceCacheSize, r.ResourceCacheTTL)
 	r.outgoing = newOutgoing()
+	r.pendingEntries = make(map[*corev1.Event]pendingEntry)
+	r.containerSpans = newSeenSpans(r.clock)
+	r.objects = newObjectStore(r.Projections)
+	r.sampler = newSampler(r.Sampling, r.clock)
+	r.initSelfTracing()
+	if r.Metadata != nil {
+		r.metadata = newMetadataCache(r.Metadata, mapper, r.metadataNamespaces())
+	}
+	r.setLeader(!r.LeaderElection)
+	// A new shard cache replays Events we already handled in the namespaces we keep
+	if r.LeaderElection || r.Checkpoint != nil || r.Sharding != nil {
+		r.handled = newHandledEvents(r.clock)
+	}
+	if r.PendingLimit == 0 {
+		r.PendingLimit = defaultPendingLimit
+	}
+	if r.ShedPolicy == "" {
+		r.ShedPolicy = ShedOldest
+	}
+	if r.RepeatQuietPeriod == 0 {
+		r.RepeatQuietPeriod = defaultRepeatQuietPeriod
+	}
+	if r.ReorderWindow > 0 {
+		r.reorder = &reorderBuffer{}
+	}
+	if r.Workers == 0 {
+		r.Workers = 1
+	}
+	if r.ShutdownTimeout == 0 {
+		r.ShutdownTimeout = defaultShutdownTimeout
+	}
+	r.work = make(chan func())
+	r.done = make(chan struct{})
+	r.correlatorDone = make(chan struct{})
+	r.flushed = make(chan struct{})
 	r.Unlock()
-	go r.runTicker()
+	go r.runCorrelator()
 }
 
-func (r *EventWatcher) stop() {
-	if r.ticker != nil {
-		r.ticker.Stop()
+// Which namespaces the metadata cache should watch: nil for the whole cluster, unless we only handle
+// some namespaces, as listed or as our shard. r.shards is read when asked, as it is set up after this.
+func (r *EventWatcher) metadataNamespaces() func(string) bool {
+	if len(r.Filter.IncludeNamespaces) == 0 && r.Sharding == nil {
+		return nil
+	}
+	return func(namespace string) bool {
+		return allowed(r.Filter.IncludeNamespaces, r.Filter.ExcludeNamespaces, namespace) && r.shards.owns(namespace)
 	}
 }
 
+// Stop the correlation goroutine and anything else we started; safe to call more than once.
+func (r *EventWatcher) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+		if r.metadata != nil {
+			r.metadata.stop()
+		}
+	})
+}
+
 // SetupWithManager to set up the watcher
 func (r *EventWatcher) SetupWithManager(mgr ctrl.Manager) error {
-	r.initialize(mgr.GetScheme())
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Event{}).
-		Complete(r)
+	r.initialize(mgr.GetScheme(), mgr.GetRESTMapper())
+	if err := mgr.Add(tickerRunnable{r: r}); err != nil {
+		return err
+	}
+	if r.Sharding != nil {
+		r.shards = newShards(*r.Sharding, mgr.GetClient(), mgr.GetAPIReader(), r.Log.WithName("shards"))
+		// Find out who else is there before we start, so we don't handle everything until the first renewal
+		if err := r.shards.sync(context.Background()); err != nil {
+			return err
+		}
+		if err := mgr.Add(r.shards); err != nil {
+			return err
+		}
+		newCache := func(namespaces []string) (cache.Cache, error) {
+			return cache.MultiNamespacedCacheBuilder(namespaces)(mgr.GetConfig(), cache.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+		}
+		r.shardCache = newShardCache(r.shards, &r.Filter, mgr.GetAPIReader(), newCache, r.Log.WithName("shard-cache"))
+		if err := mgr.Add(r.shardCache); err != nil {
+			return err
+		}
+	}
+	if r.Checkpoint != nil {
+		store := r.newCheckpointStore(mgr.GetClient(), mgr.GetAPIReader())
+		r.checkpointStore = store // for the last save, at shutdown
+		// Better to start afresh than not at all
+		if err := r.loadCheckpoint(context.Background(), store); err != nil {
+			r.Log.Error(err, "starting without checkpoint")
+		}
+		interval := r.Checkpoint.Interval
+		if interval == 0 {
+			interval = defaultCheckpointInterval
+		}
+		if err := mgr.Add(checkpointRunnable{r: r, store: store, interval: interval}); err != nil {
+			return err
+		}
+	}
+	// Only the replica sending spans backfills, once it is elected
+	var backfill *backfillRunnable
+	if r.Backfill > 0 {
+		r.backfilled = make(chan struct{})
+		backfill = &backfillRunnable{r: r, reader: mgr.GetAPIReader()}
+	}
+	if r.LeaderElection {
+		if err := mgr.Add(leaderRunnable{r: r, backfill: backfill}); err != nil {
+			return err
+		}
+		if err := mgr.Add(standbyRunnable{r: r, cache: mgr.GetCache()}); err != nil {
+			return err
+		}
+	} else if backfill != nil {
+		if err := mgr.Add(*backfill); err != nil {
+			return err
+		}
+	}
+	if r.ContainerSpans {
+		if err := r.addController(mgr, "pod", &corev1.Pod{}, reconcile.Func(r.ReconcilePod), r.Filter.podPredicate()); err != nil {
+			return err
+		}
+	}
+	return r.addController(mgr, "event", &corev1.Event{}, r, r.Filter.eventPredicate())
+}
+
+// Watch objects of one kind, through the manager's cache, or the shard cache when sharding.
+func (r *EventWatcher) addController(mgr ctrl.Manager, name string, obj runtime.Object, reconciler reconcile.Reconciler, filter predicate.Predicate) error {
+	options := controller.Options{MaxConcurrentReconciles: r.Workers}
+	if r.shardCache == nil {
+		return ctrl.NewControllerManagedBy(mgr).
+			For(obj).
+			WithOptions(options).
+			WithEventFilter(filter).
+			Complete(reconciler)
+	}
+	options.Reconciler = reconciler
+	c, err := controller.New(name, mgr, options)
+	if err != nil {
+		return err
+	}
+	return c.Watch(r.shardCache.source(obj), &handler.EnqueueRequestForObject{}, filter, r.shards.predicate())
 }
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Filter says which Events to turn into spans. An empty include list means everything;
+// exclude lists take precedence over include lists.
+type Filter struct {
+	IncludeNamespaces, ExcludeNamespaces []string
+	IncludeReasons, ExcludeReasons       []string
+	IncludeSources, ExcludeSources       []string        // source component, e.g. "kubelet"
+	IncludeKinds, ExcludeKinds           []string        // involved object kind
+	ObjectSelector                       labels.Selector // on the involved object; nil means everything
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func allowed(include, exclude []string, s string) bool {
+	return !contains(exclude, s) && (len(include) == 0 || contains(include, s))
+}
+
+// Checks everything we can tell from the Event itself; returns the name of the filter that rejected it, if any.
+func (f *Filter) rejectEvent(event *corev1.Event) string {
+	switch {
+	case !allowed(f.IncludeNamespaces, f.ExcludeNamespaces, event.Namespace):
+		return "namespace"
+	case !allowed(f.IncludeReasons, f.ExcludeReasons, event.Reason):
+		return "reason"
+	case !allowed(f.IncludeSources, f.ExcludeSources, eventSource(event).name):
+		return "source"
+	case !allowed(f.IncludeKinds, f.ExcludeKinds, event.InvolvedObject.Kind):
+		return "kind"
+	}
+	return ""
+}
+
+// Predicate to stop controller-runtime queueing Events we don't want, so we never fetch them.
+// Drops are counted on Create only, so an Event that repeats or is resynced counts once.
+func (f *Filter) eventPredicate() predicate.Predicate {
+	accept := func(obj runtime.Object, count bool) bool {
+		event, ok := obj.(*corev1.Event)
+		if !ok {
+			return true
+		}
+		if reason := f.rejectEvent(event); reason != "" {
+			if count {
+				filteredEventsNum.WithLabelValues(reason).Inc()
+			}
+			return false
+		}
+		return true
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return accept(e.Object, true) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return accept(e.ObjectNew, false) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return accept(e.Object, false) },
+		GenericFunc: func(e event.GenericEvent) bool { return accept(e.Object, false) },
+	}
+}
+
+// The namespace and object selector apply to Pods too.
+func (f *Filter) acceptPod(m metav1.Object) bool {
+	if !allowed(f.IncludeNamespaces, f.ExcludeNamespaces, m.GetNamespace()) {
+		return false
+	}
+	return f.ObjectSelector == nil || f.ObjectSelector.Matches(labels.Set(m.GetLabels()))
+}
+
+// Predicate for the Pod watch.
+func (f *Filter) podPredicate() predicate.Predicate {
+	accept := f.acceptPod
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return accept(e.Meta) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return accept(e.MetaNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return accept(e.Meta) },
+		GenericFunc: func(e event.GenericEvent) bool { return accept(e.Meta) },
+	}
+}
+
+// Apply the filter in full, including the selector on the involved object, which may mean fetching it.
+// Returns true if the event should be dropped.
+func (r *EventWatcher) filteredOut(ctx context.Context, event *corev1.Event) bool {
+	if !r.shards.owns(event.InvolvedObject.Namespace) { // another replica's; not counted as dropped
+		return true
+	}
+	reason := r.Filter.rejectEvent(event)
+	if reason == "" && r.Filter.ObjectSelector != nil && !r.Filter.ObjectSelector.Empty() {
+		ref := refFromObjRef(event.InvolvedObject)
+		info, found := r.objects.get(ref)
+		if !found {
+			_, err := r.getObject(ctx, event.InvolvedObject.APIVersion, ref.Kind, ref.Namespace, ref.Name)
+			info, found = r.objects.get(ref)
+			if err != nil || !found {
+				return false // can't tell, so let it through
+			}
+		}
+		if !r.Filter.ObjectSelector.Matches(labels.Set(info.labels)) {
+			reason = "selector"
+		}
+	}
+	if reason != "" {
+		filteredEventsNum.WithLabelValues(reason).Inc()
+		return true
+	}
+	return false
+}
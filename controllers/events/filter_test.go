@@ -0,0 +1,93 @@
+package events
+
+import (
+	"testing"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestFilterEvent(t *testing.T) {
+	g := o.NewWithT(t)
+	f := Filter{
+		ExcludeNamespaces: []string{"kube-system"},
+		IncludeReasons:    []string{"Scheduled", "BackOff"},
+		ExcludeSources:    []string{"kubelet"},
+		ExcludeKinds:      []string{"Node"},
+	}
+	mkEvent := func(namespace, reason, source, kind string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: namespace, Name: "x"},
+			InvolvedObject: corev1.ObjectReference{Kind: kind, Namespace: namespace, Name: "x"},
+			Reason:         reason,
+			Source:         corev1.EventSource{Component: source},
+		}
+	}
+	g.Expect(f.rejectEvent(mkEvent("default", "Scheduled", "default-scheduler", "Pod"))).To(o.Equal(""))
+	g.Expect(f.rejectEvent(mkEvent("kube-system", "Scheduled", "default-scheduler", "Pod"))).To(o.Equal("namespace"))
+	g.Expect(f.rejectEvent(mkEvent("default", "Pulled", "default-scheduler", "Pod"))).To(o.Equal("reason"))
+	g.Expect(f.rejectEvent(mkEvent("default", "BackOff", "kubelet", "Pod"))).To(o.Equal("source"))
+	g.Expect(f.rejectEvent(mkEvent("default", "BackOff", "node-controller", "Node"))).To(o.Equal("kind"))
+
+	p := f.eventPredicate()
+	ev := mkEvent("default", "Scheduled", "default-scheduler", "Pod")
+	g.Expect(p.Create(event.CreateEvent{Meta: ev, Object: ev})).To(o.BeTrue())
+	ev = mkEvent("kube-system", "Scheduled", "default-scheduler", "Pod")
+	dropped := testutil.ToFloat64(filteredEventsNum.WithLabelValues("namespace"))
+	g.Expect(p.Create(event.CreateEvent{Meta: ev, Object: ev})).To(o.BeFalse())
+	g.Expect(p.Update(event.UpdateEvent{MetaNew: ev, ObjectNew: ev})).To(o.BeFalse())
+	g.Expect(p.Generic(event.GenericEvent{Meta: ev, Object: ev})).To(o.BeFalse())
+	g.Expect(p.Delete(event.DeleteEvent{Meta: ev, Object: ev})).To(o.BeFalse())
+	// Counted once, when the Event is created
+	g.Expect(testutil.ToFloat64(filteredEventsNum.WithLabelValues("namespace")) - dropped).To(o.Equal(1.0))
+
+	// An empty filter lets everything through
+	g.Expect((&Filter{}).rejectEvent(ev)).To(o.Equal(""))
+}
+
+func TestFilterObjectSelector(t *testing.T) {
+	g := o.NewWithT(t)
+
+	var (
+		deploy1 unstructured.Unstructured
+		pod1    unstructured.Unstructured
+	)
+	mustParse(t, deploy1str, &deploy1)
+	mustParse(t, pod1str, &pod1)
+
+	ctx, r, exporter, _ := newTestEventWatcher(&deploy1, &pod1)
+	defer r.stop()
+	selector, err := labels.Parse("name=hello-world")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	r.Filter.ObjectSelector = selector
+
+	mkEvent := func(ref corev1.ObjectReference) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: ref.Name + ".test"},
+			InvolvedObject: ref,
+			Reason:         "Test",
+			Source:         corev1.EventSource{Component: "test"},
+		}
+	}
+	// The Pod has the label, the Deployment doesn't
+	podEvent := mkEvent(corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: pod1.GetName()})
+	g.Expect(r.filteredOut(ctx, podEvent)).To(o.BeFalse())
+	deployEvent := mkEvent(corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: deploy1.GetName()})
+	g.Expect(r.filteredOut(ctx, deployEvent)).To(o.BeTrue())
+	g.Expect(r.handleEvent(ctx, deployEvent)).To(o.Succeed())
+	g.Expect(r.pending).To(o.BeEmpty())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	// If we can't find the object we can't tell, so let it through
+	goneEvent := mkEvent(corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "gone"})
+	g.Expect(r.filteredOut(ctx, goneEvent)).To(o.BeFalse())
+
+	p := r.Filter.podPredicate()
+	g.Expect(p.Create(event.CreateEvent{Meta: &pod1, Object: &pod1})).To(o.BeTrue())
+	g.Expect(p.Create(event.CreateEvent{Meta: &deploy1, Object: &deploy1})).To(o.BeFalse())
+}
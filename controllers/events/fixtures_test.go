@@ -2322,3 +2322,80 @@ status:
   qosClass: Burstable
   startTime: "2021-02-17T14:21:02Z"
 `
+
+// The Pod from deploymentUpdateEvents after its containers have started, with an init container
+// and a previous run of the main container that ran out of memory.
+var pod1RunningStr = `
+apiVersion: v1
+kind: Pod
+metadata:
+  creationTimestamp: "2020-11-27T12:04:05Z"
+  generateName: hello-world-6b9d85fbd6-
+  labels:
+    name: hello-world
+    pod-template-hash: 6b9d85fbd6
+  name: hello-world-6b9d85fbd6-klpv2
+  namespace: default
+  ownerReferences:
+  - apiVersion: apps/v1
+    blockOwnerDeletion: true
+    controller: true
+    kind: ReplicaSet
+    name: hello-world-6b9d85fbd6
+    uid: b2fcb2a4-ed25-49dc-87de-db6cf8ec7a00
+  resourceVersion: "649460"
+  uid: deb2b4f7-e312-44dd-bd06-7c00d0f5695a
+spec:
+  initContainers:
+  - image: busybox
+    name: init-config
+  containers:
+  - image: nginx:1.19.2-alpine
+    name: hello-world
+  nodeName: kind-control-plane
+status:
+  conditions:
+  - lastTransitionTime: "2020-11-27T12:04:06Z"
+    status: "True"
+    type: Initialized
+  - lastTransitionTime: "2020-11-27T12:04:09Z"
+    status: "True"
+    type: Ready
+  - lastTransitionTime: "2020-11-27T12:04:09Z"
+    status: "True"
+    type: ContainersReady
+  - lastTransitionTime: "2020-11-27T12:04:05Z"
+    status: "True"
+    type: PodScheduled
+  initContainerStatuses:
+  - image: busybox:latest
+    name: init-config
+    ready: true
+    restartCount: 0
+    state:
+      terminated:
+        exitCode: 0
+        finishedAt: "2020-11-27T12:04:06Z"
+        reason: Completed
+        startedAt: "2020-11-27T12:04:05Z"
+  containerStatuses:
+  - image: nginx:1.19.2-alpine
+    lastState:
+      terminated:
+        exitCode: 137
+        finishedAt: "2020-11-27T12:04:07Z"
+        reason: OOMKilled
+        startedAt: "2020-11-27T12:04:06Z"
+    name: hello-world
+    ready: true
+    restartCount: 1
+    started: true
+    state:
+      running:
+        startedAt: "2020-11-27T12:04:08Z"
+  hostIP: 172.18.0.2
+  phase: Running
+  podIP: 10.244.0.10
+  qosClass: BestEffort
+  startTime: "2020-11-27T12:04:05Z"
+`
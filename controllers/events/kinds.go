@@ -0,0 +1,72 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// Don't ask for discovery to be refreshed more often than this for the same kind
+const kindRefreshInterval = time.Minute
+
+// Mappers that can throw away what they know and go back to discovery, e.g. DeferredDiscoveryRESTMapper
+type resettable interface {
+	Reset()
+}
+
+// kindResolver finds the preferred apiVersion for a Kind, when all we have is the Kind
+// e.g. in an Event reference to a Node, or a Pod named in an Event message.
+type kindResolver struct {
+	sync.Mutex
+	mapper meta.RESTMapper
+
+	apiVersions map[string]string    // Kind -> apiVersion
+	unknown     map[string]time.Time // Kind -> when we last failed to find it
+}
+
+func newKindResolver(mapper meta.RESTMapper) *kindResolver {
+	return &kindResolver{
+		mapper:      mapper,
+		apiVersions: make(map[string]string),
+		unknown:     make(map[string]time.Time),
+	}
+}
+
+func (k *kindResolver) apiVersionFor(kind string) (string, error) {
+	k.Lock()
+	defer k.Unlock()
+	if apiVersion, found := k.apiVersions[kind]; found {
+		return apiVersion, nil
+	}
+	gvk, err := k.lookup(kind)
+	if meta.IsNoMatchError(err) {
+		// Maybe a CRD was added since we last looked; refresh discovery, but not too often.
+		if last, found := k.unknown[kind]; found && mtime.Now().Sub(last) < kindRefreshInterval {
+			return "", err
+		}
+		k.unknown[kind] = mtime.Now()
+		if r, ok := k.mapper.(resettable); ok {
+			r.Reset()
+			gvk, err = k.lookup(kind)
+		}
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to find apiVersion for kind %q", kind)
+	}
+	delete(k.unknown, kind)
+	apiVersion := gvk.GroupVersion().String()
+	k.apiVersions[kind] = apiVersion
+	return apiVersion, nil
+}
+
+// Discovery registers the lower-case Kind as the singular resource name, and for a partial
+// resource the mapper will give us the preferred group and version.
+func (k *kindResolver) lookup(kind string) (schema.GroupVersionKind, error) {
+	return k.mapper.KindFor(schema.GroupVersionResource{Resource: strings.ToLower(kind)})
+}
@@ -0,0 +1,53 @@
+package events
+
+import (
+	"testing"
+
+	o "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// A RESTMapper that only learns about batch/v1 when it is reset, like a CRD added after we started.
+type resettableMapper struct {
+	*meta.DefaultRESTMapper
+	resets int
+}
+
+func (m *resettableMapper) Reset() {
+	m.resets++
+	m.DefaultRESTMapper.Add(batchv1.SchemeGroupVersion.WithKind("Job"), meta.RESTScopeNamespace)
+}
+
+func Test_kindResolver(t *testing.T) {
+	g := o.NewWithT(t)
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	mapper := &resettableMapper{DefaultRESTMapper: newTestRESTMapper(scheme)}
+	k := newKindResolver(mapper)
+
+	tests := []struct {
+		kind           string
+		wantAPIVersion string
+		wantResets     int
+	}{
+		{kind: "Node", wantAPIVersion: "v1"},
+		{kind: "ReplicaSet", wantAPIVersion: "apps/v1"},
+		{kind: "Job", wantAPIVersion: "batch/v1", wantResets: 1},
+		{kind: "Job", wantAPIVersion: "batch/v1", wantResets: 1}, // second time comes from cache
+		{kind: "Unknown", wantResets: 2},
+		{kind: "Unknown", wantResets: 2}, // don't refresh again so soon
+	}
+	for _, tt := range tests {
+		apiVersion, err := k.apiVersionFor(tt.kind)
+		if tt.wantAPIVersion == "" {
+			g.Expect(err).To(o.HaveOccurred())
+		} else {
+			g.Expect(err).NotTo(o.HaveOccurred())
+		}
+		g.Expect(apiVersion).To(o.Equal(tt.wantAPIVersion), tt.kind)
+		g.Expect(mapper.resets).To(o.Equal(tt.wantResets), tt.kind)
+	}
+}
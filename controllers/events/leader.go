@@ -0,0 +1,158 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// With leader election, only the leader sends spans. A standby watches Events passively and runs them
+// through the same pipeline with sending turned off, so its recentInfoStore is warm when it takes over.
+// With container spans it does the same with Pods, so it knows which container spans were already sent.
+// Span and trace IDs are hashes of UIDs, so the new leader carries on the traces the old one started.
+
+func (r *EventWatcher) isLeader() bool {
+	return atomic.LoadInt32(&r.leader) != 0
+}
+
+func (r *EventWatcher) setLeader(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	atomic.StoreInt32(&r.leader, v)
+	leaderGauge.Set(float64(v))
+}
+
+// Runs only once this replica is elected; controller-runtime won't start it until then.
+type leaderRunnable struct {
+	r        *EventWatcher
+	backfill *backfillRunnable // if set, run once we are sending spans
+}
+
+func (l leaderRunnable) Start(stop <-chan struct{}) error {
+	l.r.Log.Info("became leader; sending spans")
+	l.r.setLeader(true)
+	if l.backfill != nil {
+		l.backfill.run(stop)
+	}
+	<-stop
+	return nil
+}
+
+// Runs on every replica, feeding Events, and Pods if enabled, from the shared informers to the watcher while it is standby.
+type standbyRunnable struct {
+	r     *EventWatcher
+	cache cache.Cache
+}
+
+func (s standbyRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+func (s standbyRunnable) Start(stop <-chan struct{}) error {
+	handle := func(obj interface{}) {
+		event, ok := obj.(*corev1.Event)
+		if !ok || s.r.isLeader() {
+			return
+		}
+		if s.r.Filter.rejectEvent(event) != "" {
+			return
+		}
+		s.r.receiveEvent(context.Background(), event.DeepCopy())
+	}
+	if err := s.addHandler(&corev1.Event{}, handle); err != nil {
+		return err
+	}
+	if s.r.ContainerSpans {
+		handlePod := func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				s.r.receiveStandbyPod(context.Background(), pod.DeepCopy())
+			}
+		}
+		if err := s.addHandler(&corev1.Pod{}, handlePod); err != nil {
+			return err
+		}
+	}
+	<-stop
+	return nil
+}
+
+// Call handle for each object added or updated, from the shard cache if sharding, which may be rebuilt.
+func (s standbyRunnable) addHandler(obj runtime.Object, handle func(interface{})) error {
+	handler := toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(_, obj interface{}) { handle(obj) },
+	}
+	add := func(c cache.Cache) error {
+		informer, err := c.GetInformer(context.Background(), obj)
+		if err != nil {
+			return err
+		}
+		informer.AddEventHandler(handler)
+		return nil
+	}
+	if s.r.shardCache != nil {
+		return s.r.shardCache.watch(add)
+	}
+	return add(s.cache)
+}
+
+// On standby, go through the Pod's container spans without sending them, to note which ones the leader has sent.
+func (r *EventWatcher) receiveStandbyPod(ctx context.Context, pod *corev1.Pod) {
+	if r.isLeader() || !r.Filter.acceptPod(pod) || !r.shards.owns(pod.Namespace) {
+		return
+	}
+	ctx = r.prefetchPod(ctx, pod)
+	var err error
+	if stopErr := r.correlate(ctx, func() { _, err = r.handlePod(ctx, pod) }); stopErr != nil {
+		return
+	}
+	if err != nil {
+		r.Log.Error(err, "unable to handle pod on standby", "pod", pod.Namespace+"/"+pod.Name)
+	}
+}
+
+// Remembers which versions of which Events we have handled, so a new leader doesn't repeat what it did on standby.
+type handledEvents struct {
+	sync.Mutex
+	versions map[types.UID]handledVersion
+	clock    *correlationClock
+}
+
+type handledVersion struct {
+	resourceVersion string
+	lastSeen        time.Time
+}
+
+func newHandledEvents(clock *correlationClock) *handledEvents {
+	return &handledEvents{versions: make(map[types.UID]handledVersion), clock: clock}
+}
+
+// Returns false if we already saw this version of the event.
+func (h *handledEvents) note(event *corev1.Event) bool {
+	h.Lock()
+	defer h.Unlock()
+	if v, found := h.versions[event.UID]; found && v.resourceVersion == event.ResourceVersion {
+		return false
+	}
+	h.versions[event.UID] = handledVersion{resourceVersion: event.ResourceVersion, lastSeen: h.clock.now()}
+	return true
+}
+
+func (h *handledEvents) expire(threshold time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	for k, v := range h.versions {
+		if v.lastSeen.Before(threshold) {
+			delete(h.versions, k)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestStandbyTakeover(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.LeaderElection = true
+	r.setLeader(false)
+	r.handled = newHandledEvents(r.clock)
+	r.startTime = time.Time{} // so the recorded events are not too old
+
+	// On standby we go through the events but send nothing
+	receiveAll := func() {
+		for _, event := range rolloutEvents(t) {
+			r.receiveEvent(ctx, event)
+		}
+	}
+	receiveAll()
+	finishRollout(t, ctx, r, time.Minute)
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	// Now we take over; the events we saw on standby are not repeated
+	r.setLeader(true)
+	receiveAll()
+	r.flushOutgoing(ctx, threshold.Add(time.Minute))
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	// and a new event carries on the trace the old leader started
+	r.receiveEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))
+	r.flushOutgoing(ctx, threshold.Add(time.Minute))
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(1))
+	span := exporter.SpanSnapshot[0]
+	g.Expect(span.Name).To(o.Equal("Pod.BackOff"))
+	g.Expect(span.SpanContext.TraceID()).To(o.Equal(rolloutTraceID(t)))
+	g.Expect(span.ParentSpanID.IsValid()).To(o.BeTrue())
+}
+
+func TestStandbyTakeoverContainerSpans(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+
+	var running corev1.Pod
+	mustParse(t, pod1RunningStr, &running)
+
+	mtime.NowForce(threshold)
+	defer mtime.NowReset()
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.LeaderElection = true
+	r.ContainerSpans = true
+	r.setLeader(false)
+	r.handled = newHandledEvents(r.clock)
+	r.startTime = time.Time{} // so the recorded events are not too old
+
+	// On standby we see the Pod as the old leader did, and send nothing
+	for _, event := range rolloutEvents(t) {
+		r.receiveEvent(ctx, event)
+	}
+	finishRollout(t, ctx, r, time.Minute)
+	r.receiveEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))
+	r.receiveStandbyPod(ctx, running.DeepCopy())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+	g.Expect(r.containerSpans.seen).NotTo(o.BeEmpty())
+
+	// Once we take over, the controller reconciles every Pod; the spans the old leader sent are not repeated
+	r.setLeader(true)
+	r.receiveStandbyPod(ctx, running.DeepCopy()) // ignored now we are leader
+	_, err := r.handlePod(ctx, running.DeepCopy())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	// but a container that restarts after the takeover gets its span
+	restarted := running.DeepCopy()
+	restarted.Status.ContainerStatuses[0].RestartCount = 1
+	restarted.Status.ContainerStatuses[0].LastTerminationState.Terminated = &corev1.ContainerStateTerminated{
+		ExitCode:   137,
+		Reason:     "Error",
+		StartedAt:  metav1.NewTime(threshold),
+		FinishedAt: metav1.NewTime(threshold.Add(time.Second)),
+	}
+	_, err = r.handlePod(ctx, restarted)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(1))
+	g.Expect(exporter.SpanSnapshot[0].Name).To(o.Equal("Container.Terminated"))
+	g.Expect(exporter.SpanSnapshot[0].SpanContext.TraceID()).To(o.Equal(rolloutTraceID(t)))
+}
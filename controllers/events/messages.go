@@ -0,0 +1,194 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
+)
+
+// MessageMode says where the message from each Event goes
+type MessageMode string
+
+const (
+	MessageAttribute MessageMode = "attribute"  // a "message" attribute on the span
+	MessageSpanEvent MessageMode = "span-event" // an event on the span, at the time of the Event
+	MessageLog       MessageMode = "log"        // a log record, carrying the trace and span IDs of the span
+)
+
+// ParseMessageMode checks s is one of the modes; blank means the default.
+func ParseMessageMode(s string) (MessageMode, error) {
+	switch m := MessageMode(s); m {
+	case "":
+		return MessageAttribute, nil
+	case MessageAttribute, MessageSpanEvent, MessageLog:
+		return m, nil
+	}
+	return "", fmt.Errorf("message mode %q must be one of %s, %s, %s", s, MessageAttribute, MessageSpanEvent, MessageLog)
+}
+
+// LogExporter sends Events as log records, e.g. *otlplog.Exporter
+type LogExporter interface {
+	ExportLogs(ctx context.Context, records []*otlplog.Record) error
+}
+
+// Put the event message on the span, according to the mode.
+func (r *EventWatcher) addMessage(event *corev1.Event, span *tracesdk.SpanSnapshot) {
+	if event.Message == "" {
+		return
+	}
+	switch r.Messages {
+	case MessageSpanEvent:
+		if r.CollapseRepeats { // each repeat of the series already has a span event with the message
+			return
+		}
+		span.MessageEvents = append(span.MessageEvents, trace.Event{
+			Name:       event.Reason,
+			Time:       eventTime(event),
+			Attributes: []attribute.KeyValue{attribute.String("message", event.Message)},
+		})
+	case MessageLog:
+		// held by holdLog until the span goes out
+	default:
+		span.Attributes = append(span.Attributes, attribute.String("message", event.Message))
+	}
+}
+
+const (
+	// Log records waiting to be sent; beyond this, records are dropped rather than hold up correlation
+	logQueueSize = 1000
+	// The most log records sent in one go
+	logBatchSize = 100
+)
+
+// Log records are sent from their own goroutine, so correlation doesn't wait on the LogExporter.
+type logQueue struct {
+	start sync.Once
+	items chan logItem
+}
+
+// A record to send; or, if flushed is set, a request to say when everything before it is sent.
+type logItem struct {
+	rec     *otlplog.Record
+	flushed chan struct{}
+}
+
+// In log mode, make a log record for the event, correlated with the span we made for it.
+// The record is held with the span, and sent only if the span is. Caller must hold the outgoing lock.
+func (r *EventWatcher) holdLog(event *corev1.Event, span *tracesdk.SpanSnapshot) {
+	if r.Messages != MessageLog || r.LogExporter == nil {
+		return
+	}
+	rec := r.eventToLog(event, span)
+	r.redactLog(rec)
+	id := span.SpanContext.SpanID()
+	r.outgoing.logs[id] = append(r.outgoing.logs[id], rec)
+}
+
+// Once we have decided on span, send the log records held with it if it was sent; forget them either way.
+// Caller must hold the outgoing lock.
+func (r *EventWatcher) releaseLogs(span *tracesdk.SpanSnapshot, sent bool) {
+	id := span.SpanContext.SpanID()
+	recs := r.outgoing.logs[id]
+	delete(r.outgoing.logs, id)
+	if !sent {
+		return
+	}
+	items := r.logItems()
+	for _, rec := range recs {
+		select {
+		case items <- logItem{rec: rec}:
+		default: // the LogExporter can't keep up
+			droppedLogsNum.Inc()
+		}
+	}
+}
+
+// The queue of log records to send, started on first use.
+func (r *EventWatcher) logItems() chan logItem {
+	r.logs.start.Do(func() {
+		r.logs.items = make(chan logItem, logQueueSize)
+		go r.sendLogs()
+	})
+	return r.logs.items
+}
+
+func (r *EventWatcher) sendLogs() {
+	var batch []*otlplog.Record
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.LogExporter.ExportLogs(context.Background(), batch); err != nil {
+			r.Log.Error(err, "failed to send logs", "records", len(batch))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case item := <-r.logs.items:
+			if item.flushed != nil {
+				send()
+				close(item.flushed)
+				continue
+			}
+			batch = append(batch, item.rec)
+			// Send when there is nothing more to come straight away, or we have enough
+			if len(r.logs.items) == 0 || len(batch) == logBatchSize {
+				send()
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// flushLogs waits for the log records queued so far to be sent, or until ctx is done.
+func (r *EventWatcher) flushLogs(ctx context.Context) error {
+	if r.Messages != MessageLog || r.LogExporter == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case r.logItems() <- logItem{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return errStopped
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return errStopped
+	}
+}
+
+func (r *EventWatcher) eventToLog(event *corev1.Event, span *tracesdk.SpanSnapshot) *otlplog.Record {
+	severity := otlplog.SeverityInfo
+	if event.Type != corev1.EventTypeNormal {
+		severity = otlplog.SeverityWarn
+	}
+	attrs := append(r.objectAttributes(refFromObjRef(event.InvolvedObject), event.InvolvedObject.UID), r.eventAttributes(event)...)
+	if event.Count > 0 {
+		attrs = append(attrs, r.countAttributes(event.Count)...)
+	}
+	return &otlplog.Record{
+		Time:         eventTime(event),
+		SpanContext:  span.SpanContext,
+		Severity:     severity,
+		SeverityText: event.Type,
+		Name:         span.Name,
+		Body:         event.Message,
+		Attributes:   attrs,
+		Resource:     span.Resource,
+	}
+}
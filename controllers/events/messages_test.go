@@ -0,0 +1,141 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
+)
+
+func TestMessageModes(t *testing.T) {
+	g := o.NewWithT(t)
+
+	for _, mode := range []MessageMode{MessageSpanEvent, MessageLog} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		logs := &fakeLogExporter{}
+		r.Messages = mode
+		r.LogExporter = logs
+
+		replayRollout(t, ctx, r)
+		g.Expect(r.flushLogs(ctx)).To(o.Succeed())
+		r.stop()
+
+		// The Deployment.Update span comes from the object, not an event, so has no message.
+		g.Expect(exporter.SpanSnapshot).To(o.HaveLen(len(deploymentUpdateEvents) + 1))
+		spans := make(map[string]bool)
+		for _, span := range exporter.SpanSnapshot {
+			g.Expect(attributeValue(span.Attributes, "message")).To(o.BeEmpty())
+			spans[span.SpanContext.TraceID().String()+span.SpanContext.SpanID().String()] = true
+			if mode == MessageSpanEvent && span.Name != "Deployment.Update" {
+				g.Expect(span.MessageEvents).To(o.HaveLen(1), span.Name)
+				g.Expect(attributeValue(span.MessageEvents[0].Attributes, "message")).NotTo(o.BeEmpty(), span.Name)
+				g.Expect(span.MessageEvents[0].Time).To(o.Equal(span.StartTime))
+			}
+		}
+
+		if mode == MessageLog {
+			g.Expect(logs.records).To(o.HaveLen(len(deploymentUpdateEvents)))
+			for _, rec := range logs.records {
+				g.Expect(rec.Body).NotTo(o.BeEmpty())
+				g.Expect(spans).To(o.HaveKey(rec.SpanContext.TraceID().String()+rec.SpanContext.SpanID().String()), rec.Name)
+			}
+			g.Expect(logs.records[0].Severity).To(o.Equal(otlplog.SeverityInfo))
+		} else {
+			g.Expect(logs.records).To(o.BeEmpty())
+		}
+	}
+}
+
+// blocks sending until released
+type blockingLogExporter struct {
+	fakeLogExporter
+	release chan struct{}
+}
+
+func (b *blockingLogExporter) ExportLogs(ctx context.Context, records []*otlplog.Record) error {
+	<-b.release
+	return b.fakeLogExporter.ExportLogs(ctx, records)
+}
+
+// Correlation doesn't wait on sending logs.
+func TestSlowLogExporter(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, _ := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	logs := &blockingLogExporter{release: make(chan struct{})}
+	r.Messages = MessageLog
+	r.LogExporter = logs
+
+	replayRollout(t, ctx, r)
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	g.Expect(r.flushLogs(short)).To(o.Equal(context.DeadlineExceeded))
+
+	// Once the queue is full, records are dropped rather than hold up correlation
+	dropped := testutil.ToFloat64(droppedLogsNum)
+	span := &tracesdk.SpanSnapshot{SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}})}
+	r.outgoing.Lock()
+	for i := 0; i < logQueueSize+1; i++ {
+		r.outgoing.logs[span.SpanContext.SpanID()] = append(r.outgoing.logs[span.SpanContext.SpanID()], &otlplog.Record{})
+	}
+	r.releaseLogs(span, true)
+	r.outgoing.Unlock()
+	g.Expect(testutil.ToFloat64(droppedLogsNum) - dropped).To(o.BeNumerically(">", 0))
+
+	close(logs.release)
+	g.Expect(r.flushLogs(ctx)).To(o.Succeed())
+	g.Expect(logs.records).To(o.HaveLen(len(deploymentUpdateEvents) + logQueueSize + 1 - int(testutil.ToFloat64(droppedLogsNum)-dropped)))
+}
+
+// A log record goes out only if its span does, whether sampling is decided up front or once the trace is quiet.
+func TestLogsFollowSampling(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+	mtime.NowForce(threshold)
+	defer mtime.NowReset()
+
+	for _, tail := range []bool{false, true} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		logs := &fakeLogExporter{}
+		r.Messages = MessageLog
+		r.LogExporter = logs
+		r.Sampling = &SampleRates{Default: 1, ByNamespace: map[string]float64{"default": 0}}
+		r.sampler = newSampler(r.Sampling, r.clock)
+		r.TailSampling = tail
+
+		replayRollout(t, ctx, r)
+		r.flushTailTraces(ctx, threshold.Add(r.recent.windows.Default.Expire))
+		g.Expect(r.flushLogs(ctx)).To(o.Succeed())
+		g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+		g.Expect(logs.records).To(o.BeEmpty())
+		g.Expect(r.outgoing.logs).To(o.BeEmpty())
+		r.stop()
+	}
+
+	// With tail sampling, a failure keeps the whole trace, logs included
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	logs := &fakeLogExporter{}
+	r.Messages = MessageLog
+	r.LogExporter = logs
+	r.Sampling = &SampleRates{Default: 1, ByNamespace: map[string]float64{"default": 0}}
+	r.sampler = newSampler(r.Sampling, r.clock)
+	r.TailSampling = true
+
+	handleRolloutEvents(t, ctx, r)
+	g.Expect(r.handleEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))).To(o.Succeed())
+	finishRollout(t, ctx, r, time.Minute)
+	g.Expect(r.flushLogs(ctx)).To(o.Succeed())
+	g.Expect(logs.records).To(o.BeEmpty())
+	r.flushTailTraces(ctx, threshold.Add(r.recent.windows.Default.Expire))
+	g.Expect(r.flushLogs(ctx)).To(o.Succeed())
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(len(deploymentUpdateEvents) + 2))
+	g.Expect(logs.records).To(o.HaveLen(len(deploymentUpdateEvents) + 1))
+}
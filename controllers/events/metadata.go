@@ -0,0 +1,140 @@
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+)
+
+// metadataCache looks up objects as PartialObjectMetadata, from shared informers that watch only metadata.
+// Walking owners, projecting labels and finding update times only need metadata, so this saves
+// fetching whole objects from the API server for every event.
+// Informers are started the first time we look up each kind; until one has synced we ask the API server.
+// If we only handle some namespaces, each of those gets informers of its own, so we don't watch the
+// whole cluster, and objects in any other namespace are fetched directly.
+type metadataCache struct {
+	sync.Mutex
+	client     metadata.Interface
+	mapper     meta.RESTMapper
+	namespaces func(namespace string) bool // which namespaces to watch; nil means the whole cluster
+	factories  map[string]*metadataFactory // by namespace; NamespaceAll for cluster-scoped kinds, or everything
+	stopped    bool
+}
+
+// Informers for one namespace, or all of them.
+type metadataFactory struct {
+	factory   metadatainformer.SharedInformerFactory
+	informers map[schema.GroupVersionResource]informers.GenericInformer
+	stopCh    chan struct{}
+}
+
+func newMetadataCache(client metadata.Interface, mapper meta.RESTMapper, namespaces func(string) bool) *metadataCache {
+	return &metadataCache{
+		client:     client,
+		mapper:     mapper,
+		namespaces: namespaces,
+		factories:  make(map[string]*metadataFactory),
+	}
+}
+
+// Return the informer for gvr in namespace, starting it if this is the first time we asked;
+// nil if we don't watch that namespace.
+func (c *metadataCache) informerFor(gvr schema.GroupVersionResource, namespaced bool, namespace string) informers.GenericInformer {
+	factoryNamespace := metav1.NamespaceAll
+	if namespaced && c.namespaces != nil {
+		if namespace == "" || !c.namespaces(namespace) {
+			return nil
+		}
+		factoryNamespace = namespace
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return nil
+	}
+	f, found := c.factories[factoryNamespace]
+	if !found {
+		f = &metadataFactory{
+			factory:   metadatainformer.NewFilteredSharedInformerFactory(c.client, 0, factoryNamespace, nil),
+			informers: make(map[schema.GroupVersionResource]informers.GenericInformer),
+			stopCh:    make(chan struct{}),
+		}
+		c.factories[factoryNamespace] = f
+	}
+	if informer, found := f.informers[gvr]; found {
+		return informer
+	}
+	informer := f.factory.ForResource(gvr)
+	f.informers[gvr] = informer
+	f.factory.Start(f.stopCh)
+	return informer
+}
+
+// Stop the informers for namespaces we no longer watch, e.g. after the shard ring changed.
+func (c *metadataCache) prune() {
+	if c.namespaces == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for namespace, f := range c.factories {
+		if namespace != metav1.NamespaceAll && !c.namespaces(namespace) {
+			close(f.stopCh)
+			delete(c.factories, namespace)
+		}
+	}
+}
+
+func (c *metadataCache) get(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) (*metav1.PartialObjectMetadata, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to find resource for %s", gvk)
+	}
+	namespaced := mapping.Scope.Name() == meta.RESTScopeNameNamespace
+	if !namespaced {
+		namespace = ""
+	}
+	informer := c.informerFor(mapping.Resource, namespaced, namespace)
+	if informer != nil && informer.Informer().HasSynced() {
+		key := name
+		if namespace != "" {
+			key = namespace + "/" + name
+		}
+		if item, exists, err := informer.Informer().GetIndexer().GetByKey(key); err == nil && exists {
+			if obj, ok := item.(*metav1.PartialObjectMetadata); ok {
+				metadataCacheNum.WithLabelValues(gvk.Kind, "hit").Inc()
+				return withKind(obj.DeepCopy(), gvk), nil
+			}
+		}
+	}
+	// Not synced yet, not a namespace we watch, or the object is newer than the cache: go to the API server
+	metadataCacheNum.WithLabelValues(gvk.Kind, "miss").Inc()
+	apiCallsNum.WithLabelValues(gvk.Kind, "metadata").Inc()
+	obj, err := c.client.Resource(mapping.Resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return withKind(obj, gvk), nil
+}
+
+// Objects from the metadata API say they are PartialObjectMetadata; put back the kind they really are.
+func withKind(obj *metav1.PartialObjectMetadata, gvk schema.GroupVersionKind) *metav1.PartialObjectMetadata {
+	obj.SetGroupVersionKind(gvk)
+	return obj
+}
+
+func (c *metadataCache) stop() {
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range c.factories {
+		close(f.stopCh)
+	}
+	c.factories, c.stopped = nil, true
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func toPartial(t *testing.T, obj *unstructured.Unstructured) *metav1.PartialObjectMetadata {
+	var partial metav1.PartialObjectMetadata
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &partial); err != nil {
+		t.Fatal(err)
+	}
+	return &partial
+}
+
+func TestMetadataCache(t *testing.T) {
+	g := o.NewWithT(t)
+
+	// The controller-runtime client has no objects, so everything has to come from the metadata client
+	_, r, exporter, _ := newTestEventWatcher()
+	defer r.stop()
+	scheme := runtime.NewScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+	var partials []runtime.Object
+	for _, obj := range rolloutObjects(t) {
+		partials = append(partials, toPartial(t, obj.(*unstructured.Unstructured)))
+	}
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme, partials...)
+	rsName := partials[1].(*metav1.PartialObjectMetadata).GetName()
+	r.metadata = newMetadataCache(metadataClient, newTestRESTMapper(r.scheme), nil)
+
+	// Before the informer has synced, we go to the API server for metadata
+	hits := testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "hit"))
+	misses := testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "miss"))
+	ctx := context.Background()
+	obj, err := r.getObject(ctx, "apps/v1", "ReplicaSet", "default", rsName)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(obj).To(o.BeAssignableToTypeOf(&metav1.PartialObjectMetadata{}))
+	g.Expect(obj.GetObjectKind().GroupVersionKind().Kind).To(o.Equal("ReplicaSet"))
+	g.Expect(testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "miss"))).To(o.Equal(misses + 1))
+
+	// and after that, from the cache
+	g.Eventually(func() float64 {
+		_, _ = r.getObject(ctx, "apps/v1", "ReplicaSet", "default", rsName)
+		return testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "hit"))
+	}, 5*time.Second, 10*time.Millisecond).Should(o.BeNumerically(">", hits))
+
+	// An object that isn't there is reported as not found
+	_, err = r.getObject(ctx, "apps/v1", "ReplicaSet", "default", "nonexistent")
+	g.Expect(isNotFound(err)).To(o.BeTrue())
+
+	// Metadata is enough to put the rollout into one trace
+	replayRollout(t, ctx, r)
+	g.Expect(exporter.dump()).To(o.Equal(rolloutTrace))
+}
+
+// With only some namespaces to watch, each of those gets informers of its own and the rest are fetched directly.
+func TestMetadataCacheNamespaces(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx := context.Background()
+
+	scheme := runtime.NewScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+	rs := toPartial(t, rolloutObjects(t)[1].(*unstructured.Unstructured))
+	elsewhere := rs.DeepCopy()
+	elsewhere.SetNamespace("other")
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme, rs, elsewhere)
+	owned := map[string]bool{"default": true}
+	typed := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(typed)
+	c := newMetadataCache(metadataClient, newTestRESTMapper(typed), func(namespace string) bool { return owned[namespace] })
+	defer c.stop()
+	gvk := rs.GroupVersionKind()
+
+	// In a namespace we watch, from an informer for just that namespace
+	hits := testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "hit"))
+	g.Eventually(func() float64 {
+		_, _ = c.get(ctx, gvk, "default", rs.GetName())
+		return testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "hit"))
+	}, 5*time.Second, 10*time.Millisecond).Should(o.BeNumerically(">", hits))
+	g.Expect(c.factories).To(o.HaveLen(1))
+	g.Expect(c.factories).To(o.HaveKey("default"))
+
+	// Anywhere else, from the API server every time
+	misses := testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "miss"))
+	for i := 0; i < 3; i++ {
+		obj, err := c.get(ctx, gvk, "other", rs.GetName())
+		g.Expect(err).NotTo(o.HaveOccurred())
+		g.Expect(obj.GetNamespace()).To(o.Equal("other"))
+	}
+	g.Expect(testutil.ToFloat64(metadataCacheNum.WithLabelValues("ReplicaSet", "miss"))).To(o.Equal(misses + 3))
+	g.Expect(c.factories).To(o.HaveLen(1))
+
+	// Once the namespace is no longer ours, e.g. the shard ring changed, we stop watching it
+	owned["default"] = false
+	c.prune()
+	g.Expect(c.factories).To(o.BeEmpty())
+}
@@ -0,0 +1,262 @@
+package events
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	totalEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "events",
+			Name:      "total",
+			Help:      "The total number of events.",
+		},
+		[]string{"type", "involved_object", "reason"})
+
+	windowEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "window",
+			Name:      "events_total",
+			Help:      "Events by correlation window and outcome: mapped within the window, mapped only after the window had passed, or dropped.",
+		},
+		[]string{"window", "outcome"})
+
+	resourceCacheNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "resource_cache",
+			Name:      "requests_total",
+			Help:      "Lookups in the cache of resources by source, by result: hit or miss.",
+		},
+		[]string{"result"})
+
+	resourceEvictionsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "resource_cache",
+			Name:      "evictions_total",
+			Help:      "Resources thrown out of the cache, by reason: size, expired or replaced.",
+		},
+		[]string{"reason"})
+
+	redactionsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "redaction",
+			Name:      "total",
+			Help:      "Redactions made to spans, logs and captured objects, by action: mask or drop.",
+		},
+		[]string{"action"})
+
+	samplingNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "sampling",
+			Name:      "spans_total",
+			Help:      "Spans by sampling decision: sampled, dropped, or kept by tail sampling because something in the trace failed.",
+		},
+		[]string{"decision"})
+
+	filteredEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "filter",
+			Name:      "dropped_total",
+			Help:      "Events dropped by the filter, by the filter that matched: namespace, reason, source, kind or selector.",
+		},
+		[]string{"filter"})
+
+	pendingDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "pending",
+			Name:      "depth",
+			Help:      "Number of events held waiting to be mapped to a trace.",
+		})
+
+	shedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "pending",
+			Name:      "shed_total",
+			Help:      "Events dropped because the pending queue was full, by shed policy and event type.",
+		},
+		[]string{"policy", "type"})
+
+	leaderGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "leader",
+			Name:      "is_leader",
+			Help:      "1 if this replica is sending spans, 0 if it is on standby.",
+		})
+
+	standbySpansNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "leader",
+			Name:      "standby_spans_total",
+			Help:      "Spans made while on standby and not sent, since the leader sends them.",
+		})
+
+	shardMembersGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "shard",
+			Name:      "members",
+			Help:      "Number of live replicas sharing namespaces, as seen by this one.",
+		})
+
+	shardNamespacesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "shard",
+			Name:      "namespaces",
+			Help:      "Number of namespaces whose Events and Pods this replica caches.",
+		})
+
+	checkpointsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "checkpoint",
+			Name:      "total",
+			Help:      "Checkpoints by result: saved, error, or restored at startup.",
+		},
+		[]string{"result"})
+
+	checkpointBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "checkpoint",
+			Name:      "size_bytes",
+			Help:      "Size of the last checkpoint saved, compressed.",
+		})
+
+	recentStoreErrorsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "recent_store",
+			Name:      "errors_total",
+			Help:      "Errors from the shared store of recent activity, by operation.",
+		},
+		[]string{"op"})
+	droppedLogsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "logs",
+			Name:      "dropped_total",
+			Help:      "Log records dropped because too many were waiting to be sent.",
+		})
+	recentStoreDroppedNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "recent_store",
+			Name:      "dropped_total",
+			Help:      "Writes to the shared store of recent activity dropped because too many were waiting.",
+		})
+
+	backfillEventsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "backfill",
+			Name:      "events_total",
+			Help:      "Events from before startup handled by backfill.",
+		})
+	metadataCacheNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "metadata_cache",
+			Name:      "lookups_total",
+			Help:      "Object metadata lookups, by kind and whether the informer cache had it.",
+		},
+		[]string{"kind", "result"})
+	apiCallsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Name:      "api_object_gets_total",
+			Help:      "Objects fetched from the API server, by kind and whether just metadata or the whole object.",
+		},
+		[]string{"kind", "type"})
+	reorderDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "reorder",
+			Name:      "buffer_depth",
+			Help:      "Events held to put them in the order they happened.",
+		})
+	reorderedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "reorder",
+			Name:      "events_total",
+			Help:      "Events released from the reorder buffer, by whether something that arrived later went ahead of them.",
+		},
+		[]string{"result"})
+	droppedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "pending",
+			Name:      "dropped_total",
+			Help:      "Events given up on after waiting, by reason: not_found, no_owner or error.",
+		},
+		[]string{"reason"})
+	recentEntriesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "recent",
+			Name:      "entries",
+			Help:      "Objects with recent activity held in memory; not reported when the store is in Redis.",
+		})
+	recentExpiredNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "recent",
+			Name:      "expired_total",
+			Help:      "Objects thrown out of the in-memory store of recent activity because their window expired.",
+		})
+	outgoingSpansGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kspan",
+			Subsystem: "outgoing",
+			Name:      "spans",
+			Help:      "Spans held before sending, by map: by_ref, by_span_id, series or tail.",
+		},
+		[]string{"map"})
+	exportsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kspan",
+			Subsystem: "export",
+			Name:      "requests_total",
+			Help:      "Calls to the span exporter, by result: success or error.",
+		},
+		[]string{"result"})
+	exportLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "kspan",
+			Subsystem: "export",
+			Name:      "event_latency_seconds",
+			Help:      "Time from the latest Event a span covers to the span being sent.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		})
+	getObjectLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "kspan",
+			Subsystem: "lookup",
+			Name:      "get_object_duration_seconds",
+			Help:      "Time taken to look up an object, by source: metadata or api.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"source"})
+)
+
+func init() {
+	// Register custom metrics with the global prometheus registry
+	metrics.Registry.MustRegister(totalEventsNum, windowEventsNum, resourceCacheNum, resourceEvictionsNum, redactionsNum, samplingNum, filteredEventsNum, pendingDepth, shedEventsNum,
+		leaderGauge, standbySpansNum, shardMembersGauge, shardNamespacesGauge,
+		checkpointsNum, checkpointBytes, recentStoreErrorsNum, recentStoreDroppedNum, droppedLogsNum, backfillEventsNum,
+		metadataCacheNum, apiCallsNum, reorderDepth, reorderedEventsNum,
+		droppedEventsNum, recentEntriesGauge, recentExpiredNum, outgoingSpansGauge, exportsNum, exportLatency, getObjectLatency)
+}
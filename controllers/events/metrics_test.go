@@ -0,0 +1,83 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestOperationalMetrics(t *testing.T) {
+	g := o.NewWithT(t)
+
+	threshold := rolloutThreshold(t)
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	exports := testutil.ToFloat64(exportsNum.WithLabelValues("success"))
+	apiGets := histogramCount(t, getObjectLatency.WithLabelValues("api"))
+	latencies := histogramCount(t, exportLatency)
+
+	handleRolloutEvents(t, ctx, r)
+	g.Expect(testutil.ToFloat64(pendingDepth)).To(o.Equal(float64(len(deploymentUpdateEvents))))
+	g.Expect(r.checkOlderPending(ctx, threshold)).To(o.Succeed())
+	g.Expect(testutil.ToFloat64(pendingDepth)).To(o.BeZero())
+	g.Expect(testutil.ToFloat64(recentEntriesGauge)).To(o.BeNumerically(">", 0))
+
+	r.flushOutgoing(ctx, threshold)
+	g.Expect(testutil.ToFloat64(outgoingSpansGauge.WithLabelValues("by_ref"))).To(o.Equal(float64(len(r.outgoing.byRef))))
+	g.Expect(testutil.ToFloat64(exportsNum.WithLabelValues("success")) - exports).To(o.Equal(float64(len(exporter.SpanSnapshot))))
+	g.Expect(histogramCount(t, exportLatency) - latencies).To(o.Equal(uint64(len(exporter.SpanSnapshot))))
+	g.Expect(histogramCount(t, getObjectLatency.WithLabelValues("api"))).To(o.BeNumerically(">", apiGets))
+}
+
+func histogramCount(t *testing.T, h prometheus.Observer) uint64 {
+	return histogram(t, h).GetSampleCount()
+}
+
+func histogram(t *testing.T, h prometheus.Observer) *dto.Histogram {
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram()
+}
+
+// Latency counts from the latest Event in the span, not from when a long-running span started.
+func TestExportLatencyFromEnd(t *testing.T) {
+	g := o.NewWithT(t)
+	now := rolloutThreshold(t)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+
+	sum := histogram(t, exportLatency).GetSampleSum()
+	span := &tracesdk.SpanSnapshot{
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}}),
+		StartTime:   now.Add(-time.Hour),
+		EndTime:     now.Add(-2 * time.Second),
+	}
+	g.Expect(r.export(ctx, []*tracesdk.SpanSnapshot{span})).To(o.Succeed())
+	g.Expect(histogram(t, exportLatency).GetSampleSum() - sum).To(o.BeNumerically("~", 2, 0.001))
+}
+
+func TestDroppedEventReasons(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, exporter, _ := newTestEventWatcher() // none of the objects exist
+	defer r.stop()
+
+	threshold := rolloutThreshold(t)
+	notFound := testutil.ToFloat64(droppedEventsNum.WithLabelValues("not_found"))
+
+	g.Expect(r.handleEvent(ctx, rolloutEvents(t)[1])).To(o.Succeed())
+	g.Expect(r.checkOlderPending(ctx, threshold)).To(o.Succeed())
+	g.Expect(testutil.ToFloat64(droppedEventsNum.WithLabelValues("not_found")) - notFound).To(o.Equal(1.0))
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+}
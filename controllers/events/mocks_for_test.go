@@ -4,20 +4,35 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"go.opentelemetry.io/otel/attribute"
 	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
 	"go.opentelemetry.io/otel/semconv"
 	"go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake" //nolint:staticcheck
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
 )
 
 // Initialize an EventWatcher, context and logger ready for testing
 func newTestEventWatcher(initObjs ...runtime.Object) (context.Context, *EventWatcher, *fakeExporter, logr.Logger) {
+	return newConfiguredTestEventWatcher(nil, initObjs...)
+}
+
+// Like newTestEventWatcher, with configure, if set, called before the watcher is initialized.
+func newConfiguredTestEventWatcher(configure func(*EventWatcher), initObjs ...runtime.Object) (context.Context, *EventWatcher, *fakeExporter, logr.Logger) {
 	ctx := context.Background()
 	scheme := runtime.NewScheme()
 	_ = clientgoscheme.AddToScheme(scheme)
@@ -31,12 +46,136 @@ func newTestEventWatcher(initObjs ...runtime.Object) (context.Context, *EventWat
 		Log:      log,
 		Exporter: exporter,
 	}
+	if configure != nil {
+		configure(r)
+	}
 
-	r.initialize(scheme)
+	r.initialize(scheme, newTestRESTMapper(scheme))
 
 	return ctx, r, exporter, log
 }
 
+// The objects that deploymentUpdateEvents refer to.
+func rolloutObjects(t *testing.T) []runtime.Object {
+	var (
+		deploy1    unstructured.Unstructured
+		rs1, rs2   unstructured.Unstructured
+		pod0, pod1 unstructured.Unstructured
+	)
+	mustParse(t, deploy1str, &deploy1)
+	mustParse(t, replicaSet1str, &rs1)
+	mustParse(t, replicaSet2str, &rs2)
+	mustParse(t, pod0str, &pod0)
+	mustParse(t, pod1str, &pod1)
+	return []runtime.Object{&deploy1, &rs1, &rs2, &pod0, &pod1}
+}
+
+// A time by which everything in deploymentUpdateEvents has happened.
+func rolloutThreshold(t *testing.T) time.Time {
+	threshold, err := time.Parse(time.RFC3339, deploymentUpdateEventsThresholdStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return threshold
+}
+
+func rolloutEvents(t *testing.T) []*corev1.Event {
+	events := make([]*corev1.Event, len(deploymentUpdateEvents))
+	for index := range deploymentUpdateEvents {
+		events[index] = &corev1.Event{}
+		mustParse(t, deploymentUpdateEvents[index], events[index])
+	}
+	return events
+}
+
+// Initialize an EventWatcher that can see the objects in the Deployment rollout
+func newRolloutTestEventWatcher(t *testing.T) (context.Context, *EventWatcher, *fakeExporter) {
+	ctx, r, exporter, _ := newTestEventWatcher(rolloutObjects(t)...)
+	return ctx, r, exporter
+}
+
+// Pass each event to handleEvent, stopping at the first error; safe to call off the test goroutine.
+func handleEvents(ctx context.Context, r *EventWatcher, events []*corev1.Event) error {
+	for _, event := range events {
+		if err := r.handleEvent(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pass each event in the Deployment rollout to handleEvent, in the order they were recorded.
+func handleRolloutEvents(t *testing.T, ctx context.Context, r *EventWatcher) {
+	t.Helper()
+	if err := handleEvents(ctx, r, rolloutEvents(t)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Map whatever is still pending from the rollout, then send spans held until extra after it.
+func finishRollout(t *testing.T, ctx context.Context, r *EventWatcher, extra time.Duration) {
+	t.Helper()
+	threshold := rolloutThreshold(t)
+	if err := r.checkOlderPending(ctx, threshold); err != nil {
+		t.Fatal(err)
+	}
+	r.flushOutgoing(ctx, threshold.Add(extra))
+}
+
+// Play the whole Deployment rollout through r.
+func replayRollout(t *testing.T, ctx context.Context, r *EventWatcher) {
+	t.Helper()
+	handleRolloutEvents(t, ctx, r)
+	finishRollout(t, ctx, r, 0)
+}
+
+// The trace replayRollout makes with default settings.
+var rolloutTrace = []string{
+	"0: kubectl Deployment.Update ",
+	"1: deployment-controller Deployment.ScalingReplicaSet (0) Scaled up replica set hello-world-6b9d85fbd6 to 1",
+	"2: replicaset-controller ReplicaSet.SuccessfulCreate (1) Created pod: hello-world-6b9d85fbd6-klpv2",
+	"3: default-scheduler Pod.Scheduled (2) Successfully assigned default/hello-world-6b9d85fbd6-klpv2 to kind-control-plane",
+	"4: kubelet Pod.Pulled (2) Container image \"nginx:1.19.2-alpine\" already present on machine",
+	"5: kubelet Pod.Created (2) Created container hello-world",
+	"6: kubelet Pod.Started (2) Started container hello-world",
+	"7: deployment-controller Deployment.ScalingReplicaSet (0) Scaled down replica set hello-world-7ff854f459 to 0",
+	"8: kubelet Pod.Killing (7) Stopping container hello-world",
+	"9: replicaset-controller ReplicaSet.SuccessfulDelete (7) Deleted pod: hello-world-7ff854f459-kl4hq",
+}
+
+// The trace the rollout goes into, from the Deployment's generation.
+func rolloutTraceID(t *testing.T) trace.TraceID {
+	return objectToTraceID(rolloutObjects(t)[0].(*unstructured.Unstructured))
+}
+
+// A Warning about the new Pod in the rollout, as if its container were crash-looping.
+func rolloutBackOff(at time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2.backoff", UID: "backoff-1"},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2",
+			UID: "deb2b4f7-e312-44dd-bd06-7c00d0f5695a",
+		},
+		Reason:        "BackOff",
+		Message:       "Back-off restarting failed container",
+		Source:        corev1.EventSource{Component: "kubelet"},
+		Type:          corev1.EventTypeWarning,
+		Count:         1,
+		LastTimestamp: metav1.NewTime(at),
+	}
+}
+
+// Make a RESTMapper for the API groups used in tests; the real one is populated from discovery.
+func newTestRESTMapper(scheme *runtime.Scheme) *meta.DefaultRESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gv := range []schema.GroupVersion{corev1.SchemeGroupVersion, appsv1.SchemeGroupVersion} {
+		for kind := range scheme.KnownTypes(gv) {
+			mapper.Add(gv.WithKind(kind), meta.RESTScopeNamespace)
+		}
+	}
+	return mapper
+}
+
 func newFakeExporter() *fakeExporter {
 	return &fakeExporter{}
 }
@@ -77,6 +216,17 @@ func (f *fakeExporter) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// records logs sent to it, for testing purposes
+type fakeLogExporter struct {
+	records []*otlplog.Record
+}
+
+// ExportLogs implements LogExporter
+func (f *fakeLogExporter) ExportLogs(ctx context.Context, records []*otlplog.Record) error {
+	f.records = append(f.records, records...)
+	return nil
+}
+
 func attributeValue(attributes []attribute.KeyValue, key attribute.Key) string {
 	for _, lbl := range attributes {
 		if lbl.Key == key {
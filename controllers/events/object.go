@@ -18,6 +18,8 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -67,18 +69,26 @@ func (r *EventWatcher) createTraceFromTopLevelObject(ctx context.Context, obj ru
 	}
 
 	updateSource, operation, updateTime := getUpdateSource(m, "f:spec")
-	res := r.getResource(source{name: updateSource})
+	res := r.getResource(ctx, source{name: updateSource})
 
 	if updateTime.IsZero() { // We didn't find a time in the object
 		updateTime = eventTime
 	}
 
-	kind := obj.GetObjectKind().GroupVersionKind().Kind
-	attrs := []attribute.KeyValue{
-		attribute.String("k8s.namespace.name", m.GetNamespace()),
-		attribute.String("k8s."+strings.ToLower(kind)+".name", m.GetName()),
-		attribute.String("kind", kind),
-		attribute.Int64("generation", m.GetGeneration()),
+	attrs := append(r.objectAttributes(refFromObject(m), m.GetUID()), keyGeneration.Int64(m.GetGeneration()))
+	attrs = append(attrs, r.projectedAttributes(refFromObject(m))...)
+	if r.LegacyAttributes {
+		attrs = append(attrs, attribute.Int64("generation", m.GetGeneration()))
+	}
+
+	// Each generation has its own trace; link back to the previous one.
+	// (there may not have been a trace for it, if nothing happened at that generation)
+	var links []trace.Link
+	if m.GetGeneration() > 1 {
+		links = append(links, newLink(trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: generationToTraceID(m.GetUID(), m.GetGeneration()-1),
+			SpanID:  generationToSpanID(m.GetUID(), m.GetGeneration()-1),
+		}), "previous-generation"))
 	}
 
 	spanData := &tracesdk.SpanSnapshot{
@@ -86,6 +96,7 @@ func (r *EventWatcher) createTraceFromTopLevelObject(ctx context.Context, obj ru
 			TraceID: objectToTraceID(m),
 			SpanID:  objectToSpanID(m),
 		}),
+		Links:      links,
 		SpanKind:   trace.SpanKindInternal,
 		Name:       fmt.Sprintf("%s.%s", obj.GetObjectKind().GroupVersionKind().Kind, operation),
 		StartTime:  updateTime,
@@ -99,9 +110,13 @@ func (r *EventWatcher) createTraceFromTopLevelObject(ctx context.Context, obj ru
 
 // create a spanID that will be consistent for a particular object
 func objectToSpanID(m v1.Object) trace.SpanID {
+	return generationToSpanID(m.GetUID(), m.GetGeneration())
+}
+
+func generationToSpanID(uid types.UID, generation int64) trace.SpanID {
 	f := fnv.New64a()
-	_, _ = f.Write([]byte(m.GetUID()))
-	_ = binary.Write(f, binary.LittleEndian, m.GetGeneration())
+	_, _ = f.Write([]byte(uid))
+	_ = binary.Write(f, binary.LittleEndian, generation)
 	var h trace.SpanID
 	_ = f.Sum(h[:0])
 	return h
@@ -109,23 +124,61 @@ func objectToSpanID(m v1.Object) trace.SpanID {
 
 // we include the generation, so changes to the spec will start a new trace.
 func objectToTraceID(m v1.Object) trace.TraceID {
+	return generationToTraceID(m.GetUID(), m.GetGeneration())
+}
+
+func generationToTraceID(uid types.UID, generation int64) trace.TraceID {
 	f := fnv.New128a()
-	_, _ = f.Write([]byte(m.GetUID()))
-	_ = binary.Write(f, binary.LittleEndian, m.GetGeneration())
+	_, _ = f.Write([]byte(uid))
+	_ = binary.Write(f, binary.LittleEndian, generation)
 	var h trace.TraceID
 	_ = f.Sum(h[:0])
 	return h
 }
 
-func getObject(ctx context.Context, c client.Client, apiVersion, kind, namespace, name string) (runtime.Object, error) {
+// Fetch an object; if apiVersion is blank we look up the preferred version for the kind.
+// With a metadata cache this returns a PartialObjectMetadata, unless Capture needs the whole object.
+// If the object was prefetched for the Event being correlated we use that.
+func (r *EventWatcher) getObject(ctx context.Context, apiVersion, kind, namespace, name string) (runtime.Object, error) {
+	if p, found := prefetched(ctx, kind, namespace, name); found {
+		noteLookup(ctx, "prefetched", kind, namespace, name, p.err)
+		return p.obj, p.err
+	}
 	obj := &unstructured.Unstructured{}
-	if apiVersion == "" { // this happens with Node references
-		apiVersion = "v1" // TODO: find a more general solution
+	if apiVersion == "" { // this happens with Node references, and objects we picked out of a message
+		var err error
+		apiVersion, err = r.kinds.apiVersionFor(kind)
+		if err != nil {
+			return obj, err
+		}
+	}
+	// Capture records whole objects; otherwise metadata is all we need.
+	if r.metadata != nil && r.Capture == nil {
+		gv, err := schema.ParseGroupVersion(apiVersion)
+		if err != nil {
+			return obj, errors.Wrap(err, "unable to parse apiVersion")
+		}
+		start := time.Now()
+		partial, err := r.metadata.get(ctx, gv.WithKind(kind), namespace, name)
+		getObjectLatency.WithLabelValues("metadata").Observe(time.Since(start).Seconds())
+		noteLookup(ctx, "metadata", kind, namespace, name, err)
+		if err != nil {
+			return obj, errors.Wrap(err, "unable to get object metadata")
+		}
+		r.objects.note(partial)
+		return partial, nil
 	}
+	apiCallsNum.WithLabelValues(kind, "full").Inc()
 	obj.SetAPIVersion(apiVersion)
 	obj.SetKind(kind)
 	key := client.ObjectKey{Namespace: namespace, Name: name}
-	err := c.Get(ctx, key, obj)
+	start := time.Now()
+	err := r.Client.Get(ctx, key, obj)
+	getObjectLatency.WithLabelValues("api").Observe(time.Since(start).Seconds())
+	noteLookup(ctx, "api", kind, namespace, name, err)
+	if err == nil {
+		r.objects.note(obj)
+	}
 	return obj, errors.Wrap(err, "unable to get object")
 }
 
@@ -152,9 +205,12 @@ func refFromOwner(oRef v1.OwnerReference, namespace string) objectReference {
 }
 
 func refFromObject(obj v1.Object) objectReference {
-	ty := obj.(v1.Type)
+	var kind string
+	if ty, ok := obj.(runtime.Object); ok {
+		kind = ty.GetObjectKind().GroupVersionKind().Kind
+	}
 	return objectReference{
-		Kind:      ty.GetKind(),
+		Kind:      kind,
 		Namespace: lc(obj.GetNamespace()),
 		Name:      lc(obj.GetName()),
 	}
@@ -6,7 +6,11 @@ import (
 	"time"
 
 	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/semconv"
 	apitrace "go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
 )
 
 type outgoing struct {
@@ -14,17 +18,32 @@ type outgoing struct {
 
 	byRef    map[objectReference]*tracesdk.SpanSnapshot
 	bySpanID map[apitrace.SpanID]*tracesdk.SpanSnapshot
+	series   map[types.UID]*series // keyed by Event UID
+	tail     map[apitrace.TraceID]*tailTrace
+	logs     map[apitrace.SpanID][]*otlplog.Record // in log mode, sent once their span is
 }
 
 func newOutgoing() *outgoing {
 	return &outgoing{
 		byRef:    make(map[objectReference]*tracesdk.SpanSnapshot),
 		bySpanID: make(map[apitrace.SpanID]*tracesdk.SpanSnapshot),
+		series:   make(map[types.UID]*series),
+		tail:     make(map[apitrace.TraceID]*tailTrace),
+		logs:     make(map[apitrace.SpanID][]*otlplog.Record),
 	}
 }
 
 const timeFmt = "15:04:05.000"
 
+// The component a span is seen as coming from.
+func spanSource(span *tracesdk.SpanSnapshot) string {
+	if span.Resource == nil {
+		return ""
+	}
+	value, _ := span.Resource.Set().Value(semconv.ServiceNameKey)
+	return value.AsString()
+}
+
 // note we do not return errors, just log them here, because the one place it
 // can happen refers to a previous span, so not something the caller can react to.
 func (r *EventWatcher) emitSpan(ctx context.Context, ref objectReference, span *tracesdk.SpanSnapshot) {
@@ -39,7 +58,7 @@ func (r *EventWatcher) emitSpan(ctx context.Context, ref objectReference, span *
 			r.Log.Info("New span before old span", "oldSpan", prev.Name, "oldTime", prev.StartTime.Format(timeFmt), "newSpan", span.Name, "newTime", span.StartTime.Format(timeFmt))
 		}
 		r.Log.Info("emitting span", "ref", ref, "name", prev.Name)
-		err := r.Exporter.ExportSpans(ctx, []*tracesdk.SpanSnapshot{prev})
+		err := r.exportSpan(ctx, prev)
 		if err != nil {
 			r.Log.Error(err, "failed to emit span", "ref", ref, "name", prev.Name)
 		}
@@ -48,6 +67,24 @@ func (r *EventWatcher) emitSpan(ctx context.Context, ref objectReference, span *
 	r.outgoing.byRef[ref] = span
 	r.outgoing.bySpanID[span.SpanContext.SpanID()] = span
 
+	r.extendParents(span)
+}
+
+// Send out a span which already has its final start and end times, e.g. from container status.
+func (r *EventWatcher) emitCompleteSpan(ctx context.Context, span *tracesdk.SpanSnapshot) {
+	r.Log.Info("emitting complete span", "name", span.Name, "start", span.StartTime.Format(timeFmt), "end", span.EndTime.Format(timeFmt))
+	r.outgoing.Lock()
+	defer r.outgoing.Unlock()
+
+	r.extendParents(span)
+	err := r.exportSpan(ctx, span)
+	if err != nil {
+		r.Log.Error(err, "failed to emit span", "name", span.Name)
+	}
+}
+
+// Make sure the parents we still hold end no earlier than this span. Caller must hold the outgoing lock.
+func (r *EventWatcher) extendParents(span *tracesdk.SpanSnapshot) {
 	for parentID := span.ParentSpanID; parentID.IsValid(); {
 		if parent, found := r.outgoing.bySpanID[parentID]; found {
 			if span.EndTime.After(parent.EndTime) {
@@ -65,13 +102,17 @@ func (r *EventWatcher) emitSpan(ctx context.Context, ref objectReference, span *
 	}
 }
 
+// The threshold is for objects using the default window; others are adjusted for their own window.
 func (r *EventWatcher) flushOutgoing(ctx context.Context, threshold time.Time) {
 	r.outgoing.Lock()
 	defer r.outgoing.Unlock()
+	windows := r.recent.windows
 	for k, span := range r.outgoing.byRef {
-		if !span.EndTime.After(threshold) {
+		// Spans are held for twice the window, so adjust twice
+		win, _ := windows.forSource(spanSource(span), k.Kind)
+		if !span.EndTime.After(windows.adjust(windows.adjust(threshold, win), win)) {
 			r.Log.Info("deferred emit", "ref", k, "name", span.Name, "endTime", span.EndTime, "threshold", threshold)
-			err := r.Exporter.ExportSpans(ctx, []*tracesdk.SpanSnapshot{span})
+			err := r.exportSpan(ctx, span)
 			if err != nil {
 				r.Log.Error(err, "failed to emit span", "ref", k, "name", span.Name)
 			}
@@ -79,10 +120,42 @@ func (r *EventWatcher) flushOutgoing(ctx context.Context, threshold time.Time) {
 			delete(r.outgoing.bySpanID, span.SpanContext.SpanID())
 		}
 	}
-	// Now clear out anything old that is still in bySpanID
+	// Now clear out anything old that is still in bySpanID, unless we are still holding it
+	held := make(map[apitrace.SpanID]struct{}, len(r.outgoing.byRef))
+	for _, span := range r.outgoing.byRef {
+		held[span.SpanContext.SpanID()] = struct{}{}
+	}
+	for _, s := range r.outgoing.series {
+		held[s.span.SpanContext.SpanID()] = struct{}{}
+	}
 	for k, span := range r.outgoing.bySpanID {
-		if !span.EndTime.After(threshold) {
+		if _, found := held[k]; !found && !span.EndTime.After(threshold) {
 			delete(r.outgoing.bySpanID, k)
 		}
 	}
+	r.outgoing.updateMetrics()
+}
+
+// Traces which still have a span waiting to go out. Caller must hold the lock.
+func (o *outgoing) heldTraces() map[apitrace.TraceID]struct{} {
+	held := make(map[apitrace.TraceID]struct{})
+	for _, span := range o.byRef {
+		held[span.SpanContext.TraceID()] = struct{}{}
+	}
+	for _, s := range o.series {
+		held[s.span.SpanContext.TraceID()] = struct{}{}
+	}
+	return held
+}
+
+// Caller must hold the lock.
+func (o *outgoing) updateMetrics() {
+	outgoingSpansGauge.WithLabelValues("by_ref").Set(float64(len(o.byRef)))
+	outgoingSpansGauge.WithLabelValues("by_span_id").Set(float64(len(o.bySpanID)))
+	outgoingSpansGauge.WithLabelValues("series").Set(float64(len(o.series)))
+	tail := 0
+	for _, t := range o.tail {
+		tail += len(t.spans)
+	}
+	outgoingSpansGauge.WithLabelValues("tail").Set(float64(tail))
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"time"
 
-	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -18,15 +17,24 @@ func (r *EventWatcher) checkPending(ctx context.Context) error {
 	copy(pending, r.pending)
 	r.pending = r.pending[:0]
 	r.Unlock()
+	ctx, selfSpan := r.startSelfBatchSpan(ctx, "checkPending")
+	defer selfSpan.End()
+	selfSpan.SetAttributes(keySelfPending.Int(len(pending)))
+	var mapped []string
+	defer func() { selfSpan.SetAttributes(keyEventUID.Array(mapped)) }()
 	for { // repeat if we do generate any new spans
 		anyEmitted := false
 		for i := 0; i < len(pending); {
 			ev := pending[i]
-			emitted, err := r.emitSpanFromEvent(ctx, log, ev)
+			emitted, err := r.emitSpanFromEvent(r.pendingContext(ctx, ev), log, ev)
 			if err != nil {
+				selfSpan.RecordError(err)
 				return err
 			}
 			if emitted {
+				mapped = append(mapped, string(ev.UID))
+				_, name := r.recent.windows.forEvent(ev)
+				windowEventsNum.WithLabelValues(name, "within").Inc()
 				// delete entry from pending
 				pending = append(pending[:i], pending[i+1:]...)
 				anyEmitted = true
@@ -41,79 +49,103 @@ func (r *EventWatcher) checkPending(ctx context.Context) error {
 	// Now copy back what we didn't process, adding any new items on r.pending after the ones that were there before
 	r.Lock()
 	r.pending = append(pending, r.pending...)
+	r.shedPending()
 	r.Unlock()
 	return nil
 }
 
 // After we've given up waiting, walk further up the owner chain to look for recent activity;
 // if necessary create a new span based off the topmost owner.
+// The threshold is for events using the default window; others are adjusted for their own window.
 func (r *EventWatcher) checkOlderPending(ctx context.Context, threshold time.Time) error {
 	r.Lock()
 	var olderPending []*corev1.Event
 	// Collect older events and remove them from pending, which we unlock before calling any other methods
 	for i := 0; i < len(r.pending); {
 		event := r.pending[i]
-		if eventTime(event).Before(threshold) {
+		if r.olderPending(event, threshold) {
 			olderPending = append(olderPending, event)
 			r.pending = append(r.pending[:i], r.pending[i+1:]...)
 		} else {
 			i++
 		}
 	}
+	pendingDepth.Set(float64(len(r.pending)))
 	r.Unlock()
+	if len(olderPending) == 0 {
+		return nil
+	}
+	ctx, selfSpan := r.startSelfBatchSpan(ctx, "checkOlderPending")
+	defer selfSpan.End()
+	selfSpan.SetAttributes(keySelfPending.Int(len(olderPending)))
 	// Now go through the older events; if we can't map at this point we give up and drop them
 	for _, event := range olderPending {
-		success, ref, remoteContext, err := r.makeSpanContextFromEvent(ctx, r.Client, event)
-		if err != nil {
-			if !isNotFound(err) {
-				r.Log.Error(err, "dropping span", "name", event.UID)
-			}
-			continue
-		}
-		if success {
-			span := r.eventToSpan(event, remoteContext)
-			r.emitSpan(ctx, ref.object, span)
-			if !(ref.IsTopLevel() && remoteContext.HasSpanID()) { // Only store for top-level object if top-level span
-				r.recent.store(ref, remoteContext, span.SpanContext)
-			}
-		}
+		r.mapOlderPending(r.pendingContext(ctx, event), event)
 	}
 	return nil
 }
 
+// Whether we have waited long enough for a pending event, at threshold for the default window.
+func (r *EventWatcher) olderPending(event *corev1.Event, threshold time.Time) bool {
+	win, _ := r.recent.windows.forEvent(event)
+	return eventTime(event).Before(r.recent.windows.adjust(threshold, win))
+}
+
+// Map an event we have given up waiting for, or drop it.
+func (r *EventWatcher) mapOlderPending(ctx context.Context, event *corev1.Event) {
+	ctx, selfSpan := r.startSelfSpan(ctx, "mapOlderPending", event)
+	defer selfSpan.End()
+	_, windowName := r.recent.windows.forEvent(event)
+	success, ref, c, err := r.makeSpanContextFromEvent(ctx, r.Client, event)
+	if err != nil {
+		selfSpan.RecordError(err)
+		if isNotFound(err) { // TODO: could apply naming heuristic to go from a deleted pod to its ReplicaSet
+			droppedEventsNum.WithLabelValues("not_found").Inc()
+		} else {
+			r.Log.Error(err, "dropping span", "name", event.UID)
+			droppedEventsNum.WithLabelValues("error").Inc()
+		}
+		windowEventsNum.WithLabelValues(windowName, "dropped").Inc()
+		return
+	}
+	selfSpan.SetAttributes(keySelfEmitted.Bool(success))
+	if !success {
+		droppedEventsNum.WithLabelValues("no_owner").Inc()
+		windowEventsNum.WithLabelValues(windowName, "dropped").Inc()
+		return
+	}
+	windowEventsNum.WithLabelValues(windowName, "outside").Inc()
+	r.fetchForProjection(ctx, event.InvolvedObject.APIVersion, refFromObjRef(event.InvolvedObject))
+	span := r.eventToSpan(ctx, event, c)
+	r.emitEventSpan(ctx, ref.object, event, span)
+	if !(ref.IsTopLevel() && c.parent.HasSpanID()) { // Only store for top-level object if top-level span
+		r.recent.store(ref, eventSource(event).name, c.parent, span.SpanContext)
+	}
+}
+
 // Map the topmost owning object to a span, perhaps creating a new trace
-func (r *EventWatcher) makeSpanContextFromEvent(ctx context.Context, client client.Client, event *corev1.Event) (success bool, ref actionReference, remoteContext trace.SpanContext, err error) {
+func (r *EventWatcher) makeSpanContextFromEvent(ctx context.Context, client client.Client, event *corev1.Event) (success bool, ref actionReference, c correlation, err error) {
 	var apiVersion string
 	ref, apiVersion, err = objectFromEvent(ctx, client, event)
 	if err != nil {
 		return
 	}
 
-	if ref.actor.Name != "" {
-		// See if we have a recent event matching exactly this ref
-		_, remoteContext, success = r.recent.lookupSpanContext(ref)
-		if !success {
-			// Try the owner on its own, and if found use that as the parent
-			remoteContext, _, success = r.recent.lookupSpanContext(actionReference{object: ref.actor})
-		}
-	}
+	c, success = r.recent.choose(r.recent.candidatesFromRef(ref))
 	if !success {
 		var involved runtime.Object
-		involved, err = getObject(ctx, r.Client, apiVersion, ref.object.Kind, ref.object.Namespace, ref.object.Name)
+		involved, err = r.getObject(ctx, apiVersion, ref.object.Kind, ref.object.Namespace, ref.object.Name)
 		if err != nil {
-			if isNotFound(err) { // TODO: could apply naming heuristic to go from a deleted pod to its ReplicaSet
-				err = nil
-			}
 			return
 		}
 		r.captureObject(involved, "initial")
 
 		// See if we can map this object to a trace
-		remoteContext, err = r.makeSpanContextFromObject(ctx, involved, eventTime(event))
+		c, err = r.makeSpanContextFromObject(ctx, involved, eventTime(event))
 		if err != nil {
 			return
 		}
-		success = remoteContext.HasTraceID()
+		success = c.parent.HasTraceID()
 	}
 	return
 }
@@ -32,6 +32,7 @@ func (r *EventWatcher) captureObject(obj runtime.Object, style string) {
 	if r.Capture == nil {
 		return
 	}
+	obj = r.redactObject(obj)
 	fmt.Fprintln(r.Capture, "---")
 	d := captureDetails{Timestamp: mtime.Now(), Style: style, Kind: obj.GetObjectKind().GroupVersionKind().Kind}
 	buf, _ := gojson.Marshal(&d)
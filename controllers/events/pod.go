@@ -0,0 +1,273 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// Spans we have already sent for a container, so repeated updates to the Pod status don't send them again.
+type seenSpans struct {
+	sync.Mutex
+	seen  map[trace.SpanID]time.Time
+	clock *correlationClock
+}
+
+func newSeenSpans(clock *correlationClock) *seenSpans {
+	return &seenSpans{
+		seen:  make(map[trace.SpanID]time.Time),
+		clock: clock,
+	}
+}
+
+// add returns true if the span ID was not seen before
+func (s *seenSpans) add(id trace.SpanID) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.seen[id]; found {
+		return false
+	}
+	s.seen[id] = s.clock.now()
+	return true
+}
+
+func (s *seenSpans) expire(threshold time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for k, t := range s.seen {
+		if t.Before(threshold) {
+			delete(s.seen, k)
+		}
+	}
+}
+
+// ReconcilePod gets called every time a Pod changes, when container spans are enabled
+func (r *EventWatcher) ReconcilePod(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("pod", req.NamespacedName)
+
+	var pod corev1.Pod
+	if err := r.watchReader().Get(ctx, req.NamespacedName, &pod); err != nil {
+		if isNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "unable to fetch Pod")
+		return ctrl.Result{}, err
+	}
+
+	r.waitForBackfill()
+	ctx = r.prefetchPod(ctx, &pod)
+	var (
+		retry bool
+		err   error
+	)
+	if stopErr := r.correlate(ctx, func() { retry, err = r.handlePod(ctx, &pod) }); stopErr != nil {
+		return ctrl.Result{}, stopErr
+	}
+	if err != nil {
+		log.Error(err, "unable to handle pod")
+	}
+	if retry {
+		// The Pod's own events may still be pending; try again once they have had a chance to map.
+		win, _ := r.recent.windows.forSource("kubelet", "Pod")
+		return ctrl.Result{RequeueAfter: win.Recent}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// Read ahead the recent activity podParent will look up, and the Pod's Node, before the Pod gets its turn;
+// returns a context carrying the Node for handlePod.
+func (r *EventWatcher) prefetchPod(ctx context.Context, pod *corev1.Pod) context.Context {
+	// Objects from the typed client have no Kind set, and we need it to look up recent activity.
+	pod.GetObjectKind().SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+	objs := make(prefetchedObjects)
+	r.prefetchNode(ctx, objs, podSource(pod))
+	r.recent.prefetch(recentKeysFor(pod))
+	return context.WithValue(ctx, prefetchKey{}, objs)
+}
+
+// The kubelet on the Pod's Node reports on its containers.
+func podSource(pod *corev1.Pod) source {
+	return source{name: "kubelet", instance: pod.Spec.NodeName, node: pod.Spec.NodeName}
+}
+
+// handlePod turns the intervals recorded in a Pod's status into spans under the Pod's existing span.
+// Returns true if there were spans to send but nothing recent to parent them off.
+func (r *EventWatcher) handlePod(ctx context.Context, pod *corev1.Pod) (bool, error) {
+	// Objects from the typed client have no Kind set, and we need it to look up recent activity.
+	pod.GetObjectKind().SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+
+	// Intervals that ended before the Pod's window are older than anything we remember sending,
+	// so they could only go out again, under whatever the Pod is doing now.
+	win, _ := r.recent.windows.forSource("kubelet", "Pod")
+	spans := endedSince(containerSpans(pod), r.now().Add(-win.Expire))
+	if len(spans) == 0 {
+		return false, nil
+	}
+	c, found, err := r.podParent(pod)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		// What is left is recent enough that its parent may still show up.
+		return true, nil
+	}
+
+	res := r.getResource(ctx, podSource(pod))
+	r.objects.note(pod)
+	podAttrs := append(r.objectAttributes(refFromObject(pod), pod.UID), r.projectedAttributes(refFromObject(pod))...)
+	if pod.Spec.NodeName != "" {
+		podAttrs = append(podAttrs, keyNodeName.String(pod.Spec.NodeName))
+	}
+	for _, s := range spans {
+		if !r.containerSpans.add(s.SpanContext.SpanID()) {
+			continue
+		}
+		span := &tracesdk.SpanSnapshot{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: c.parent.TraceID(),
+				SpanID:  s.SpanContext.SpanID(),
+			}),
+			ParentSpanID:    c.parent.SpanID(),
+			SpanKind:        trace.SpanKindInternal,
+			Name:            s.Name,
+			StartTime:       s.StartTime,
+			EndTime:         s.EndTime,
+			Attributes:      append(append(s.Attributes, podAttrs...), c.attributes()...),
+			Links:           c.links,
+			StatusCode:      s.StatusCode,
+			StatusMessage:   s.StatusMessage,
+			HasRemoteParent: true,
+			Resource:        res,
+		}
+		r.emitCompleteSpan(ctx, span)
+	}
+	return false, nil
+}
+
+// Container spans go under the Pod's own latest span; failing that, wherever its owners' activity is.
+func (r *EventWatcher) podParent(pod *corev1.Pod) (correlation, bool, error) {
+	if own, found := r.recent.candidate(actionReference{object: refFromObject(pod)}, ruleObject, false); found {
+		c, found := r.recent.choose([]candidate{own})
+		return c, found, nil
+	}
+	candidates, err := r.recent.candidatesFromObject(pod)
+	if err != nil {
+		return correlation{}, false, err
+	}
+	c, found := r.recent.choose(candidates)
+	return c, found, nil
+}
+
+func endedSince(spans []*tracesdk.SpanSnapshot, threshold time.Time) []*tracesdk.SpanSnapshot {
+	var ret []*tracesdk.SpanSnapshot
+	for _, s := range spans {
+		if !s.EndTime.Before(threshold) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// Make spans, without trace context, for each interval we can find in the Pod status.
+// Intervals without a start time, e.g. a container that never started, are left out.
+func containerSpans(pod *corev1.Pod) []*tracesdk.SpanSnapshot {
+	var spans []*tracesdk.SpanSnapshot
+	for _, cs := range pod.Status.InitContainerStatuses {
+		if t := cs.State.Terminated; t != nil && !t.StartedAt.IsZero() {
+			spans = append(spans, terminatedSpan(pod, cs, "Container.Init", t))
+		}
+		// An init container that failed and was run again
+		if t := cs.LastTerminationState.Terminated; t != nil && !t.StartedAt.IsZero() {
+			spans = append(spans, terminatedSpan(pod, cs, "Container.Init", t))
+		}
+	}
+
+	// The Pod status doesn't say when each container became ready, so use the time all containers did.
+	var readyTime time.Time
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.ContainersReady && c.Status == corev1.ConditionTrue {
+			readyTime = c.LastTransitionTime.Time
+		}
+	}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		if r := cs.State.Running; r != nil && cs.Ready && !r.StartedAt.IsZero() && !readyTime.IsZero() && !readyTime.Before(r.StartedAt.Time) {
+			spans = append(spans, &tracesdk.SpanSnapshot{
+				SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+					SpanID: containerToSpanID(pod, cs.Name, "Startup", r.StartedAt.Time),
+				}),
+				Name:       "Container.Startup",
+				StartTime:  r.StartedAt.Time,
+				EndTime:    readyTime,
+				Attributes: containerAttributes(cs),
+				StatusCode: codes.Ok,
+			})
+		}
+		if t := cs.State.Terminated; t != nil && !t.StartedAt.IsZero() {
+			spans = append(spans, terminatedSpan(pod, cs, "Container.Terminated", t))
+		}
+		// A container that was restarted has details of its previous run here
+		if t := cs.LastTerminationState.Terminated; t != nil && !t.StartedAt.IsZero() {
+			spans = append(spans, terminatedSpan(pod, cs, "Container.Terminated", t))
+		}
+	}
+	return spans
+}
+
+func terminatedSpan(pod *corev1.Pod, cs corev1.ContainerStatus, name string, t *corev1.ContainerStateTerminated) *tracesdk.SpanSnapshot {
+	attrs := append(containerAttributes(cs), attribute.Int64("container.exit_code", int64(t.ExitCode)))
+	if t.Reason != "" { // e.g. "OOMKilled", "Completed", "Error"
+		attrs = append(attrs, attribute.String("container.reason", t.Reason))
+	}
+	if t.Signal != 0 {
+		attrs = append(attrs, attribute.Int64("container.signal", int64(t.Signal)))
+	}
+	statusCode := codes.Ok
+	var statusMessage string
+	if t.ExitCode != 0 {
+		statusCode = codes.Error
+		statusMessage = fmt.Sprintf("exit code %d %s", t.ExitCode, t.Reason)
+	}
+	return &tracesdk.SpanSnapshot{
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			SpanID: containerToSpanID(pod, cs.Name, name, t.StartedAt.Time),
+		}),
+		Name:          name,
+		StartTime:     t.StartedAt.Time,
+		EndTime:       t.FinishedAt.Time,
+		Attributes:    attrs,
+		StatusCode:    statusCode,
+		StatusMessage: statusMessage,
+	}
+}
+
+func containerAttributes(cs corev1.ContainerStatus) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.K8SContainerNameKey.String(cs.Name),
+		attribute.Int64("container.restart_count", int64(cs.RestartCount)),
+		attribute.String("container.image", cs.Image),
+	}
+}
+
+// create a spanID that will be consistent for one run of a container, however many times we see it
+func containerToSpanID(pod *corev1.Pod, container, phase string, startedAt time.Time) trace.SpanID {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(pod.UID))
+	_, _ = f.Write([]byte(container))
+	_, _ = f.Write([]byte(phase))
+	fmt.Fprint(f, startedAt.Unix())
+	var h trace.SpanID
+	_ = f.Sum(h[:0])
+	return h
+}
@@ -0,0 +1,97 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/codes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestContainerSpansFromPodStatus(t *testing.T) {
+	g := o.NewWithT(t)
+
+	var running corev1.Pod
+	mustParse(t, pod1RunningStr, &running)
+	running.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Pod"))
+	// The init container failed once before it succeeded
+	running.Status.InitContainerStatuses[0].RestartCount = 1
+	running.Status.InitContainerStatuses[0].LastTerminationState.Terminated = &corev1.ContainerStateTerminated{
+		ExitCode:   1,
+		Reason:     "Error",
+		StartedAt:  metav1.NewTime(time.Date(2020, 11, 27, 12, 4, 4, 0, time.UTC)),
+		FinishedAt: metav1.NewTime(time.Date(2020, 11, 27, 12, 4, 5, 0, time.UTC)),
+	}
+
+	// A container killed before it started has no start time, and makes no span
+	running.Status.ContainerStatuses = append(running.Status.ContainerStatuses, corev1.ContainerStatus{
+		Name: "never-started",
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			ExitCode:   137,
+			FinishedAt: metav1.NewTime(time.Date(2020, 11, 27, 12, 4, 7, 0, time.UTC)),
+		}},
+	})
+
+	threshold := rolloutThreshold(t)
+	mtime.NowForce(threshold)
+	defer mtime.NowReset()
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+
+	// Before any events have been mapped there is nothing to parent the container spans off.
+	_, err := r.handlePod(ctx, running.DeepCopy())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	handleRolloutEvents(t, ctx, r)
+	// Most of the events can only be mapped once we walk up to the Deployment.
+	finishRollout(t, ctx, r, -time.Hour)
+	// Something happens to the Pod itself
+	g.Expect(r.handleEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))).To(o.Succeed())
+	exporter.SpanSnapshot = nil
+	retry, err := r.handlePod(ctx, running.DeepCopy())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(retry).To(o.BeFalse())
+	// Seeing the same status again should not send the spans again.
+	_, err = r.handlePod(ctx, running.DeepCopy())
+	g.Expect(err).NotTo(o.HaveOccurred())
+
+	// Container spans go under the Pod's own latest span, not the ReplicaSet's span that created it
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(4))
+	podSpan, found := r.recent.peek(actionReference{object: refFromObject(&running)})
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(podSpan.spanContext.SpanID()).To(o.Equal(eventToSpanID(rolloutBackOff(time.Time{}))))
+	names := map[string]int{}
+	for _, span := range exporter.SpanSnapshot {
+		g.Expect(span.ParentSpanID).To(o.Equal(podSpan.spanContext.SpanID()), span.Name)
+		g.Expect(span.SpanContext.TraceID()).To(o.Equal(podSpan.spanContext.TraceID()), span.Name)
+		names[span.Name]++
+		switch {
+		case span.Name == "Container.Terminated":
+			g.Expect(attributeValue(span.Attributes, "container.reason")).To(o.Equal("OOMKilled"))
+			g.Expect(span.StatusCode).To(o.Equal(codes.Error))
+		case span.Name == "Container.Startup":
+			g.Expect(span.EndTime.Sub(span.StartTime)).To(o.Equal(time.Second))
+		case span.Name == "Container.Init" && span.StatusCode == codes.Error:
+			g.Expect(attributeValue(span.Attributes, "container.reason")).To(o.Equal("Error"))
+		}
+	}
+	g.Expect(names).To(o.Equal(map[string]int{"Container.Init": 2, "Container.Terminated": 1, "Container.Startup": 1}))
+
+	// Long after, when we no longer remember sending them, something else happens to the Pod;
+	// its old intervals are not sent again under the new activity.
+	later := threshold.Add(time.Hour)
+	mtime.NowForce(later)
+	r.tick(ctx)
+	g.Expect(r.containerSpans.seen).To(o.BeEmpty())
+	exporter.SpanSnapshot = nil
+	g.Expect(r.handleEvent(ctx, rolloutBackOff(later))).To(o.Succeed())
+	retry, err = r.handlePod(ctx, running.DeepCopy())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(retry).To(o.BeFalse())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+}
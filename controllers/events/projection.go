@@ -0,0 +1,109 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Projection copies a label or annotation from an object onto the spans about it
+type Projection struct {
+	Annotation bool   // false means a label
+	Key        string // e.g. "app.kubernetes.io/name"
+	Attribute  string // the attribute name on the span
+}
+
+// ParseProjections parses a list like "app.kubernetes.io/name=app,team" into projections;
+// where no attribute name is given we use k8s.label.<key> or k8s.annotation.<key>.
+func ParseProjections(s string, annotation bool) ([]Projection, error) {
+	var ret []Projection
+	if s == "" {
+		return ret, nil
+	}
+	prefix := "k8s.label."
+	if annotation {
+		prefix = "k8s.annotation."
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(item, "=")
+		if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+			return nil, fmt.Errorf("projection %q must be of the form key[=attribute]", item)
+		}
+		p := Projection{Annotation: annotation, Key: parts[0], Attribute: prefix + parts[0]}
+		if len(parts) == 2 {
+			p.Attribute = parts[1]
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// Pick out the values we want from an object, so we don't have to keep all its labels and annotations
+func project(projections []Projection, m v1.Object) map[string]string {
+	if len(projections) == 0 {
+		return nil
+	}
+	ret := make(map[string]string)
+	for _, p := range projections {
+		values := m.GetLabels()
+		if p.Annotation {
+			values = m.GetAnnotations()
+		}
+		if value, found := values[p.Key]; found {
+			ret[p.Attribute] = value
+		}
+	}
+	return ret
+}
+
+// Attributes from the labels and annotations of an object, and its owners if configured.
+// Values on the object win over those on its owners.
+func (r *EventWatcher) projectedAttributes(ref objectReference) []attribute.KeyValue {
+	if len(r.Projections) == 0 {
+		return nil
+	}
+	var attrs []attribute.KeyValue
+	done := make(map[string]bool)
+	for i := 0; i < maxOwnerChainSize; i++ {
+		info, found := r.objects.get(ref)
+		if !found {
+			break
+		}
+		for _, p := range r.Projections {
+			if value, found := info.projected[p.Attribute]; found && !done[p.Attribute] {
+				attrs = append(attrs, attribute.String(p.Attribute, value))
+				done[p.Attribute] = true
+			}
+		}
+		if !r.ProjectFromOwners || info.owner.Blank() {
+			break
+		}
+		ref = info.owner
+	}
+	return attrs
+}
+
+// Spans can be made without fetching the object they are about; if we need its labels, fetch it
+// (and its owners, if configured) unless we already have it.
+func (r *EventWatcher) fetchForProjection(ctx context.Context, apiVersion string, ref objectReference) {
+	if len(r.Projections) == 0 {
+		return
+	}
+	for i := 0; i < maxOwnerChainSize && !ref.Blank(); i++ {
+		info, found := r.objects.get(ref)
+		if !found {
+			if _, err := r.getObject(ctx, apiVersion, ref.Kind, ref.Namespace, ref.Name); err != nil {
+				r.Log.Info("unable to fetch object for labels", "ref", ref, "error", err)
+				return
+			}
+			info, _ = r.objects.get(ref)
+		}
+		if !r.ProjectFromOwners {
+			return
+		}
+		ref, apiVersion = info.owner, info.ownerAPIVersion
+	}
+}
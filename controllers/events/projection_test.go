@@ -0,0 +1,61 @@
+package events
+
+import (
+	"testing"
+
+	o "github.com/onsi/gomega"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+)
+
+func TestParseProjections(t *testing.T) {
+	g := o.NewWithT(t)
+	p, err := ParseProjections("app.kubernetes.io/name=app,team", false)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(p).To(o.Equal([]Projection{
+		{Key: "app.kubernetes.io/name", Attribute: "app"},
+		{Key: "team", Attribute: "k8s.label.team"},
+	}))
+	p, err = ParseProjections("cost-center", true)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(p).To(o.Equal([]Projection{{Annotation: true, Key: "cost-center", Attribute: "k8s.annotation.cost-center"}}))
+	_, err = ParseProjections("team=", false)
+	g.Expect(err).To(o.HaveOccurred())
+}
+
+func TestProjectLabelsAndAnnotations(t *testing.T) {
+	g := o.NewWithT(t)
+
+	labels, err := ParseProjections("name=app,pod-template-hash", false)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	annotations, err := ParseProjections("deployment.kubernetes.io/revision=revision", true)
+	g.Expect(err).NotTo(o.HaveOccurred())
+
+	for _, fromOwners := range []bool{false, true} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		r.Projections = append(labels, annotations...)
+		r.ProjectFromOwners = fromOwners
+		r.objects = newObjectStore(r.Projections)
+
+		replayRollout(t, ctx, r)
+		r.stop()
+
+		spans := make(map[string]*tracesdk.SpanSnapshot)
+		for _, span := range exporter.SpanSnapshot {
+			spans[span.Name] = span
+		}
+		g.Expect(spans).To(o.HaveKey("Deployment.Update"))
+		g.Expect(spans).To(o.HaveKey("Pod.Scheduled"))
+
+		// Top-level span from the Deployment itself
+		g.Expect(attributeValue(spans["Deployment.Update"].Attributes, "revision")).To(o.Equal("3"))
+		// The Pod has both labels, but only its owners have the annotation
+		pod := spans["Pod.Scheduled"].Attributes
+		g.Expect(attributeValue(pod, "app")).To(o.Equal("hello-world"))
+		g.Expect(attributeValue(pod, "k8s.label.pod-template-hash")).To(o.Equal("6b9d85fbd6"))
+		if fromOwners {
+			g.Expect(attributeValue(pod, "revision")).To(o.Equal("3"))
+		} else {
+			g.Expect(attributeValue(pod, "revision")).To(o.BeEmpty())
+		}
+	}
+}
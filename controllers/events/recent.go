@@ -5,21 +5,14 @@ import (
 	"time"
 
 	"go.opentelemetry.io/otel/trace"
-
-	"github.com/weaveworks-experiments/kspan/pkg/mtime"
-)
-
-const (
-	defaultRecentWindow = time.Second * 5
-	defaultExpireAfter  = time.Minute * 5
 )
 
+// recentInfoStore remembers recent activity on each object, for as long as the window for its kind says.
+// The backend holds the data: in memory by default, or in Redis to share between replicas.
 type recentInfoStore struct {
-	sync.Mutex
-	recentWindow time.Duration // events within this window are considered likely to belong together
-	expireAfter  time.Duration // how long to keep events in the recent cache
-
-	info map[actionReference]recentInfo
+	windows Windows
+	backend recentBackend
+	clock   *correlationClock
 }
 
 // Info about what happened recently with an object
@@ -27,52 +20,149 @@ type recentInfo struct {
 	lastUsed      time.Time
 	spanContext   trace.SpanContext
 	parentContext trace.SpanContext
+	source        string // the component that did it, so its window applies; blank if we made the span from an object
 }
 
-func newRecentInfoStore() *recentInfoStore {
+// recentBackend stores recentInfo with a time-to-live, counted from now in every backend;
+// an entry is gone once its ttl passes without a touch.
+type recentBackend interface {
+	store(key actionReference, info recentInfo, now time.Time, ttl time.Duration)
+	get(key actionReference) (recentInfo, bool)
+	touch(key actionReference, now time.Time, ttl time.Duration)
+	// Remove anything past its ttl, for backends that don't do that themselves
+	expire(now time.Time)
+	// Everything currently held, for checkpoints
+	all() map[actionReference]recentInfo
+	// Read keys ahead of correlation, for backends that are slow to read
+	prefetch(keys []actionReference)
+	// Wait for writes to be done, for backends that make them in the background
+	flush()
+	// Let go of connections and goroutines, once correlation has stopped
+	close()
+}
+
+func newRecentInfoStore(windows Windows, backend recentBackend, clock *correlationClock) *recentInfoStore {
+	if backend == nil {
+		backend = newMemoryRecentBackend()
+	}
 	return &recentInfoStore{
-		recentWindow: defaultRecentWindow,
-		expireAfter:  defaultExpireAfter,
-		info:         make(map[actionReference]recentInfo),
+		windows: windows.withDefaults(),
+		backend: backend,
+		clock:   clock,
 	}
 }
 
-func (r *recentInfoStore) store(key actionReference, parentContext, spanContext trace.SpanContext) {
-	r.Lock()
-	defer r.Unlock()
-	r.info[key] = recentInfo{
-		lastUsed:      mtime.Now(),
+// The window for what is recorded under key, from the source that did it or the kind of object.
+func (r *recentInfoStore) window(key actionReference, info recentInfo) Window {
+	win, _ := r.windows.forSource(info.source, key.object.Kind)
+	return win
+}
+
+func (r *recentInfoStore) store(key actionReference, source string, parentContext, spanContext trace.SpanContext) {
+	now := r.clock.now()
+	info := recentInfo{
+		lastUsed:      now,
 		spanContext:   spanContext,
 		parentContext: parentContext,
+		source:        source,
 	}
+	r.backend.store(key, info, now, r.window(key, info).Expire)
 }
 
-func (r *recentInfoStore) lookupSpanContext(key actionReference) (trace.SpanContext, trace.SpanContext, bool) {
-	now := mtime.Now()
-	r.Lock()
-	defer r.Unlock()
-	value, ok := r.info[key]
-	if !ok {
-		return noTrace, noTrace, false
-	}
-	//nolint:staticcheck
-	if value.lastUsed.Before(now.Add(-r.recentWindow)) {
-		// fmt.Printf("key %v info too old %s, %s\n", key, value.lastUsed, now.Add(-r.recentWindow))
-		//return noTrace, false
+// Return what we know about key, without counting this as a use.
+func (r *recentInfoStore) peek(key actionReference) (recentInfo, bool) {
+	return r.backend.get(key)
+}
+
+// Mark key as used, so it stays recent for another win.Expire
+func (r *recentInfoStore) touch(key actionReference, win Window) {
+	r.backend.touch(key, r.clock.now(), win.Expire)
+}
+
+// Read what correlation is about to look up, before it gets its turn.
+func (r *recentInfoStore) prefetch(keys []actionReference) {
+	if len(keys) > 0 {
+		r.backend.prefetch(keys)
 	}
-	value.lastUsed = now
-	r.info[key] = value
-	return value.spanContext, value.parentContext, ok
 }
 
 func (r *recentInfoStore) expire() {
-	now := mtime.Now()
-	expiry := now.Add(-r.expireAfter)
-	r.Lock()
-	defer r.Unlock()
-	for k, v := range r.info {
-		if v.lastUsed.Before(expiry) {
-			delete(r.info, k)
+	r.backend.expire(r.clock.now())
+}
+
+// Put back info saved earlier, with whatever time it has left.
+func (r *recentInfoStore) restore(key actionReference, info recentInfo) {
+	now := r.clock.now()
+	ttl := r.window(key, info).Expire - now.Sub(info.lastUsed)
+	if ttl <= 0 {
+		return
+	}
+	r.backend.store(key, info, now, ttl)
+}
+
+// The default backend, a map.
+type memoryRecentBackend struct {
+	sync.Mutex
+	info map[actionReference]memoryRecentEntry
+}
+
+type memoryRecentEntry struct {
+	recentInfo
+	expires time.Time
+}
+
+func newMemoryRecentBackend() *memoryRecentBackend {
+	return &memoryRecentBackend{info: make(map[actionReference]memoryRecentEntry)}
+}
+
+func (m *memoryRecentBackend) store(key actionReference, info recentInfo, now time.Time, ttl time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.info[key] = memoryRecentEntry{recentInfo: info, expires: now.Add(ttl)}
+	recentEntriesGauge.Set(float64(len(m.info)))
+}
+
+func (m *memoryRecentBackend) get(key actionReference) (recentInfo, bool) {
+	m.Lock()
+	defer m.Unlock()
+	value, ok := m.info[key]
+	return value.recentInfo, ok
+}
+
+func (m *memoryRecentBackend) touch(key actionReference, now time.Time, ttl time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if value, ok := m.info[key]; ok {
+		value.lastUsed = now
+		value.expires = now.Add(ttl)
+		m.info[key] = value
+	}
+}
+
+func (m *memoryRecentBackend) expire(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for k, v := range m.info {
+		if v.expires.Before(now) {
+			delete(m.info, k)
+			recentExpiredNum.Inc()
 		}
 	}
+	recentEntriesGauge.Set(float64(len(m.info)))
+}
+
+func (m *memoryRecentBackend) prefetch(keys []actionReference) {}
+
+func (m *memoryRecentBackend) flush() {}
+
+func (m *memoryRecentBackend) close() {}
+
+func (m *memoryRecentBackend) all() map[actionReference]recentInfo {
+	m.Lock()
+	defer m.Unlock()
+	ret := make(map[actionReference]recentInfo, len(m.info))
+	for k, v := range m.info {
+		ret[k] = v.recentInfo
+	}
+	return ret
 }
@@ -0,0 +1,414 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	defaultRedisPrefix = "kspan:recent:"
+	// A read that misses what was read ahead holds up correlation, so give up on a slow one quickly
+	defaultRedisTimeout = 200 * time.Millisecond
+	// How long we use what was read ahead, before reading it again
+	redisReadAheadFor = 2 * time.Second
+	// Writes waiting to be made; beyond this, writes are dropped rather than hold up correlation
+	redisWriteQueue = 1000
+)
+
+// RedisStore keeps recent activity in Redis, or anything that speaks its protocol, so several
+// replicas can correlate each other's events.
+type RedisStore struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string        // put in front of every key; default "kspan:recent:"
+	Timeout  time.Duration // for connecting, and for each read or write; default 200ms
+}
+
+// Keys expire in Redis. So that correlation doesn't wait on Redis, keys are read ahead by the workers,
+// and writes are made in the background, in order; until a write is made, we use what we wrote.
+// Each replica keeps a note of the keys it wrote, so its checkpoint holds only those.
+type redisRecentBackend struct {
+	client *redis.Client
+	prefix string
+	log    logr.Logger
+
+	sync.Mutex
+	ahead     map[actionReference]redisReadAhead
+	unwritten map[actionReference]redisWrite
+	own       map[actionReference]time.Time // when each key we wrote expires, as far as we know
+	seq       uint64
+	writes    chan redisWrite
+	closing   chan struct{} // closed to stop writing
+	closed    chan struct{} // closed once writing has stopped and the client is closed
+}
+
+// A value read ahead of correlation, or that it wasn't there
+type redisReadAhead struct {
+	info  recentInfo
+	found bool
+	at    time.Time
+}
+
+// A store, or a touch which only changes lastUsed; or, if flushed is set, a request to say when
+// everything before it is written.
+type redisWrite struct {
+	key     actionReference
+	info    recentInfo
+	touch   bool
+	ttl     time.Duration
+	seq     uint64
+	flushed chan struct{}
+}
+
+// What we put in Redis for each key; the reference is repeated so we can list everything without parsing keys.
+type redisRecentValue struct {
+	Actor, Object objectReference
+	LastUsed      time.Time
+	Span, Parent  checkpointContext
+	Source        string `json:",omitempty"`
+}
+
+func newRedisRecentBackend(config RedisStore, log logr.Logger) *redisRecentBackend {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultRedisTimeout
+	}
+	b := &redisRecentBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:         config.Addr,
+			Password:     config.Password,
+			DB:           config.DB,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			PoolTimeout:  timeout,
+		}),
+		prefix:    prefix,
+		log:       log,
+		ahead:     make(map[actionReference]redisReadAhead),
+		unwritten: make(map[actionReference]redisWrite),
+		own:       make(map[actionReference]time.Time),
+		writes:    make(chan redisWrite, redisWriteQueue),
+		closing:   make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	go b.writeAll()
+	return b
+}
+
+func (b *redisRecentBackend) key(key actionReference) string {
+	return b.prefix + key.actor.String() + "|" + key.object.String()
+}
+
+// Errors are logged and counted rather than returned: we carry on correlating as best we can without Redis.
+func (b *redisRecentBackend) failed(err error, op string) {
+	recentStoreErrorsNum.WithLabelValues(op).Inc()
+	b.log.Error(err, "redis", "op", op)
+}
+
+// Redis counts the ttl from when it gets the write.
+func (b *redisRecentBackend) store(key actionReference, info recentInfo, _ time.Time, ttl time.Duration) {
+	b.Lock()
+	b.seq++
+	w := redisWrite{key: key, info: info, ttl: ttl, seq: b.seq}
+	b.unwritten[key] = w
+	if _, found := b.ahead[key]; found {
+		b.ahead[key] = redisReadAhead{info: info, found: true, at: time.Now()}
+	}
+	b.own[key] = time.Now().Add(ttl)
+	b.Unlock()
+	b.queue(w)
+}
+
+func (b *redisRecentBackend) touch(key actionReference, now time.Time, ttl time.Duration) {
+	b.Lock()
+	b.seq++
+	w, found := b.unwritten[key]
+	if !found || w.touch {
+		w = redisWrite{key: key, touch: true}
+	}
+	w.info.lastUsed, w.ttl, w.seq = now, ttl, b.seq
+	b.unwritten[key] = w
+	if ahead, found := b.ahead[key]; found && ahead.found {
+		ahead.info.lastUsed, ahead.at = now, time.Now()
+		b.ahead[key] = ahead
+	}
+	b.own[key] = time.Now().Add(ttl)
+	b.Unlock()
+	b.queue(w)
+}
+
+// Queue w without waiting: if Redis can't keep up, the write is dropped, and we forget it was to be made.
+func (b *redisRecentBackend) queue(w redisWrite) {
+	select {
+	case b.writes <- w:
+	default:
+		recentStoreDroppedNum.Inc()
+		b.Lock()
+		if b.unwritten[w.key].seq == w.seq {
+			delete(b.unwritten, w.key)
+		}
+		b.Unlock()
+	}
+}
+
+// Wait until everything stored or touched so far is written, or writing has stopped.
+func (b *redisRecentBackend) flush() {
+	flushed := make(chan struct{})
+	select {
+	case b.writes <- redisWrite{flushed: flushed}:
+	case <-b.closed:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-b.closed:
+	}
+}
+
+// Make the writes, in the order they were asked for, until closing; then make those already queued and close the client.
+func (b *redisRecentBackend) writeAll() {
+	defer close(b.closed)
+	for {
+		select {
+		case w := <-b.writes:
+			b.write(w)
+		case <-b.closing:
+			for {
+				select {
+				case w := <-b.writes:
+					b.write(w)
+				default:
+					if err := b.client.Close(); err != nil {
+						b.failed(err, "close")
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *redisRecentBackend) write(w redisWrite) {
+	switch {
+	case w.flushed != nil:
+		close(w.flushed)
+		return
+	case w.touch:
+		b.writeTouch(w.key, w.info.lastUsed, w.ttl)
+	default:
+		b.writeStore(w.key, w.info, w.ttl)
+	}
+	b.Lock()
+	if b.unwritten[w.key].seq == w.seq { // nothing newer to write
+		delete(b.unwritten, w.key)
+	}
+	b.Unlock()
+}
+
+// Stop writing once what is queued is written, and close the client; safe to call more than once.
+func (b *redisRecentBackend) close() {
+	b.Lock()
+	defer b.Unlock()
+	select {
+	case <-b.closing:
+	default:
+		close(b.closing)
+	}
+}
+
+func (b *redisRecentBackend) writeStore(key actionReference, info recentInfo, ttl time.Duration) {
+	data, err := json.Marshal(redisRecentValue{
+		Actor:    key.actor,
+		Object:   key.object,
+		LastUsed: info.lastUsed,
+		Span:     toCheckpointContext(info.spanContext),
+		Parent:   toCheckpointContext(info.parentContext),
+		Source:   info.source,
+	})
+	if err != nil {
+		b.failed(err, "encode")
+		return
+	}
+	if err := b.client.Set(b.key(key), data, ttl).Err(); err != nil {
+		b.failed(err, "set")
+	}
+}
+
+func (b *redisRecentBackend) decode(data string) (redisRecentValue, recentInfo, bool) {
+	var value redisRecentValue
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		b.failed(err, "decode")
+		return value, recentInfo{}, false
+	}
+	return value, recentInfo{
+		lastUsed:      value.LastUsed,
+		spanContext:   value.Span.spanContext(),
+		parentContext: value.Parent.spanContext(),
+		source:        value.Source,
+	}, true
+}
+
+func (b *redisRecentBackend) get(key actionReference) (recentInfo, bool) {
+	b.Lock()
+	w, unwritten := b.unwritten[key]
+	ahead, readAhead := b.ahead[key]
+	b.Unlock()
+	if unwritten && !w.touch {
+		return w.info, true
+	}
+	var info recentInfo
+	var found bool
+	if readAhead && time.Since(ahead.at) < redisReadAheadFor {
+		info, found = ahead.info, ahead.found
+	} else {
+		info, found = b.read(key)
+	}
+	if found && unwritten { // touched, but not written yet
+		info.lastUsed = w.info.lastUsed
+	}
+	return info, found
+}
+
+func (b *redisRecentBackend) read(key actionReference) (recentInfo, bool) {
+	data, err := b.client.Get(b.key(key)).Result()
+	if err == redis.Nil {
+		return recentInfo{}, false
+	}
+	if err != nil {
+		b.failed(err, "get")
+		return recentInfo{}, false
+	}
+	_, info, ok := b.decode(data)
+	return info, ok
+}
+
+// Read all of keys in one go, for get to use during correlation.
+func (b *redisRecentBackend) prefetch(keys []actionReference) {
+	seen := make(map[actionReference]bool, len(keys))
+	var unique []actionReference
+	var redisKeys []string
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+			redisKeys = append(redisKeys, b.key(key))
+		}
+	}
+	values, err := b.client.MGet(redisKeys...).Result()
+	if err != nil {
+		b.failed(err, "mget")
+		return
+	}
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	for i, key := range unique {
+		ahead := redisReadAhead{at: now}
+		if data, ok := values[i].(string); ok {
+			_, ahead.info, ahead.found = b.decode(data)
+		}
+		b.ahead[key] = ahead
+	}
+}
+
+// Touch is done as a transaction, so we don't put back what we read over something another replica stored meanwhile.
+func (b *redisRecentBackend) writeTouch(key actionReference, now time.Time, ttl time.Duration) {
+	k := b.key(key)
+	err := b.client.Watch(func(tx *redis.Tx) error {
+		data, err := tx.Get(k).Result()
+		if err != nil {
+			return err
+		}
+		value, _, ok := b.decode(data)
+		if !ok {
+			return nil
+		}
+		value.LastUsed = now
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(k, encoded, ttl)
+			return nil
+		})
+		return err
+	}, k)
+	switch err {
+	case nil, redis.Nil, redis.TxFailedErr: // done, gone, or changed by someone else more recently
+	default:
+		b.failed(err, "touch")
+	}
+}
+
+// Forget what was read ahead and is now too old to use.
+func (b *redisRecentBackend) expire(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	for key, ahead := range b.ahead {
+		if time.Since(ahead.at) >= redisReadAheadFor {
+			delete(b.ahead, key)
+		}
+	}
+	for key, expires := range b.own {
+		if time.Now().After(expires) {
+			delete(b.own, key)
+		}
+	}
+}
+
+// Everything this replica wrote that is still there, for its checkpoint; other replicas checkpoint what they wrote.
+// This is read in one go, and writes still to be made are taken as they are, so it doesn't wait on the queue.
+func (b *redisRecentBackend) all() map[actionReference]recentInfo {
+	b.Lock()
+	keys := make([]actionReference, 0, len(b.own))
+	redisKeys := make([]string, 0, len(b.own))
+	unwritten := make(map[actionReference]redisWrite, len(b.unwritten))
+	for key := range b.own {
+		keys = append(keys, key)
+		redisKeys = append(redisKeys, b.key(key))
+		if w, found := b.unwritten[key]; found {
+			unwritten[key] = w
+		}
+	}
+	b.Unlock()
+	ret := make(map[actionReference]recentInfo, len(keys))
+	if len(keys) == 0 {
+		return ret
+	}
+	values, err := b.client.MGet(redisKeys...).Result()
+	if err != nil {
+		b.failed(err, "mget")
+	}
+	for i, key := range keys {
+		w, found := unwritten[key]
+		if found && !w.touch {
+			ret[key] = w.info
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, ok := values[i].(string)
+		if !ok { // expired
+			continue
+		}
+		if _, info, ok := b.decode(data); ok {
+			if found { // touched, but not written yet
+				info.lastUsed = w.info.lastUsed
+			}
+			ret[key] = info
+		}
+	}
+	return ret
+}
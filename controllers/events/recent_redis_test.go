@@ -0,0 +1,251 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestRedisRecentBackend(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	b := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, zap.New(zap.UseDevMode(true)))
+	// Calls are made while correlating, so they must not hang
+	g.Expect(b.client.Options().ReadTimeout).To(o.Equal(defaultRedisTimeout))
+	g.Expect(b.client.Options().DialTimeout).To(o.Equal(defaultRedisTimeout))
+	key := actionReference{
+		actor:  objectReference{Kind: "ReplicaSet", Namespace: "default", Name: "hello-world-6b9d85fbd6"},
+		object: objectReference{Kind: "Pod", Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2"},
+	}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	info := recentInfo{
+		lastUsed:      now,
+		spanContext:   trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}}),
+		parentContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{3}}),
+	}
+
+	_, found := b.get(key)
+	g.Expect(found).To(o.BeFalse())
+	b.store(key, info, now, time.Minute)
+	got, found := b.get(key)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(got).To(o.Equal(info))
+	g.Expect(b.all()).To(o.Equal(map[actionReference]recentInfo{key: info}))
+
+	// Touching extends the time to live; writes are made in the background
+	b.flush()
+	mr.FastForward(50 * time.Second)
+	b.touch(key, now.Add(50*time.Second), time.Minute)
+	got, _ = b.get(key)
+	g.Expect(got.lastUsed).To(o.Equal(now.Add(50 * time.Second)))
+	b.flush()
+	mr.FastForward(50 * time.Second)
+	got, found = b.get(key)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(got.lastUsed).To(o.Equal(now.Add(50 * time.Second)))
+
+	// and once it runs out, the entry is gone
+	mr.FastForward(time.Minute)
+	_, found = b.get(key)
+	g.Expect(found).To(o.BeFalse())
+	g.Expect(b.all()).To(o.BeEmpty())
+
+	// If Redis goes away we carry on without it
+	mr.Close()
+	b.store(key, info, now, time.Minute)
+	b.flush()
+	_, found = b.get(key)
+	g.Expect(found).To(o.BeFalse())
+}
+
+func TestRedisSharedBetweenReplicas(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	threshold := rolloutThreshold(t)
+	withRedis := func() (*EventWatcher, *fakeExporter) {
+		_, r, exporter, log := newTestEventWatcher(rolloutObjects(t)...)
+		r.recent = newRecentInfoStore(r.Windows, newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log), r.clock)
+		return r, exporter
+	}
+	a, _ := withRedis()
+	defer a.stop()
+	b, bExporter := withRedis()
+	defer b.stop()
+
+	// One replica sees the rollout
+	ctx := context.Background()
+	handleRolloutEvents(t, ctx, a)
+	g.Expect(a.checkOlderPending(ctx, threshold)).To(o.Succeed())
+	a.recent.backend.flush()
+
+	// and the other puts a later event in the same trace
+	g.Expect(b.handleEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))).To(o.Succeed())
+	b.flushOutgoing(ctx, threshold.Add(time.Minute))
+	g.Expect(bExporter.SpanSnapshot).To(o.HaveLen(1))
+	g.Expect(bExporter.SpanSnapshot[0].SpanContext.TraceID()).To(o.Equal(rolloutTraceID(t)))
+	g.Expect(bExporter.SpanSnapshot[0].ParentSpanID.IsValid()).To(o.BeTrue())
+}
+
+// What the workers read ahead is used in correlation without going back to Redis.
+func TestRedisReadAhead(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	log := zap.New(zap.UseDevMode(true))
+	writer := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log)
+	key := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2"}}
+	missing := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "missing"}}
+	info := recentInfo{
+		lastUsed:    time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+		spanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}}),
+	}
+	writer.store(key, info, info.lastUsed, time.Minute)
+	writer.flush()
+
+	b := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log)
+	b.prefetch([]actionReference{key, missing, key})
+	commands := mr.CommandCount()
+	got, found := b.get(key)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(got).To(o.Equal(info))
+	_, found = b.get(missing)
+	g.Expect(found).To(o.BeFalse())
+	g.Expect(mr.CommandCount()).To(o.Equal(commands))
+
+	// What we write is used straight away, whether or not it has been written
+	later := info.lastUsed.Add(time.Second)
+	b.touch(key, later, time.Minute)
+	got, _ = b.get(key)
+	g.Expect(got.lastUsed).To(o.Equal(later))
+	b.store(missing, info, info.lastUsed, time.Minute)
+	_, found = b.get(missing)
+	g.Expect(found).To(o.BeTrue())
+
+	b.flush()
+	got, found = writer.get(key)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(got.lastUsed).To(o.Equal(later))
+}
+
+// Each replica checkpoints only what it wrote, without waiting for its writes to be made.
+func TestRedisAllOwnKeys(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	log := zap.New(zap.UseDevMode(true))
+	a := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log)
+	defer a.close()
+	b := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, log)
+	defer b.close()
+	keyA := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "a"}}
+	keyB := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "b"}}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	info := recentInfo{
+		lastUsed:    now,
+		spanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}}),
+	}
+	a.store(keyA, info, now, time.Minute)
+	b.store(keyB, info, now, time.Minute)
+	g.Expect(a.all()).To(o.Equal(map[actionReference]recentInfo{keyA: info}))
+	a.flush()
+	b.flush()
+	g.Expect(a.all()).To(o.Equal(map[actionReference]recentInfo{keyA: info}))
+
+	// Touching b's key makes it ours too, as we are the last to use it
+	a.touch(keyB, now.Add(time.Second), time.Minute)
+	touched := info
+	touched.lastUsed = now.Add(time.Second)
+	g.Expect(a.all()).To(o.Equal(map[actionReference]recentInfo{keyA: info, keyB: touched}))
+}
+
+// When Redis can't keep up, writes are dropped rather than holding up correlation.
+func TestRedisWriteQueueFull(t *testing.T) {
+	g := o.NewWithT(t)
+	// Something that takes connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer l.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	b := newRedisRecentBackend(RedisStore{Addr: l.Addr().String(), Timeout: time.Second}, zap.New(zap.UseDevMode(true)))
+	defer b.close()
+	dropped := testutil.ToFloat64(recentStoreDroppedNum)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	start := time.Now()
+	for i := 0; i < redisWriteQueue+10; i++ {
+		key := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: fmt.Sprintf("pod-%d", i)}}
+		b.store(key, recentInfo{lastUsed: now}, now, time.Minute)
+	}
+	g.Expect(time.Since(start)).To(o.BeNumerically("<", time.Second))
+	g.Expect(testutil.ToFloat64(recentStoreDroppedNum) - dropped).To(o.BeNumerically(">=", 9))
+	// What was dropped is not held as still to be written
+	b.Lock()
+	g.Expect(len(b.unwritten)).To(o.BeNumerically("<=", redisWriteQueue+1))
+	b.Unlock()
+}
+
+// Once closed, what was queued is written and the client is closed.
+func TestRedisClose(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	b := newRedisRecentBackend(RedisStore{Addr: mr.Addr()}, zap.New(zap.UseDevMode(true)))
+	key := actionReference{object: objectReference{Kind: "Pod", Namespace: "default", Name: "hello-world-6b9d85fbd6-klpv2"}}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	b.store(key, recentInfo{lastUsed: now}, now, time.Minute)
+	b.close()
+	b.close()
+	<-b.closed
+	g.Expect(mr.Exists(b.key(key))).To(o.BeTrue())
+	g.Expect(b.client.Ping().Err()).To(o.HaveOccurred())
+	b.flush() // doesn't wait for a writer that has gone
+}
+
+// Stopping the watcher closes its store.
+func TestRedisClosedOnStop(t *testing.T) {
+	g := o.NewWithT(t)
+	mr, err := miniredis.Run()
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer mr.Close()
+
+	_, r, _, _ := newConfiguredTestEventWatcher(func(r *EventWatcher) {
+		r.RedisStore = &RedisStore{Addr: mr.Addr()}
+	})
+	r.stop()
+	<-r.correlatorDone
+	g.Eventually(r.recent.backend.(*redisRecentBackend).closed).Should(o.BeClosed())
+}
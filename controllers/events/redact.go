@@ -0,0 +1,220 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
+)
+
+// What replaces a masked value, or the part of it that matched
+const redactedMask = "[REDACTED]"
+
+// RedactAction says what to do with a match
+type RedactAction string
+
+const (
+	RedactMask RedactAction = "mask" // replace the matching text, or the whole value for a key rule
+	RedactDrop RedactAction = "drop" // remove the attribute, or blank the message
+)
+
+// RedactionRule matches either text anywhere in a string value, or attributes by key.
+type RedactionRule struct {
+	Action  RedactAction
+	Pattern *regexp.Regexp // for a regex rule
+	Key     string         // for a key rule; a trailing "*" matches any key with that prefix
+}
+
+// ParseRedactionRule parses "<action>:regex:<pattern>" or "<action>:key:<attribute key>",
+// where action is mask or drop.
+func ParseRedactionRule(s string) (RedactionRule, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return RedactionRule{}, fmt.Errorf("redaction %q must be of the form mask|drop:regex|key:<expression>", s)
+	}
+	rule := RedactionRule{Action: RedactAction(parts[0])}
+	if rule.Action != RedactMask && rule.Action != RedactDrop {
+		return RedactionRule{}, fmt.Errorf("redaction %q: action must be %s or %s", s, RedactMask, RedactDrop)
+	}
+	switch parts[1] {
+	case "regex":
+		var err error
+		if rule.Pattern, err = regexp.Compile(parts[2]); err != nil {
+			return RedactionRule{}, fmt.Errorf("redaction %q: %v", s, err)
+		}
+	case "key":
+		rule.Key = parts[2]
+	default:
+		return RedactionRule{}, fmt.Errorf("redaction %q: type must be regex or key", s)
+	}
+	return rule, nil
+}
+
+func (rule RedactionRule) matchesKey(key attribute.Key) bool {
+	if strings.HasSuffix(rule.Key, "*") {
+		return strings.HasPrefix(string(key), strings.TrimSuffix(rule.Key, "*"))
+	}
+	return rule.Key == string(key)
+}
+
+// Apply regex rules to a string; returns false if it should be dropped.
+func redactString(rules []RedactionRule, s string) (string, bool) {
+	for _, rule := range rules {
+		if rule.Pattern == nil || !rule.Pattern.MatchString(s) {
+			continue
+		}
+		redactionsNum.WithLabelValues(string(rule.Action)).Inc()
+		if rule.Action == RedactDrop {
+			return "", false
+		}
+		s = rule.Pattern.ReplaceAllString(s, redactedMask)
+	}
+	return s, true
+}
+
+// Returns a new slice if anything was redacted, otherwise the one passed in.
+func redactAttributes(rules []RedactionRule, attrs []attribute.KeyValue) []attribute.KeyValue {
+	ret, _ := redactAttributesChanged(rules, attrs)
+	return ret
+}
+
+// Like redactAttributes, also saying whether anything was redacted.
+func redactAttributesChanged(rules []RedactionRule, attrs []attribute.KeyValue) ([]attribute.KeyValue, bool) {
+	if len(rules) == 0 {
+		return attrs, false
+	}
+	ret := make([]attribute.KeyValue, 0, len(attrs))
+	changed := false
+outer:
+	for _, kv := range attrs {
+		for _, rule := range rules {
+			if rule.Key == "" || !rule.matchesKey(kv.Key) {
+				continue
+			}
+			redactionsNum.WithLabelValues(string(rule.Action)).Inc()
+			changed = true
+			if rule.Action == RedactDrop {
+				continue outer
+			}
+			kv = kv.Key.String(redactedMask)
+		}
+		if kv.Value.Type() == attribute.STRING {
+			value, keep := redactString(rules, kv.Value.AsString())
+			if !keep {
+				changed = true
+				continue
+			}
+			if value != kv.Value.AsString() {
+				kv = kv.Key.String(value)
+				changed = true
+			}
+		}
+		ret = append(ret, kv)
+	}
+	if !changed {
+		return attrs, false
+	}
+	return ret, true
+}
+
+// Returns a new Resource if anything was redacted, otherwise the one passed in, which may be shared.
+func redactResource(rules []RedactionRule, res *resource.Resource) *resource.Resource {
+	if res == nil || len(rules) == 0 {
+		return res
+	}
+	attrs, changed := redactAttributesChanged(rules, res.Attributes())
+	if !changed {
+		return res
+	}
+	return resource.NewWithAttributes(attrs...)
+}
+
+// Make a redacted copy of a span, leaving the original as it is since we may still be updating it.
+func (r *EventWatcher) redactSpan(span *tracesdk.SpanSnapshot) *tracesdk.SpanSnapshot {
+	if len(r.Redactions) == 0 {
+		return span
+	}
+	cp := *span
+	cp.Attributes = redactAttributes(r.Redactions, span.Attributes)
+	cp.StatusMessage, _ = redactString(r.Redactions, span.StatusMessage)
+	cp.Resource = redactResource(r.Redactions, span.Resource)
+	if len(span.MessageEvents) > 0 {
+		cp.MessageEvents = make([]trace.Event, len(span.MessageEvents))
+		for i, ev := range span.MessageEvents {
+			ev.Attributes = redactAttributes(r.Redactions, ev.Attributes)
+			cp.MessageEvents[i] = ev
+		}
+	}
+	if len(span.Links) > 0 {
+		cp.Links = make([]trace.Link, len(span.Links))
+		for i, l := range span.Links {
+			l.Attributes = redactAttributes(r.Redactions, l.Attributes)
+			cp.Links[i] = l
+		}
+	}
+	return &cp
+}
+
+func (r *EventWatcher) redactLog(rec *otlplog.Record) {
+	rec.Body, _ = redactString(r.Redactions, rec.Body)
+	rec.Attributes = redactAttributes(r.Redactions, rec.Attributes)
+	rec.Resource = redactResource(r.Redactions, rec.Resource)
+}
+
+// Make a copy of an object with its messages and annotation values redacted, to write to the capture file.
+// Names and other identifying fields are left alone so the capture can still be played back.
+// Key rules are for attributes, so only regex rules apply here.
+func (r *EventWatcher) redactObject(obj runtime.Object) runtime.Object {
+	if len(r.Redactions) == 0 {
+		return obj
+	}
+	switch o := obj.(type) {
+	case *corev1.Event:
+		cp := o.DeepCopy()
+		cp.Message, _ = redactString(r.Redactions, cp.Message)
+		cp.Annotations = redactAnnotations(r.Redactions, cp.Annotations)
+		return cp
+	case *unstructured.Unstructured:
+		cp := o.DeepCopy()
+		if annotations := cp.GetAnnotations(); len(annotations) > 0 {
+			cp.SetAnnotations(redactAnnotations(r.Redactions, annotations))
+		}
+		redactMessages(r.Redactions, cp.Object)
+		return cp
+	}
+	return obj
+}
+
+func redactAnnotations(rules []RedactionRule, annotations map[string]string) map[string]string {
+	for k, v := range annotations {
+		annotations[k], _ = redactString(rules, v)
+	}
+	return annotations
+}
+
+// Redact every string field called "message", e.g. in status conditions, at any depth.
+func redactMessages(rules []RedactionRule, v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if s, ok := item.(string); ok && k == "message" {
+				val[k], _ = redactString(rules, s)
+				continue
+			}
+			redactMessages(rules, item)
+		}
+	case []interface{}:
+		for _, item := range val {
+			redactMessages(rules, item)
+		}
+	}
+}
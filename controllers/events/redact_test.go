@@ -0,0 +1,113 @@
+package events
+
+import (
+	"testing"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/semconv"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func mustParseRules(t *testing.T, specs ...string) []RedactionRule {
+	var rules []RedactionRule
+	for _, s := range specs {
+		rule, err := ParseRedactionRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestParseRedactionRule(t *testing.T) {
+	g := o.NewWithT(t)
+	rule, err := ParseRedactionRule(`mask:regex:password=\S+`)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(rule.Action).To(o.Equal(RedactMask))
+	g.Expect(rule.Pattern.String()).To(o.Equal(`password=\S+`))
+	rule, err = ParseRedactionRule("drop:key:k8s.annotation.*")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(rule.Key).To(o.Equal("k8s.annotation.*"))
+	for _, bad := range []string{"mask:regex:", "hide:key:foo", "mask:glob:foo", "mask:regex:(", "mask"} {
+		_, err = ParseRedactionRule(bad)
+		g.Expect(err).To(o.HaveOccurred(), bad)
+	}
+}
+
+func TestRedactAttributes(t *testing.T) {
+	g := o.NewWithT(t)
+	rules := mustParseRules(t,
+		`mask:regex:[a-z0-9.-]+\.internal`,
+		`drop:regex:secret`,
+		"mask:key:eventID",
+		"drop:key:k8s.annotation.*",
+	)
+	attrs := []attribute.KeyValue{
+		attribute.String("message", "Failed to pull image from registry.corp.internal/app:1"),
+		attribute.String("other", "uses secret db-password"),
+		attribute.String("eventID", "default/foo.123"),
+		attribute.String("k8s.annotation.cost-center", "42"),
+		attribute.Int64("k8s.event.count", 3),
+	}
+	g.Expect(redactAttributes(rules, attrs)).To(o.Equal([]attribute.KeyValue{
+		attribute.String("message", "Failed to pull image from [REDACTED]/app:1"),
+		attribute.String("eventID", "[REDACTED]"),
+		attribute.Int64("k8s.event.count", 3),
+	}))
+	// nothing to do gives back the same slice
+	clean := attrs[4:]
+	g.Expect(redactAttributes(rules, clean)).To(o.Equal(clean))
+}
+
+func TestRedactSpansAndCapture(t *testing.T) {
+	g := o.NewWithT(t)
+
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.Redactions = mustParseRules(t, `mask:regex:hello-world-6b9d85fbd6-\w+`, "mask:key:k8s.node.name")
+
+	events := rolloutEvents(t)
+	for _, event := range events {
+		g.Expect(r.handleEvent(ctx, event)).To(o.Succeed())
+	}
+	finishRollout(t, ctx, r, 0)
+
+	g.Expect(exporter.dump()).To(o.ContainElement("2: replicaset-controller ReplicaSet.SuccessfulCreate (1) Created pod: [REDACTED]"))
+	g.Expect(exporter.dump()).NotTo(o.ContainElement(o.ContainSubstring("klpv2")))
+	// What we keep is not changed, only what we send
+	g.Expect(events[1].Message).To(o.Equal("Created pod: hello-world-6b9d85fbd6-klpv2"))
+
+	// Resource attributes are redacted too, without changing the cached Resource
+	kubeletSpans := 0
+	for _, span := range exporter.SpanSnapshot {
+		if attributeValue(span.Resource.Attributes(), semconv.ServiceNameKey) != "kubelet" {
+			continue
+		}
+		kubeletSpans++
+		g.Expect(attributeValue(span.Resource.Attributes(), "k8s.node.name")).To(o.Equal("[REDACTED]"), span.Name)
+	}
+	g.Expect(kubeletSpans).NotTo(o.BeZero())
+	kubelet := r.getResource(ctx, source{name: "kubelet", instance: "kind-control-plane", node: "kind-control-plane"})
+	g.Expect(attributeValue(kubelet.Attributes(), "k8s.node.name")).To(o.Equal("kind-control-plane"))
+
+	// Objects are redacted before capture too, but only messages and annotation values
+	captured := r.redactObject(events[1]).(*corev1.Event)
+	g.Expect(captured.Message).To(o.Equal("Created pod: [REDACTED]"))
+	pod1 := rolloutObjects(t)[4].(*unstructured.Unstructured)
+	pod1.SetAnnotations(map[string]string{"example.com/note": "restarted hello-world-6b9d85fbd6-klpv2 by hand"})
+	g.Expect(unstructured.SetNestedSlice(pod1.Object, []interface{}{
+		map[string]interface{}{"type": "Ready", "status": "False", "message": "waiting for hello-world-6b9d85fbd6-klpv2"},
+	}, "status", "conditions")).To(o.Succeed())
+	pod := r.redactObject(pod1).(*unstructured.Unstructured)
+	g.Expect(pod.GetName()).To(o.Equal("hello-world-6b9d85fbd6-klpv2"))
+	g.Expect(pod.GetAnnotations()).To(o.Equal(map[string]string{"example.com/note": "restarted [REDACTED] by hand"}))
+	conditions, _, _ := unstructured.NestedSlice(pod.Object, "status", "conditions")
+	g.Expect(conditions).To(o.Equal([]interface{}{
+		map[string]interface{}{"type": "Ready", "status": "False", "message": "waiting for [REDACTED]"},
+	}))
+	// The original is not changed
+	g.Expect(pod1.GetAnnotations()["example.com/note"]).To(o.ContainSubstring("klpv2"))
+}
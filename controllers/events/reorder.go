@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The API server doesn't deliver Events in the order they happened, and their timestamps are only
+// to the second, so within a second we put them in the order these components usually act.
+// Anything else comes first: it is more likely to be a person or a tool starting something off.
+var sourceRanks = map[string]int{
+	"cronjob-controller":     1,
+	"deployment-controller":  2,
+	"replicaset-controller":  3,
+	"statefulset-controller": 3,
+	"daemonset-controller":   3,
+	"job-controller":         3,
+	"default-scheduler":      4,
+	"kubelet":                5,
+}
+
+// Whether a should go to correlation before b: by the second they happened in, then by source,
+// then by exact time, then by the order the API server stored them.
+func causallyBefore(a, b *corev1.Event) bool {
+	ta, tb := eventTime(a), eventTime(b)
+	if sa, sb := ta.Truncate(time.Second), tb.Truncate(time.Second); !sa.Equal(sb) {
+		return sa.Before(sb)
+	}
+	if ra, rb := sourceRanks[a.Source.Component], sourceRanks[b.Source.Component]; ra != rb {
+		return ra < rb
+	}
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return storedBefore(a, b)
+}
+
+// reorderBuffer holds Events for a short while before correlation, so it can give them back in causal order.
+// Only used on the correlation goroutine.
+type reorderBuffer struct {
+	items   []reorderItem
+	arrived uint64
+}
+
+type reorderItem struct {
+	ctx       context.Context // carries the objects prefetched for the event
+	event     *corev1.Event
+	arrived   uint64
+	arrivedAt time.Time
+}
+
+func (b *reorderBuffer) add(ctx context.Context, event *corev1.Event, now time.Time) {
+	b.arrived++
+	b.items = append(b.items, reorderItem{ctx: ctx, event: event, arrived: b.arrived, arrivedAt: now})
+	reorderDepth.Set(float64(len(b.items)))
+}
+
+// Remove and return, in causal order, the events that arrived at or before threshold, along with
+// any that go before them. Holds are counted from arrival, so an event whose clock is off, or that
+// was delivered late, is held no longer and no less than any other.
+func (b *reorderBuffer) release(threshold time.Time) []reorderItem {
+	sort.SliceStable(b.items, func(i, j int) bool { return causallyBefore(b.items[i].event, b.items[j].event) })
+	n := 0
+	for i, item := range b.items {
+		if !item.arrivedAt.After(threshold) {
+			n = i + 1
+		}
+	}
+	ret := make([]reorderItem, n)
+	copy(ret, b.items)
+	b.items = b.items[n:]
+	reorderDepth.Set(float64(len(b.items)))
+
+	var latest uint64
+	for _, item := range ret {
+		if item.arrived < latest { // something that arrived after this one is going ahead of it
+			reorderedEventsNum.WithLabelValues("reordered").Inc()
+		} else {
+			reorderedEventsNum.WithLabelValues("in-order").Inc()
+			latest = item.arrived
+		}
+	}
+	return ret
+}
+
+// Send the events that have been held for ReorderWindow since they arrived on to be handled.
+func (r *EventWatcher) releaseReordered(threshold time.Time) {
+	for _, item := range r.reorder.release(threshold) {
+		r.handleAndLog(item.ctx, item.event)
+	}
+}
@@ -0,0 +1,134 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	g := o.NewWithT(t)
+
+	threshold := rolloutThreshold(t)
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.ReorderWindow = 2 * time.Second
+	r.reorder = &reorderBuffer{}
+	defer mtime.NowReset()
+
+	// Everything arrives backwards, just after the last one happened
+	var last time.Time
+	reordered := testutil.ToFloat64(reorderedEventsNum.WithLabelValues("reordered"))
+	events := rolloutEvents(t)
+	for index := len(events) - 1; index >= 0; index-- {
+		event := events[index]
+		if eventTime(event).After(last) {
+			last = eventTime(event)
+		}
+		mtime.NowForce(last)
+		g.Expect(r.correlate(ctx, func() { r.processEvent(ctx, event) })).To(o.Succeed())
+	}
+	// Nothing goes until the window has passed
+	g.Expect(r.reorder.items).To(o.HaveLen(len(deploymentUpdateEvents)))
+
+	mtime.NowForce(last.Add(r.ReorderWindow + time.Second))
+	g.Expect(r.correlate(ctx, func() { r.releaseReordered(mtime.Now().Add(-r.ReorderWindow)) })).To(o.Succeed())
+	g.Expect(r.reorder.items).To(o.BeEmpty())
+	g.Expect(testutil.ToFloat64(reorderedEventsNum.WithLabelValues("reordered"))).To(o.BeNumerically(">", reordered))
+
+	// They went to correlation in the order they happened; with no top-level event they all wait for the Deployment's span
+	var reasons []string
+	for _, event := range r.pending {
+		reasons = append(reasons, event.Source.Component+" "+event.Reason)
+	}
+	g.Expect(reasons).To(o.Equal([]string{
+		"deployment-controller ScalingReplicaSet",
+		"replicaset-controller SuccessfulCreate",
+		"default-scheduler Scheduled",
+		"deployment-controller ScalingReplicaSet",
+		"replicaset-controller SuccessfulDelete",
+		"kubelet Pulled",
+		"kubelet Created",
+		"kubelet Started",
+		"kubelet Killing",
+	}))
+
+	// and we get the trace as if they had arrived in order, except the Pod being killed now follows from its deletion
+	var err error
+	g.Expect(r.correlate(ctx, func() {
+		err = r.checkOlderPending(ctx, threshold)
+		r.flushOutgoing(ctx, threshold)
+	})).To(o.Succeed())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(exporter.dump()).To(o.Equal([]string{
+		"0: kubectl Deployment.Update ",
+		"1: deployment-controller Deployment.ScalingReplicaSet (0) Scaled up replica set hello-world-6b9d85fbd6 to 1",
+		"2: replicaset-controller ReplicaSet.SuccessfulCreate (1) Created pod: hello-world-6b9d85fbd6-klpv2",
+		"3: default-scheduler Pod.Scheduled (2) Successfully assigned default/hello-world-6b9d85fbd6-klpv2 to kind-control-plane",
+		"4: kubelet Pod.Pulled (2) Container image \"nginx:1.19.2-alpine\" already present on machine",
+		"5: kubelet Pod.Created (2) Created container hello-world",
+		"6: kubelet Pod.Started (2) Started container hello-world",
+		"7: deployment-controller Deployment.ScalingReplicaSet (0) Scaled down replica set hello-world-7ff854f459 to 0",
+		"8: replicaset-controller ReplicaSet.SuccessfulDelete (7) Deleted pod: hello-world-7ff854f459-kl4hq",
+		"9: kubelet Pod.Killing (8) Stopping container hello-world",
+	}))
+}
+
+func TestCausalOrder(t *testing.T) {
+	g := o.NewWithT(t)
+	at := func(s, component, resourceVersion string) *corev1.Event {
+		var event corev1.Event
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		g.Expect(err).NotTo(o.HaveOccurred())
+		event.LastTimestamp.Time = ts
+		event.Source.Component = component
+		event.ResourceVersion = resourceVersion
+		return &event
+	}
+	g.Expect(causallyBefore(at("2020-11-27T12:04:05Z", "kubelet", "1"), at("2020-11-27T12:04:06Z", "deployment-controller", "1"))).To(o.BeTrue())
+	g.Expect(causallyBefore(at("2020-11-27T12:04:05.5Z", "kubelet", "1"), at("2020-11-27T12:04:05Z", "default-scheduler", "1"))).To(o.BeFalse())
+	g.Expect(causallyBefore(at("2020-11-27T12:04:05Z", "flux", "1"), at("2020-11-27T12:04:05Z", "deployment-controller", "1"))).To(o.BeTrue())
+	g.Expect(causallyBefore(at("2020-11-27T12:04:05Z", "kubelet", "9"), at("2020-11-27T12:04:05Z", "kubelet", "10"))).To(o.BeTrue())
+}
+
+// Each Event is held for the window from when it arrives, whatever its timestamp says.
+func TestReorderHoldFromArrival(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, _ := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.ReorderWindow = 2 * time.Second
+	r.reorder = &reorderBuffer{}
+	defer mtime.NowReset()
+	release := func() {
+		g.Expect(r.correlate(ctx, func() { r.releaseReordered(mtime.Now().Add(-r.ReorderWindow)) })).To(o.Succeed())
+	}
+
+	// Delivered a minute late and out of order: they are still held, and put back in order
+	events := rolloutEvents(t)
+	arrived := eventTime(events[1]).Add(time.Minute)
+	mtime.NowForce(arrived)
+	for _, event := range []*corev1.Event{events[1], events[0]} {
+		event := event
+		g.Expect(r.correlate(ctx, func() { r.processEvent(ctx, event) })).To(o.Succeed())
+	}
+	g.Expect(r.reorder.items).To(o.HaveLen(2))
+	mtime.NowForce(arrived.Add(r.ReorderWindow))
+	release()
+	g.Expect(r.reorder.items).To(o.BeEmpty())
+	g.Expect(r.pending).To(o.HaveLen(2))
+	g.Expect(r.pending[0].UID).To(o.Equal(events[0].UID))
+
+	// From a clock an hour fast: it goes once the window has passed, not an hour later
+	skewed := events[2].DeepCopy()
+	skewed.LastTimestamp.Time = mtime.Now().Add(time.Hour + 500*time.Millisecond)
+	g.Expect(r.correlate(ctx, func() { r.processEvent(ctx, skewed) })).To(o.Succeed())
+	g.Expect(r.reorder.items).To(o.HaveLen(1))
+	mtime.NowForce(mtime.Now().Add(r.ReorderWindow))
+	release()
+	g.Expect(r.reorder.items).To(o.BeEmpty())
+}
@@ -0,0 +1,162 @@
+package events
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/semconv"
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+const (
+	defaultResourceCacheSize = 1000
+	defaultResourceCacheTTL  = time.Minute * 10 // so changes to e.g. node labels get picked up
+)
+
+// resourceCache holds the Resource for each source, up to a size limit,
+// throwing away the least-recently used when full and anything older than ttl.
+type resourceCache struct {
+	sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	lru     *list.List // front is most recently used
+	entries map[source]*list.Element
+}
+
+type resourceEntry struct {
+	source  source
+	res     *resource.Resource
+	created time.Time
+}
+
+func newResourceCache(maxSize int, ttl time.Duration) *resourceCache {
+	if maxSize <= 0 {
+		maxSize = defaultResourceCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultResourceCacheTTL
+	}
+	return &resourceCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[source]*list.Element),
+	}
+}
+
+func (c *resourceCache) get(s source) (*resource.Resource, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.entries[s]
+	if !found {
+		resourceCacheNum.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	entry := e.Value.(*resourceEntry)
+	if mtime.Now().Sub(entry.created) > c.ttl {
+		c.remove(e, "expired")
+		resourceCacheNum.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	resourceCacheNum.WithLabelValues("hit").Inc()
+	return entry.res, true
+}
+
+// Whether get would find s, without counting it as a use.
+func (c *resourceCache) has(s source) bool {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.entries[s]
+	return found && mtime.Now().Sub(e.Value.(*resourceEntry).created) <= c.ttl
+}
+
+// Throw out everything older than ttl, so Resources we no longer use don't sit there until pushed out.
+func (c *resourceCache) expire() {
+	c.Lock()
+	defer c.Unlock()
+	now := mtime.Now()
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.Sub(e.Value.(*resourceEntry).created) > c.ttl {
+			c.remove(e, "expired")
+		}
+		e = prev
+	}
+}
+
+func (c *resourceCache) add(s source, res *resource.Resource) {
+	c.Lock()
+	defer c.Unlock()
+	if e, found := c.entries[s]; found { // someone else got there first
+		c.remove(e, "replaced")
+	}
+	c.entries[s] = c.lru.PushFront(&resourceEntry{source: s, res: res, created: mtime.Now()})
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back(), "size")
+	}
+}
+
+// call with lock held
+func (c *resourceCache) remove(e *list.Element, reason string) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*resourceEntry).source)
+	resourceEvictionsNum.WithLabelValues(reason).Inc()
+}
+
+func (r *EventWatcher) getResource(ctx context.Context, s source) *resource.Resource {
+	if res, found := r.resources.get(s); found {
+		return res
+	}
+	// Make a new resource and cache for later.
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(s.name), semconv.ServiceInstanceIDKey.String(s.instance)}
+	if r.ClusterName != "" {
+		attrs = append(attrs, semconv.K8SClusterNameKey.String(r.ClusterName))
+	}
+	if s.node != "" {
+		attrs = append(attrs, keyNodeName.String(s.node))
+		attrs = append(attrs, r.nodeLabelAttributes(ctx, s.node)...)
+	}
+	res := resource.NewWithAttributes(attrs...)
+	r.resources.add(s, res)
+	return res
+}
+
+// Fetch the Node whose labels go on the Resource for s into objs, unless that Resource is cached already.
+func (r *EventWatcher) prefetchNode(ctx context.Context, objs prefetchedObjects, s source) {
+	if len(r.NodeLabels) == 0 || s.node == "" || r.resources.has(s) {
+		return
+	}
+	r.prefetchObject(ctx, objs, "v1", "Node", "", s.node)
+}
+
+// Copy the labels listed in NodeLabels from the Node to k8s.node.label.<key>;
+// the Node is normally prefetched, so this doesn't hold up correlation.
+func (r *EventWatcher) nodeLabelAttributes(ctx context.Context, nodeName string) []attribute.KeyValue {
+	if len(r.NodeLabels) == 0 {
+		return nil
+	}
+	node, err := r.getObject(ctx, "v1", "Node", "", nodeName)
+	if err != nil {
+		r.Log.Info("unable to fetch node for labels", "node", nodeName, "error", err)
+		return nil
+	}
+	m, err := meta.Accessor(node)
+	if err != nil {
+		return nil
+	}
+	var attrs []attribute.KeyValue
+	labels := m.GetLabels()
+	for _, key := range r.NodeLabels {
+		if value, found := labels[key]; found {
+			attrs = append(attrs, attribute.String("k8s.node.label."+key, value))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestResourceCache(t *testing.T) {
+	g := o.NewWithT(t)
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime.NowForce(now)
+	defer mtime.NowReset()
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a", "other": "x"},
+		},
+	}
+	ctx, r, _, _ := newTestEventWatcher(node)
+	defer r.stop()
+	r.NodeLabels = []string{"topology.kubernetes.io/zone"}
+	r.resources = newResourceCache(2, time.Minute)
+
+	kubelet1 := r.getResource(ctx, source{name: "kubelet", instance: "node-1", node: "node-1"})
+	g.Expect(attributeValue(kubelet1.Attributes(), "k8s.node.name")).To(o.Equal("node-1"))
+	g.Expect(attributeValue(kubelet1.Attributes(), "k8s.node.label.topology.kubernetes.io/zone")).To(o.Equal("zone-a"))
+	g.Expect(attributeValue(kubelet1.Attributes(), "k8s.node.label.other")).To(o.BeEmpty())
+	g.Expect(r.getResource(ctx, source{name: "kubelet", instance: "node-1", node: "node-1"})).To(o.BeIdenticalTo(kubelet1))
+
+	// A node we can't fetch still gets a resource, without labels
+	kubelet2 := r.getResource(ctx, source{name: "kubelet", instance: "node-2", node: "node-2"})
+	g.Expect(attributeValue(kubelet2.Attributes(), "k8s.node.name")).To(o.Equal("node-2"))
+
+	// Adding a third pushes out the least-recently used, which is node-1
+	r.getResource(ctx, source{name: "kubelet", instance: "node-2", node: "node-2"})
+	r.getResource(ctx, source{name: "default-scheduler"})
+	g.Expect(r.resources.lru.Len()).To(o.Equal(2))
+	_, found := r.resources.get(source{name: "kubelet", instance: "node-1", node: "node-1"})
+	g.Expect(found).To(o.BeFalse())
+
+	// Everything goes after the TTL
+	mtime.NowForce(now.Add(2 * time.Minute))
+	_, found = r.resources.get(source{name: "default-scheduler"})
+	g.Expect(found).To(o.BeFalse())
+	g.Expect(r.resources.entries).To(o.HaveLen(1))
+	// including those nobody asks for again
+	r.resources.expire()
+	g.Expect(r.resources.entries).To(o.BeEmpty())
+	g.Expect(r.resources.lru.Len()).To(o.Equal(0))
+}
+
+// The Node is fetched ahead of correlation, along with the Event or Pod, so its labels don't need an API call then.
+func TestResourceNodePrefetched(t *testing.T) {
+	g := o.NewWithT(t)
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-b"}}},
+	}
+	ctx, r, _, _ := newTestEventWatcher(nodes[0], nodes[1])
+	defer r.stop()
+	r.NodeLabels = []string{"topology.kubernetes.io/zone"}
+
+	event := &corev1.Event{
+		InvolvedObject: corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: "pod-1"},
+		Source:         corev1.EventSource{Component: "kubelet", Host: "node-1"},
+	}
+	eventCtx := r.prefetch(ctx, event)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod-2"},
+		Spec:       corev1.PodSpec{NodeName: "node-2"},
+	}
+	podCtx := r.prefetchPod(ctx, pod)
+	for _, node := range nodes {
+		g.Expect(r.Client.Delete(ctx, node)).To(o.Succeed())
+	}
+
+	res := r.getResource(eventCtx, eventSource(event))
+	g.Expect(attributeValue(res.Attributes(), "k8s.node.label.topology.kubernetes.io/zone")).To(o.Equal("zone-a"))
+	res = r.getResource(podCtx, podSource(pod))
+	g.Expect(attributeValue(res.Attributes(), "k8s.node.label.topology.kubernetes.io/zone")).To(o.Equal("zone-b"))
+
+	// Once the Resource is cached, the Node is not fetched again
+	objs := make(prefetchedObjects)
+	r.prefetchNode(ctx, objs, eventSource(event))
+	g.Expect(objs).To(o.BeEmpty())
+}
+
+func TestResourceNodeOnlyFromNodeInstance(t *testing.T) {
+	g := o.NewWithT(t)
+
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+	r.NodeLabels = []string{"topology.kubernetes.io/zone"}
+
+	// A controller reports its own Pod as the instance, which is not a Node
+	controller := r.getResource(ctx, eventSource(&corev1.Event{
+		ReportingController: "deployment-controller",
+		ReportingInstance:   "kube-controller-manager-abc12",
+	}))
+	g.Expect(attributeValue(controller.Attributes(), "service.instance.id")).To(o.Equal("kube-controller-manager-abc12"))
+	g.Expect(attributeValue(controller.Attributes(), "k8s.node.name")).To(o.BeEmpty())
+
+	kubelet := r.getResource(ctx, eventSource(&corev1.Event{
+		ReportingController: "kubelet",
+		ReportingInstance:   "node-1",
+	}))
+	g.Expect(attributeValue(kubelet.Attributes(), "k8s.node.name")).To(o.Equal("node-1"))
+
+	legacy := r.getResource(ctx, eventSource(&corev1.Event{
+		Source: corev1.EventSource{Component: "kubelet", Host: "node-2"},
+	}))
+	g.Expect(attributeValue(legacy.Attributes(), "k8s.node.name")).To(o.Equal("node-2"))
+}
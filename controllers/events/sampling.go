@@ -0,0 +1,237 @@
+package events
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SampleRates gives the fraction of traces to keep, from 0 to 1, by the object that started the trace.
+// A source override takes precedence over kind, and kind over namespace.
+type SampleRates struct {
+	Default     float64
+	ByNamespace map[string]float64
+	ByKind      map[string]float64
+	BySource    map[string]float64
+}
+
+// ParseSampleRates parses a list like "kube-system=0.1,default=1" into a map.
+func ParseSampleRates(s string) (map[string]float64, error) {
+	ret := make(map[string]float64)
+	if s == "" {
+		return ret, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("sample rate %q must be of the form name=rate", item)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("sample rate %q must be between 0 and 1", item)
+		}
+		ret[parts[0]] = rate
+	}
+	return ret, nil
+}
+
+// nil means keep everything
+func (s *SampleRates) all() bool {
+	return s == nil || (s.Default >= 1 && len(s.ByNamespace) == 0 && len(s.ByKind) == 0 && len(s.BySource) == 0)
+}
+
+func (s *SampleRates) forSpan(span *tracesdk.SpanSnapshot) float64 {
+	if rate, found := s.BySource[stringAttribute(span.Resource.Attributes(), semconv.ServiceNameKey)]; found {
+		return rate
+	}
+	if rate, found := s.ByKind[stringAttribute(span.Attributes, keyObjectKind)]; found {
+		return rate
+	}
+	if rate, found := s.ByNamespace[stringAttribute(span.Attributes, semconv.K8SNamespaceNameKey)]; found {
+		return rate
+	}
+	return s.Default
+}
+
+// Remembers the rate for each trace, so every span in it gets the same decision.
+type sampler struct {
+	sync.Mutex
+	rates   *SampleRates
+	byTrace map[trace.TraceID]traceRate
+	clock   *correlationClock
+}
+
+type traceRate struct {
+	rate     float64
+	lastSeen time.Time
+}
+
+func newSampler(rates *SampleRates, clock *correlationClock) *sampler {
+	return &sampler{
+		rates:   rates,
+		byTrace: make(map[trace.TraceID]traceRate),
+		clock:   clock,
+	}
+}
+
+// The span starts a trace; its namespace, kind and source set the rate for everything in the trace.
+func (s *sampler) noteRoot(span *tracesdk.SpanSnapshot) {
+	if s.rates.all() {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.byTrace[span.SpanContext.TraceID()] = traceRate{rate: s.rates.forSpan(span), lastSeen: s.clock.now()}
+}
+
+// Head sampling: decided from the trace ID, so it comes out the same for every span in the trace.
+// If we didn't see the start of the trace, the first span we do see sets the rate.
+func (s *sampler) sampled(span *tracesdk.SpanSnapshot) bool {
+	if s.rates.all() {
+		return true
+	}
+	traceID := span.SpanContext.TraceID()
+	s.Lock()
+	defer s.Unlock()
+	tr, found := s.byTrace[traceID]
+	if !found {
+		tr.rate = s.rates.forSpan(span)
+	}
+	tr.lastSeen = s.clock.now()
+	s.byTrace[traceID] = tr
+	return traceIDRatio(traceID) < tr.rate
+}
+
+// Forget the rate for traces not seen since threshold, unless we are still holding spans in them.
+func (s *sampler) expire(threshold time.Time, held map[trace.TraceID]struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	for k, v := range s.byTrace {
+		if _, found := held[k]; found {
+			continue
+		}
+		if v.lastSeen.Before(threshold) {
+			delete(s.byTrace, k)
+		}
+	}
+}
+
+// Map a trace ID to [0, 1), the same way as the OpenTelemetry ratio sampler.
+func traceIDRatio(traceID trace.TraceID) float64 {
+	x := binary.BigEndian.Uint64(traceID[8:16]) >> 1
+	return float64(x) / float64(uint64(1)<<63)
+}
+
+// A trace held for tail sampling until nothing more can join it.
+type tailTrace struct {
+	spans   []*tracesdk.SpanSnapshot
+	sampled bool      // head sampling would keep it
+	keep    bool      // something failed, so send everything
+	quietAt time.Time // when the last span added can no longer be found by a new event
+}
+
+// Every span goes out through here, so we can sample and redact it. Caller must hold the outgoing lock.
+func (r *EventWatcher) exportSpan(ctx context.Context, span *tracesdk.SpanSnapshot) error {
+	if !r.isLeader() {
+		standbySpansNum.Inc()
+		r.releaseLogs(span, false)
+		return nil
+	}
+	if r.TailSampling {
+		r.holdForTail(span)
+		return nil
+	}
+	if r.sampler.sampled(span) {
+		samplingNum.WithLabelValues("sampled").Inc()
+		r.releaseLogs(span, true)
+		return r.export(ctx, []*tracesdk.SpanSnapshot{r.redactSpan(span)})
+	}
+	samplingNum.WithLabelValues("dropped").Inc()
+	r.releaseLogs(span, false)
+	return nil
+}
+
+// Add the span to its trace, which is held until it goes quiet. Caller must hold the outgoing lock.
+func (r *EventWatcher) holdForTail(span *tracesdk.SpanSnapshot) {
+	traceID := span.SpanContext.TraceID()
+	t, found := r.outgoing.tail[traceID]
+	if !found {
+		t = &tailTrace{sampled: r.sampler.sampled(span)}
+		r.outgoing.tail[traceID] = t
+	}
+	t.spans = append(t.spans, span)
+	// A Warning event makes a span with Error status
+	if span.StatusCode == codes.Error {
+		t.keep = true
+	}
+	// A new event can join the trace for as long as this span is in the recent store
+	win, _ := r.recent.windows.forSource(spanSource(span), stringAttribute(span.Attributes, keyObjectKind))
+	if quietAt := r.now().Add(win.Expire); quietAt.After(t.quietAt) {
+		t.quietAt = quietAt
+	}
+}
+
+// Hand spans to the Exporter, noting how long after its Event each one went out.
+func (r *EventWatcher) export(ctx context.Context, spans []*tracesdk.SpanSnapshot) error {
+	// e.g. past the shutdown deadline
+	if err := ctx.Err(); err != nil {
+		exportsNum.WithLabelValues("error").Inc()
+		return err
+	}
+	if err := r.Exporter.ExportSpans(ctx, spans); err != nil {
+		exportsNum.WithLabelValues("error").Inc()
+		return err
+	}
+	exportsNum.WithLabelValues("success").Inc()
+	now := r.now()
+	for _, span := range spans {
+		// The end is the latest Event the span covers; a held span or a series can start long before
+		exportLatency.Observe(now.Sub(span.EndTime).Seconds())
+	}
+	return nil
+}
+
+// Decide on each held trace that has gone quiet by now: nothing of it still held as outgoing, and nothing
+// more can join it. Failed traces are sent whatever the sample rate, the rest if head sampling keeps them.
+func (r *EventWatcher) flushTailTraces(ctx context.Context, now time.Time) {
+	r.outgoing.Lock()
+	defer r.outgoing.Unlock()
+	held := r.outgoing.heldTraces()
+	for k, t := range r.outgoing.tail {
+		if _, found := held[k]; found || t.quietAt.After(now) {
+			continue
+		}
+		delete(r.outgoing.tail, k)
+		var decision string
+		switch {
+		case t.keep:
+			decision = "kept"
+		case t.sampled:
+			decision = "sampled"
+		default:
+			samplingNum.WithLabelValues("dropped").Add(float64(len(t.spans)))
+			for _, s := range t.spans {
+				r.releaseLogs(s, false)
+			}
+			continue
+		}
+		samplingNum.WithLabelValues(decision).Add(float64(len(t.spans)))
+		spans := make([]*tracesdk.SpanSnapshot, len(t.spans))
+		for i, s := range t.spans {
+			r.releaseLogs(s, true)
+			spans[i] = r.redactSpan(s)
+		}
+		if err := r.export(ctx, spans); err != nil {
+			r.Log.Error(err, "failed to emit held trace", "traceID", k)
+		}
+	}
+}
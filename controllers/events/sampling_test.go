@@ -0,0 +1,125 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestHeadSamplingAgreesAcrossTrace(t *testing.T) {
+	g := o.NewWithT(t)
+	s := newSampler(&SampleRates{Default: 1, ByKind: map[string]float64{"Deployment": 0.5}}, nil)
+
+	spanIn := func(traceID trace.TraceID, kind string) *tracesdk.SpanSnapshot {
+		return &tracesdk.SpanSnapshot{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID}),
+			Attributes:  []attribute.KeyValue{keyObjectKind.String(kind)},
+		}
+	}
+	kept := 0
+	for i := 0; i < 200; i++ {
+		traceID := trace.TraceID{15: byte(i), 8: byte(i * 7)}
+		s.noteRoot(spanIn(traceID, "Deployment"))
+		decision := s.sampled(spanIn(traceID, "Deployment"))
+		// A Pod on its own would always be kept, but in this trace it goes with the Deployment
+		g.Expect(s.sampled(spanIn(traceID, "Pod"))).To(o.Equal(decision))
+		// and the same again
+		g.Expect(s.sampled(spanIn(traceID, "Deployment"))).To(o.Equal(decision))
+		if decision {
+			kept++
+		}
+	}
+	g.Expect(kept).To(o.BeNumerically("~", 100, 30))
+
+	// A trace we didn't see start takes its rate from the first span we see
+	g.Expect(s.sampled(spanIn(trace.TraceID{8: 0xff}, "Pod"))).To(o.BeTrue())
+}
+
+func TestTailSamplingKeepsFailedTraces(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+	mtime.NowForce(threshold)
+	defer mtime.NowReset()
+
+	for _, failed := range []bool{false, true} {
+		ctx, r, exporter := newRolloutTestEventWatcher(t)
+		// Drop everything in the default namespace, unless something fails
+		r.Sampling = &SampleRates{Default: 1, ByNamespace: map[string]float64{"default": 0}}
+		r.sampler = newSampler(r.Sampling, r.clock)
+		r.TailSampling = true
+
+		handleRolloutEvents(t, ctx, r)
+		g.Expect(r.checkOlderPending(ctx, threshold)).To(o.Succeed())
+		if failed {
+			g.Expect(r.handleEvent(ctx, rolloutBackOff(threshold.Add(-time.Second)))).To(o.Succeed())
+		}
+		// Nothing is decided while spans in the trace are still held
+		r.flushTailTraces(ctx, threshold.Add(time.Hour))
+		g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+		r.flushOutgoing(ctx, threshold.Add(time.Minute))
+		g.Expect(r.outgoing.byRef).To(o.BeEmpty())
+		g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+		g.Expect(r.outgoing.tail).To(o.HaveLen(1))
+
+		// Nor before a new event could no longer find the trace
+		r.flushTailTraces(ctx, threshold.Add(r.recent.windows.Default.Expire-time.Second))
+		g.Expect(r.outgoing.tail).To(o.HaveLen(1))
+
+		r.flushTailTraces(ctx, threshold.Add(r.recent.windows.Default.Expire))
+		g.Expect(r.outgoing.tail).To(o.BeEmpty())
+		if failed {
+			// The whole trace goes out, including spans from before the warning
+			g.Expect(exporter.SpanSnapshot).To(o.HaveLen(len(deploymentUpdateEvents) + 2))
+			g.Expect(exporter.dump()).To(o.ContainElement(o.ContainSubstring("Pod.BackOff")))
+			g.Expect(exporter.dump()).To(o.ContainElement("0: kubectl Deployment.Update "))
+		} else {
+			g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+		}
+		r.stop()
+	}
+}
+
+func TestTailSamplingHoldsSampledTraces(t *testing.T) {
+	g := o.NewWithT(t)
+	threshold := rolloutThreshold(t)
+	mtime.NowForce(threshold)
+	defer mtime.NowReset()
+
+	// At the default rate everything is sampled, but still held until the trace is quiet
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.TailSampling = true
+
+	replayRollout(t, ctx, r)
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+	r.flushTailTraces(ctx, threshold.Add(r.recent.windows.Default.Expire))
+	g.Expect(exporter.dump()).To(o.Equal(rolloutTrace))
+}
+
+func TestSampleRateKeptWhileTraceHeld(t *testing.T) {
+	g := o.NewWithT(t)
+	s := newSampler(&SampleRates{Default: 1, ByKind: map[string]float64{"Deployment": 0}}, nil)
+	traceID := trace.TraceID{15: 1}
+	span := func(kind string) *tracesdk.SpanSnapshot {
+		return &tracesdk.SpanSnapshot{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID}),
+			Attributes:  []attribute.KeyValue{keyObjectKind.String(kind)},
+		}
+	}
+	s.noteRoot(span("Deployment"))
+	g.Expect(s.sampled(span("Pod"))).To(o.BeFalse())
+
+	// Long after the last span, but something in the trace is still held
+	s.expire(time.Now().Add(time.Hour), map[trace.TraceID]struct{}{traceID: {}})
+	g.Expect(s.sampled(span("Pod"))).To(o.BeFalse())
+
+	s.expire(time.Now().Add(time.Hour), nil)
+	g.Expect(s.byTrace).To(o.BeEmpty())
+}
@@ -0,0 +1,218 @@
+package events
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Rules by which we relate an event to something that happened recently
+const (
+	ruleDirect      = "direct"       // the event is marked as the start of a trace
+	ruleExact       = "exact"        // the same actor did something to the same object; share its parent
+	ruleActor       = "actor"        // the actor did something; that is the parent
+	ruleTopLevel    = "top-level"    // something happened to this object, which has no owner; that is the parent
+	ruleOwnerAction = "owner-action" // an owner did something to this object; that is the parent
+	ruleSibling     = "sibling"      // something else happened to this object; share its parent
+	ruleOwner       = "owner"        // something happened to an owner; that is the parent
+	ruleObject      = "object"       // something happened to this object; that is the parent
+	ruleNewTrace    = "new-trace"    // nothing recent, so we started a trace from the top-level owner
+
+	// prefix for rules applied to the actor's object rather than the involved object
+	viaActor = "actor-"
+)
+
+// How much we believe each type of relationship
+var relationWeights = map[string]float64{
+	ruleDirect:      2, // always wins
+	ruleExact:       1,
+	ruleActor:       1,
+	ruleTopLevel:    1,
+	ruleOwnerAction: 1,
+	ruleSibling:     0.85,
+	ruleOwner:       0.8,
+	ruleObject:      1,
+	ruleNewTrace:    1,
+}
+
+const (
+	partialMatchWeight = 0.95 // the reference matched only the object, not actor and object
+	viaActorWeight     = 0.9  // we had to go via the actor's object
+	perfectScore       = 1    // an exact match within the window; nothing but a direct rule can beat it
+	linkScoreRatio     = 0.5  // candidates in other traces scoring at least this fraction of the best get a link
+)
+
+// The parent chosen for a span, and how we chose it
+type correlation struct {
+	parent trace.SpanContext
+	rule   string
+	score  float64
+	links  []trace.Link // other activity this may be related to
+}
+
+// Record on the span how we chose its parent
+func (c correlation) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("kspan.correlation.rule", c.rule),
+		attribute.Float64("kspan.correlation.score", c.score),
+	}
+}
+
+// A possible parent for a span
+type candidate struct {
+	correlation
+	key    actionReference // the recent activity this came from
+	window Window          // the window that applies to that activity
+}
+
+// Score by the type of relationship, whether the reference matched exactly, and how recent the activity was.
+// Inside the window recency doesn't matter; beyond it the score falls away.
+func score(rule string, exact bool, age time.Duration, win Window) float64 {
+	s := relationWeights[rule]
+	if !exact {
+		s *= partialMatchWeight
+	}
+	if age > win.Recent {
+		s *= float64(win.Recent) / float64(age)
+	}
+	return s
+}
+
+// Look for recent activity under key, and make a candidate from it, using either its parent or its own span.
+func (r *recentInfoStore) candidate(key actionReference, rule string, useParent bool) (candidate, bool) {
+	value, found := r.peek(key)
+	if !found {
+		return candidate{}, false
+	}
+	parent := value.spanContext
+	if useParent {
+		parent = value.parentContext
+	}
+	if !parent.HasTraceID() { // e.g. the parent of a top-level span
+		return candidate{}, false
+	}
+	win := r.window(key, value)
+	return candidate{
+		correlation: correlation{
+			parent: parent,
+			rule:   rule,
+			score:  score(rule, !key.actor.Blank(), r.clock.now().Sub(value.lastUsed), win),
+		},
+		key:    key,
+		window: win,
+	}, true
+}
+
+// Candidates we can find from the references in an event, without fetching anything.
+func (r *recentInfoStore) candidatesFromRef(ref actionReference) []candidate {
+	var ret []candidate
+	if ref.actor.Name != "" {
+		// A recent event matching exactly this ref; use its parent
+		if c, found := r.candidate(ref, ruleExact, true); found {
+			ret = append(ret, c)
+		}
+		// The owner on its own; use that as the parent
+		if c, found := r.candidate(actionReference{object: ref.actor}, ruleActor, false); found {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Candidates from recent activity on an object or its owners.
+func (r *recentInfoStore) candidatesFromObject(obj runtime.Object) ([]candidate, error) {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	var ret []candidate
+	add := func(c candidate, found bool) {
+		if found {
+			ret = append(ret, c)
+		}
+	}
+	objRef := refFromObject(m)
+	// If no owners, this is a top-level object
+	if len(m.GetOwnerReferences()) == 0 {
+		add(r.candidate(actionReference{object: objRef}, ruleTopLevel, false))
+	}
+	for _, ownerRef := range m.GetOwnerReferences() {
+		ownerObjRef := refFromOwner(ownerRef, m.GetNamespace())
+		// Something the owner did to this object
+		add(r.candidate(actionReference{actor: ownerObjRef, object: objRef}, ruleOwnerAction, false))
+		// A sibling event for the object on its own
+		add(r.candidate(actionReference{object: objRef}, ruleSibling, true))
+		// The owner on its own
+		add(r.candidate(actionReference{object: ownerObjRef}, ruleOwner, false))
+	}
+	return ret, nil
+}
+
+// The keys candidatesFromObject looks up for obj, so they can be read ahead of correlation.
+func recentKeysFor(obj runtime.Object) []actionReference {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+	objRef := refFromObject(m)
+	keys := []actionReference{{object: objRef}}
+	for _, ownerRef := range m.GetOwnerReferences() {
+		ownerObjRef := refFromOwner(ownerRef, m.GetNamespace())
+		keys = append(keys, actionReference{actor: ownerObjRef, object: objRef}, actionReference{object: ownerObjRef})
+	}
+	return keys
+}
+
+// Pick the highest-scoring candidate; on a tie the first one wins.
+func bestCandidate(candidates []candidate) (candidate, bool) {
+	var best candidate
+	found := false
+	for _, c := range candidates {
+		if !found || c.score > best.score {
+			best, found = c, true
+		}
+	}
+	return best, found
+}
+
+// Pick the best candidate and mark its activity as used.
+// Runners-up in other traces are returned as links, so that relationship is not lost.
+func (r *recentInfoStore) choose(candidates []candidate) (correlation, bool) {
+	best, found := bestCandidate(candidates)
+	if !found {
+		return correlation{parent: noTrace}, false
+	}
+	if !best.key.object.Blank() {
+		r.touch(best.key, best.window)
+	}
+	best.links = nil
+	linked := make(map[trace.SpanID]bool)
+	for _, c := range candidates {
+		if c.parent.TraceID() == best.parent.TraceID() || c.score < best.score*linkScoreRatio || linked[c.parent.SpanID()] {
+			continue
+		}
+		linked[c.parent.SpanID()] = true
+		best.links = append(best.links, newLink(c.parent, c.rule))
+	}
+	return best.correlation, true
+}
+
+// Make a link to another span, saying why we linked it
+func newLink(sc trace.SpanContext, reason string) trace.Link {
+	return trace.Link{
+		SpanContext: sc,
+		Attributes:  []attribute.KeyValue{attribute.String("kspan.link.reason", reason)},
+	}
+}
+
+// Candidates found via the actor's object are less likely than ones on the involved object.
+func indirect(candidates []candidate) []candidate {
+	for i := range candidates {
+		candidates[i].rule = viaActor + candidates[i].rule
+		candidates[i].score *= viaActorWeight
+	}
+	return candidates
+}
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func Test_score(t *testing.T) {
+	g := o.NewWithT(t)
+	win := Window{Recent: 5 * time.Second}
+
+	// Within the window, the type of relationship decides.
+	g.Expect(score(ruleOwnerAction, true, time.Second, win)).To(o.BeNumerically(">", score(ruleSibling, false, time.Second, win)))
+	g.Expect(score(ruleSibling, false, time.Second, win)).To(o.BeNumerically(">", score(ruleOwner, false, time.Second, win)))
+	// Recency doesn't matter inside the window
+	g.Expect(score(ruleExact, true, time.Second, win)).To(o.Equal(score(ruleExact, true, 4*time.Second, win)))
+	// A stale exact match loses to a recent owner
+	g.Expect(score(ruleExact, true, time.Minute, win)).To(o.BeNumerically("<", score(ruleOwner, false, time.Second, win)))
+	// A partial reference scores lower than an exact one
+	g.Expect(score(ruleOwner, false, time.Second, win)).To(o.BeNumerically("<", score(ruleOwner, true, time.Second, win)))
+}
+
+func TestChooseMostRecentCandidate(t *testing.T) {
+	g := o.NewWithT(t)
+
+	var pod unstructured.Unstructured
+	mustParse(t, pod1str, &pod)
+	podRef := refFromObject(&pod)
+	rsRef := objectReference{Kind: "ReplicaSet", Namespace: "default", Name: "hello-world-6b9d85fbd6"}
+
+	sc := func(b byte) trace.SpanContext {
+		return trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{b}, SpanID: trace.SpanID{b}})
+	}
+
+	start := time.Date(2020, time.November, 27, 12, 4, 5, 0, time.UTC)
+	defer mtime.NowReset()
+	recent := newRecentInfoStore(Windows{}, nil, nil)
+
+	// The ReplicaSet created the Pod, then a minute later something else happened to the ReplicaSet.
+	mtime.NowForce(start)
+	recent.store(actionReference{actor: rsRef, object: podRef}, "", sc(1), sc(2))
+	mtime.NowForce(start.Add(time.Minute))
+	recent.store(actionReference{object: rsRef}, "", sc(3), sc(4))
+
+	candidates, err := recent.candidatesFromObject(&pod)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(candidates).To(o.HaveLen(2))
+
+	// First match would have been the stale owner-action; the recent owner scores higher.
+	c, found := recent.choose(candidates)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(c.rule).To(o.Equal(ruleOwner))
+	g.Expect(c.parent).To(o.Equal(sc(4)))
+	g.Expect(c.score).To(o.BeNumerically("~", relationWeights[ruleOwner]*partialMatchWeight))
+
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+	var event corev1.Event
+	mustParse(t, deploymentUpdateEvents[2], &event)
+	span := r.eventToSpan(ctx, &event, c)
+	g.Expect(span.ParentSpanID).To(o.Equal(sc(4).SpanID()))
+	g.Expect(attributeValue(span.Attributes, "kspan.correlation.rule")).To(o.Equal(ruleOwner))
+}
+
+func TestLinkToSecondaryCandidates(t *testing.T) {
+	g := o.NewWithT(t)
+
+	var pod unstructured.Unstructured
+	mustParse(t, pod1str, &pod)
+	podRef := refFromObject(&pod)
+	rsRef := objectReference{Kind: "ReplicaSet", Namespace: "default", Name: "hello-world-6b9d85fbd6"}
+
+	sc := func(b byte) trace.SpanContext {
+		return trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{b}, SpanID: trace.SpanID{b}})
+	}
+
+	recent := newRecentInfoStore(Windows{}, nil, nil)
+	// The ReplicaSet created the Pod as part of one trace, while the ReplicaSet is also involved in another.
+	recent.store(actionReference{actor: rsRef, object: podRef}, "", sc(1), sc(2))
+	recent.store(actionReference{object: rsRef}, "", sc(3), sc(4))
+
+	candidates, err := recent.candidatesFromObject(&pod)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	c, found := recent.choose(candidates)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(c.rule).To(o.Equal(ruleOwnerAction))
+	g.Expect(c.parent).To(o.Equal(sc(2)))
+	g.Expect(c.links).To(o.HaveLen(1))
+	g.Expect(c.links[0].SpanContext).To(o.Equal(sc(4)))
+	g.Expect(attributeValue(c.links[0].Attributes, "kspan.link.reason")).To(o.Equal(ruleOwner))
+}
+
+func TestLinkToPreviousGeneration(t *testing.T) {
+	g := o.NewWithT(t)
+
+	var deploy unstructured.Unstructured
+	mustParse(t, deploy1str, &deploy)
+	g.Expect(deploy.GetGeneration()).To(o.BeNumerically(">", 1))
+
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+	span, err := r.createTraceFromTopLevelObject(ctx, &deploy, time.Now())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(span.Links).To(o.HaveLen(1))
+	g.Expect(span.Links[0].TraceID()).To(o.Equal(generationToTraceID(deploy.GetUID(), deploy.GetGeneration()-1)))
+	g.Expect(span.Links[0].TraceID()).NotTo(o.Equal(span.SpanContext.TraceID()))
+	g.Expect(attributeValue(span.Links[0].Attributes, "kspan.link.reason")).To(o.Equal("previous-generation"))
+}
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Spans about kspan's own work, so when a trace looks wrong we can see what it did to make it.
+// They go to SelfExporter, never to Exporter, and are not affected by Sampling or Redactions.
+
+const selfTracerName = "github.com/weaveworks-experiments/kspan"
+
+var (
+	keySelfTraceID    = attribute.Key("kspan.trace_id")         // the trace the event's span went into
+	keySelfEmitted    = attribute.Key("kspan.emitted")          // whether a span was made from the event
+	keySelfPending    = attribute.Key("kspan.pending")          // number of events pending
+	keySelfPendingFor = attribute.Key("kspan.event.pending_ms") // how long the event has been pending, if it has
+	keySelfCandidates = attribute.Key("kspan.candidates")       // how many places the event might fit
+	keySelfRule       = attribute.Key("kspan.rule")             // the rule that chose where it went
+	keySelfSource     = attribute.Key("kspan.lookup.source")    // where getObject found an object
+)
+
+// The spans about one event, so they can all be given the trace ID once we know it.
+type selfSpansKey struct{}
+
+func (r *EventWatcher) initSelfTracing() {
+	if r.SelfExporter == nil {
+		r.tracer = trace.NewNoopTracerProvider().Tracer(selfTracerName)
+		return
+	}
+	r.selfProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(r.SelfExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String("kspan"))),
+	)
+	r.tracer = r.selfProvider.Tracer(selfTracerName)
+}
+
+// Start a span about our handling of event, a child of any span in ctx.
+func (r *EventWatcher) startSelfSpan(ctx context.Context, name string, event *corev1.Event) (context.Context, trace.Span) {
+	ctx, span := r.tracer.Start(ctx, name, trace.WithAttributes(
+		keyEventUID.String(string(event.UID)),
+		keyEventReason.String(event.Reason),
+		keyObjectKind.String(event.InvolvedObject.Kind),
+		keyObjectName.String(event.InvolvedObject.Name),
+	))
+	if pendingFor, pending := r.pendingFor(event); pending {
+		span.SetAttributes(keySelfPendingFor.Int64(pendingFor.Milliseconds()))
+	}
+	if !span.IsRecording() {
+		return ctx, span
+	}
+	spans, _ := ctx.Value(selfSpansKey{}).([]trace.Span)
+	return context.WithValue(ctx, selfSpansKey{}, append(spans[:len(spans):len(spans)], span)), span
+}
+
+// Start a span about work on many events; spans for each event inside it are not part of the outer event's.
+func (r *EventWatcher) startSelfBatchSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, span := r.tracer.Start(ctx, name)
+	return context.WithValue(ctx, selfSpansKey{}, []trace.Span(nil)), span
+}
+
+// Record on the spans about this event which trace its span went into.
+func noteTraceID(ctx context.Context, traceID trace.TraceID) {
+	spans, _ := ctx.Value(selfSpansKey{}).([]trace.Span)
+	for _, span := range spans {
+		span.SetAttributes(keySelfTraceID.String(traceID.String()))
+	}
+}
+
+// Note the outcome of a lookup on whatever span is in ctx.
+func noteLookup(ctx context.Context, source, kind, namespace, name string, err error) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{keySelfSource.String(source), keyObjectKind.String(kind), keyObjectName.String(namespace + "/" + name)}
+	if err != nil {
+		attrs = append(attrs, attribute.String("error", err.Error()))
+	}
+	span.AddEvent("getObject", trace.WithAttributes(attrs...))
+}
+
+// Send any self-tracing spans we are holding, and shut down SelfExporter; called at shutdown.
+// ForceFlush would only send the current batch, not what is queued behind it.
+func (r *EventWatcher) flushSelfTracing(ctx context.Context) {
+	if r.selfProvider == nil {
+		return
+	}
+	if err := r.selfProvider.Shutdown(ctx); err != nil {
+		r.Log.Error(err, "unable to flush self-tracing")
+	}
+}
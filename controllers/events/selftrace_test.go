@@ -0,0 +1,73 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestSelfTracing(t *testing.T) {
+	g := o.NewWithT(t)
+
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	selfExporter := newFakeExporter()
+	r.SelfExporter = selfExporter
+	r.initSelfTracing()
+
+	// The events wait three seconds before they are given up on at shutdown
+	arrived := rolloutThreshold(t)
+	mtime.NowForce(arrived)
+	defer mtime.NowReset()
+	events := rolloutEvents(t)
+	var err error
+	g.Expect(r.correlate(ctx, func() { err = handleEvents(ctx, r, events) })).To(o.Succeed())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	mtime.NowForce(arrived.Add(3 * time.Second))
+	r.shutdown()
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(len(rolloutTrace)))
+
+	// Every event's handling was traced, and the spans about the pending ones say which trace they went into
+	byName := map[string]int{}
+	traceIDs := map[string]bool{}
+	for _, span := range selfExporter.SpanSnapshot {
+		byName[span.Name]++
+		attrs := attribute.NewSet(span.Attributes...)
+		pendingFor, pending := attrs.Value(keySelfPendingFor)
+		if span.Name == "handleEvent" {
+			g.Expect(pending).To(o.BeFalse())
+		}
+		if span.Name == "mapOlderPending" {
+			g.Expect(attrs.HasValue(keyEventUID)).To(o.BeTrue())
+			g.Expect(pendingFor.AsInt64()).To(o.Equal(int64(3000)))
+			traceID, found := attrs.Value(keySelfTraceID)
+			g.Expect(found).To(o.BeTrue())
+			traceIDs[traceID.AsString()] = true
+		}
+	}
+	g.Expect(byName["handleEvent"]).To(o.Equal(len(deploymentUpdateEvents)))
+	g.Expect(byName["checkOlderPending"]).To(o.Equal(1))
+	g.Expect(byName["mapOlderPending"]).To(o.Equal(len(deploymentUpdateEvents)))
+	g.Expect(traceIDs).To(o.HaveLen(1))
+	g.Expect(traceIDs).To(o.HaveKey(exporter.SpanSnapshot[0].SpanContext.TraceID().String()))
+}
+
+func TestSelfTracingOff(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+
+	var event corev1.Event
+	mustParse(t, deploymentUpdateEvents[0], &event)
+	ctx, span := r.startSelfSpan(ctx, "handleEvent", &event)
+	g.Expect(span.IsRecording()).To(o.BeFalse())
+	noteTraceID(ctx, span.SpanContext().TraceID())
+	noteLookup(context.Background(), "api", "Pod", "default", "foo", nil)
+	r.flushSelfTracing(ctx)
+}
@@ -0,0 +1,170 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// How long a repeating event has to go quiet before we send its span, if not configured
+const defaultRepeatQuietPeriod = time.Minute * 5
+
+// A repeating event, collapsed into one span which we update each time the count goes up.
+type series struct {
+	span     *tracesdk.SpanSnapshot
+	count    int32
+	lastSeen time.Time
+}
+
+// Span for the event in collapsed mode: from when the event was first seen to last seen.
+func (r *EventWatcher) seriesSpan(event *corev1.Event, span *tracesdk.SpanSnapshot) {
+	if !event.FirstTimestamp.Time.IsZero() && event.FirstTimestamp.Time.Before(span.StartTime) {
+		span.StartTime = event.FirstTimestamp.Time
+	}
+	span.Attributes = append(span.Attributes, r.countAttributes(event.Count)...)
+	span.MessageEvents = append(span.MessageEvents, seriesEvent(event))
+}
+
+// One span event per count we observe
+func seriesEvent(event *corev1.Event) trace.Event {
+	attrs := []attribute.KeyValue{keyEventCount.Int64(int64(event.Count))}
+	if event.Message != "" {
+		attrs = append(attrs, attribute.String("message", event.Message))
+	}
+	return trace.Event{
+		Name:       event.Reason,
+		Time:       eventTime(event),
+		Attributes: attrs,
+	}
+}
+
+// If this event repeats one we already have a span for, or are holding as pending, update that and return true.
+func (r *EventWatcher) addToSeries(ctx context.Context, event *corev1.Event) bool {
+	r.outgoing.Lock()
+	s, found := r.outgoing.series[event.UID]
+	if !found && event.Count > 1 {
+		s, found = r.seriesFromHeldSpan(event)
+	}
+	if found {
+		if event.Count > s.count {
+			s.count = event.Count
+			s.lastSeen = eventTime(event)
+			if s.lastSeen.After(s.span.EndTime) {
+				s.span.EndTime = s.lastSeen
+			}
+			for _, kv := range r.countAttributes(event.Count) {
+				setAttribute(s.span, kv)
+			}
+			s.span.MessageEvents = append(s.span.MessageEvents, seriesEvent(event))
+			r.extendParents(s.span)
+			r.holdLog(event, s.span)
+		}
+		r.outgoing.Unlock()
+		return true
+	}
+	r.outgoing.Unlock()
+
+	// Not mapped yet; replace the pending event with this later one.
+	r.Lock()
+	defer r.Unlock()
+	for i, ev := range r.pending {
+		if ev.UID == event.UID {
+			if event.Count > ev.Count {
+				r.pending[i] = event
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// The first repeat of an event whose span is still held waiting for the next event on its object:
+// take that span out of the chain and make it the start of a series.
+// Must be called with r.outgoing locked.
+func (r *EventWatcher) seriesFromHeldSpan(event *corev1.Event) (*series, bool) {
+	for ref, span := range r.outgoing.byRef {
+		if attributeValueOf(span.Attributes, keyEventUID).AsString() != string(event.UID) {
+			continue
+		}
+		delete(r.outgoing.byRef, ref)
+		s := &series{
+			span:     span,
+			count:    int32(attributeValueOf(span.Attributes, keyEventCount).AsInt64()),
+			lastSeen: span.EndTime,
+		}
+		r.Log.Info("starting series", "name", span.Name, "count", s.count)
+		r.outgoing.series[event.UID] = s
+		return s, true
+	}
+	return nil, false
+}
+
+// Value of the attribute with key, or an empty value if not there
+func attributeValueOf(attributes []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, kv := range attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// Send out a span made from an event, and its log if enabled; in collapsed mode an event which has
+// already repeated is held as a series, while one seen once goes out as normal until it repeats.
+func (r *EventWatcher) emitEventSpan(ctx context.Context, ref objectReference, event *corev1.Event, span *tracesdk.SpanSnapshot) {
+	noteTraceID(ctx, span.SpanContext.TraceID())
+	r.outgoing.Lock()
+	r.holdLog(event, span)
+	r.outgoing.Unlock()
+	if r.CollapseRepeats && event.Count > 1 {
+		r.startSeries(event, span)
+		return
+	}
+	r.emitSpan(ctx, ref, span)
+}
+
+// Hold the span until the series goes quiet, instead of sending it when the next event for the object arrives.
+func (r *EventWatcher) startSeries(event *corev1.Event, span *tracesdk.SpanSnapshot) {
+	r.Log.Info("starting series", "name", span.Name, "count", event.Count)
+	r.outgoing.Lock()
+	defer r.outgoing.Unlock()
+	r.outgoing.series[event.UID] = &series{
+		span:     span,
+		count:    event.Count,
+		lastSeen: eventTime(event),
+	}
+	r.outgoing.bySpanID[span.SpanContext.SpanID()] = span
+	r.extendParents(span)
+}
+
+// Send the span for every series that has not been seen since threshold.
+func (r *EventWatcher) flushSeries(ctx context.Context, threshold time.Time) {
+	r.outgoing.Lock()
+	defer r.outgoing.Unlock()
+	for uid, s := range r.outgoing.series {
+		if s.lastSeen.Before(threshold) {
+			r.Log.Info("series quiet", "name", s.span.Name, "count", s.count)
+			err := r.exportSpan(ctx, s.span)
+			if err != nil {
+				r.Log.Error(err, "failed to emit span", "name", s.span.Name)
+			}
+			delete(r.outgoing.series, uid)
+			delete(r.outgoing.bySpanID, s.span.SpanContext.SpanID())
+		}
+	}
+}
+
+// Replace the value of an attribute, or add it if not there
+func setAttribute(span *tracesdk.SpanSnapshot, kv attribute.KeyValue) {
+	for i := range span.Attributes {
+		if span.Attributes[i].Key == kv.Key {
+			span.Attributes[i] = kv
+			return
+		}
+	}
+	span.Attributes = append(span.Attributes, kv)
+}
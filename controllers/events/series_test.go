@@ -0,0 +1,66 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCollapseRepeats(t *testing.T) {
+	g := o.NewWithT(t)
+
+	threshold := rolloutThreshold(t)
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.CollapseRepeats = true
+
+	handleRolloutEvents(t, ctx, r)
+	g.Expect(r.checkOlderPending(ctx, threshold)).To(o.Succeed())
+
+	// The kubelet updates the same Event each time the container crashes.
+	first := threshold
+	const repeats = 4
+	for count := 1; count <= repeats; count++ {
+		backOff := rolloutBackOff(first.Add(time.Duration(count-1) * 10 * time.Second))
+		backOff.Count = int32(count)
+		backOff.FirstTimestamp = metav1.NewTime(first)
+		g.Expect(r.handleEvent(ctx, backOff)).To(o.Succeed())
+	}
+	last := first.Add((repeats - 1) * 10 * time.Second)
+
+	// Events seen once go out as normal, chained by end time; only events that repeat are held as series.
+	r.flushOutgoing(ctx, last.Add(time.Minute))
+	names := map[string]int{}
+	for _, span := range exporter.SpanSnapshot {
+		names[span.Name]++
+		if span.Name == "Pod.Started" {
+			g.Expect(span.EndTime).To(o.Equal(first), "ended by the BackOff, before it repeated")
+		}
+	}
+	g.Expect(names).To(o.HaveKey("Pod.Started"))
+	g.Expect(names).NotTo(o.HaveKey("Pod.BackOff"))
+	g.Expect(names).NotTo(o.HaveKey("Deployment.ScalingReplicaSet"))
+
+	r.flushSeries(ctx, last)
+	g.Expect(exporter.dump()).NotTo(o.ContainElement(o.ContainSubstring("BackOff")))
+	g.Expect(exporter.dump()).To(o.ContainElement(o.ContainSubstring("ScalingReplicaSet")))
+	numSpans := len(exporter.SpanSnapshot)
+	g.Expect(numSpans).To(o.Equal(10))
+
+	r.flushSeries(ctx, last.Add(time.Second))
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(numSpans + 1))
+	span := exporter.SpanSnapshot[numSpans]
+	g.Expect(span.Name).To(o.Equal("Pod.BackOff"))
+	g.Expect(span.StartTime).To(o.Equal(first))
+	g.Expect(span.EndTime).To(o.Equal(last))
+	g.Expect(span.MessageEvents).To(o.HaveLen(repeats))
+	var count int64
+	for _, kv := range span.Attributes {
+		if kv.Key == keyEventCount {
+			count = kv.Value.AsInt64()
+		}
+	}
+	g.Expect(count).To(o.Equal(int64(repeats)))
+}
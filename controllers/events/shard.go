@@ -0,0 +1,254 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+const (
+	defaultShardLeaseDuration = 15 * time.Second
+	// Label on each replica's Lease, giving the shard group
+	shardGroupLabel = "kspan.weave.works/shard-group"
+	// Points on the hash ring per replica; more spreads namespaces more evenly
+	ringReplicas = 100
+	// Cluster-scoped objects, e.g. Nodes, have no namespace; they all go to whoever owns this key
+	clusterScopedKey = "<cluster-scoped>"
+)
+
+// Sharding splits namespaces between replicas. Each replica renews a Lease in the group; the live ones
+// make up a consistent-hash ring, and each namespace belongs to one replica on the ring.
+type Sharding struct {
+	Identity      string        // this replica, e.g. the pod name
+	Namespace     string        // where the Leases are kept
+	Group         string        // replicas sharing the work; Leases are named <Group>-<Identity>
+	LeaseDuration time.Duration // a replica that has not renewed for this long is dropped from the ring
+}
+
+type hashRing struct {
+	points []uint32 // sorted
+	owners map[uint32]string
+}
+
+func hashKey(s string) uint32 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(s))
+	// FNV spreads short, similar strings like "a#1", "a#2" poorly; mix the bits as MurmurHash3 does
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+func newHashRing(members []string) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			point := hashKey(fmt.Sprintf("%s#%d", m, i))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = m
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// The member at or after the key's point on the ring.
+func (h *hashRing) owner(key string) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+	x := hashKey(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= x })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// shards tracks the members of the group and which namespaces are ours.
+type shards struct {
+	sync.RWMutex
+	config   Sharding
+	client   client.Client // for writing our Lease
+	reader   client.Reader // for reading Leases directly, rather than caching every Lease in the cluster
+	log      logr.Logger
+	members  []string
+	ring     *hashRing
+	onChange func() // called when the ring changes; must not block
+}
+
+func newShards(config Sharding, c client.Client, reader client.Reader, log logr.Logger) *shards {
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = defaultShardLeaseDuration
+	}
+	return &shards{
+		config: config,
+		client: c,
+		reader: reader,
+		log:    log,
+		ring:   newHashRing([]string{config.Identity}), // until we hear about anyone else
+	}
+}
+
+// Nil means we are not sharding, so everything is ours.
+func (s *shards) owns(namespace string) bool {
+	if s == nil {
+		return true
+	}
+	if namespace == "" {
+		namespace = clusterScopedKey
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.ring.owner(namespace) == s.config.Identity
+}
+
+func (s *shards) setMembers(members []string) {
+	sort.Strings(members)
+	s.Lock()
+	defer s.Unlock()
+	if equalStrings(s.members, members) {
+		return
+	}
+	s.log.Info("shard members changed", "members", members)
+	s.members = members
+	s.ring = newHashRing(members)
+	shardMembersGauge.Set(float64(len(members)))
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *shards) leaseName() string {
+	return s.config.Group + "-" + s.config.Identity
+}
+
+// Renew our Lease, then read everyone's to see who is still alive.
+func (s *shards) sync(ctx context.Context) error {
+	now := metav1.NewMicroTime(mtime.Now())
+	durationSeconds := int32(s.config.LeaseDuration / time.Second)
+	var lease coordinationv1.Lease
+	err := s.reader.Get(ctx, client.ObjectKey{Namespace: s.config.Namespace, Name: s.leaseName()}, &lease)
+	switch {
+	case isNotFound(err):
+		lease = coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.config.Namespace,
+				Name:      s.leaseName(),
+				Labels:    map[string]string{shardGroupLabel: s.config.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.config.Identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		err = s.client.Create(ctx, &lease)
+	case err == nil:
+		lease.Spec.HolderIdentity = &s.config.Identity
+		lease.Spec.LeaseDurationSeconds = &durationSeconds
+		lease.Spec.RenewTime = &now
+		err = s.client.Update(ctx, &lease)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to renew shard lease")
+	}
+
+	var leases coordinationv1.LeaseList
+	err = s.reader.List(ctx, &leases, client.InNamespace(s.config.Namespace), client.MatchingLabels{shardGroupLabel: s.config.Group})
+	if err != nil {
+		return errors.Wrap(err, "unable to list shard leases")
+	}
+	members := []string{}
+	for _, l := range leases.Items {
+		if l.Spec.HolderIdentity == nil || l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expires := l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second)
+		if expires.After(now.Time) {
+			members = append(members, *l.Spec.HolderIdentity)
+		}
+	}
+	s.setMembers(members)
+	return nil
+}
+
+// Give up our Lease, so the others can take over our namespaces straight away.
+func (s *shards) release(ctx context.Context) error {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.config.Namespace, Name: s.leaseName()}}
+	err := s.client.Delete(ctx, lease)
+	if isNotFound(err) {
+		err = nil
+	}
+	return err
+}
+
+// Runs on every replica, renewing the Lease several times per LeaseDuration.
+func (s *shards) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *shards) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(s.config.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.sync(context.Background()); err != nil {
+				s.log.Error(err, "shard membership")
+			}
+		case <-stop:
+			return s.release(context.Background())
+		}
+	}
+}
+
+// Predicate to skip Events and Pods that belong to another replica. The shard cache only holds the
+// namespaces we own, but Events about cluster-scoped objects share the default namespace, and the ring
+// may have changed since the cache was built.
+func (s *shards) predicate() predicate.Predicate {
+	accept := func(m metav1.Object, obj runtime.Object) bool {
+		if event, ok := obj.(*corev1.Event); ok {
+			return s.owns(event.InvolvedObject.Namespace)
+		}
+		return s.owns(m.GetNamespace())
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return accept(e.Meta, e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return accept(e.MetaNew, e.ObjectNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return accept(e.Meta, e.Object) },
+		GenericFunc: func(e event.GenericEvent) bool { return accept(e.Meta, e.Object) },
+	}
+}
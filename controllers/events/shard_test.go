@@ -0,0 +1,86 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestHashRing(t *testing.T) {
+	g := o.NewWithT(t)
+	three := newHashRing([]string{"a", "b", "c"})
+	two := newHashRing([]string{"a", "c"})
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		ns := fmt.Sprintf("namespace-%d", i)
+		owner := three.owner(ns)
+		counts[owner]++
+		// Taking b away only moves b's namespaces
+		if owner != "b" {
+			g.Expect(two.owner(ns)).To(o.Equal(owner))
+		}
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		g.Expect(counts[m]).To(o.BeNumerically("~", 1000, 300), m)
+	}
+	g.Expect(newHashRing(nil).owner("default")).To(o.Equal(""))
+}
+
+func TestShardMembership(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	fakeClient := fake.NewFakeClientWithScheme(scheme)
+	log := zap.New(zap.UseDevMode(true))
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime.NowForce(start)
+	defer mtime.NowReset()
+
+	replica := func(name string) *shards {
+		return newShards(Sharding{Identity: name, Namespace: "kspan", Group: "kspan"}, fakeClient, fakeClient, log)
+	}
+	a, b := replica("kspan-a"), replica("kspan-b")
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(a.members).To(o.Equal([]string{"kspan-a"}))
+	g.Expect(b.sync(ctx)).To(o.Succeed())
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(a.members).To(o.Equal([]string{"kspan-a", "kspan-b"}))
+	g.Expect(b.members).To(o.Equal(a.members))
+
+	// Every namespace, and cluster-scoped objects, belong to exactly one replica
+	for _, ns := range []string{"", "default", "kube-system", "team-a", "team-b", "team-c"} {
+		g.Expect(a.owns(ns)).NotTo(o.Equal(b.owns(ns)), ns)
+	}
+
+	// b stops renewing; once its Lease runs out a takes everything
+	mtime.NowForce(start.Add(defaultShardLeaseDuration + time.Second))
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(a.members).To(o.Equal([]string{"kspan-a"}))
+	for _, ns := range []string{"", "default", "kube-system", "team-a", "team-b", "team-c"} {
+		g.Expect(a.owns(ns)).To(o.BeTrue(), ns)
+	}
+
+	// b comes back, then shuts down cleanly
+	g.Expect(b.sync(ctx)).To(o.Succeed())
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(a.members).To(o.HaveLen(2))
+	g.Expect(b.release(ctx)).To(o.Succeed())
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(a.members).To(o.Equal([]string{"kspan-a"}))
+
+	// Not sharding: everything is ours
+	var none *shards
+	g.Expect(none.owns("default")).To(o.BeTrue())
+}
@@ -0,0 +1,238 @@
+package events
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	ctrlsource "sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+// How often to look for namespaces created or deleted, if the ring hasn't changed
+const shardNamespaceInterval = time.Minute
+
+// shardCache holds Events and Pods from only the namespaces this replica owns, rather than every
+// replica caching the whole cluster. When the ring changes it builds a new cache for the new set of
+// namespaces; a new cache replays everything in it to the controllers, so Events the old owner was
+// given are queued again here, and gated by ownedSince so we only take on what it may not have finished.
+type shardCache struct {
+	sync.RWMutex
+	shards   *shards
+	filter   *Filter
+	reader   client.Reader // for listing Namespaces
+	newCache func(namespaces []string) (cache.Cache, error)
+	log      logr.Logger
+
+	changed    chan struct{}
+	current    cache.Cache
+	stop       chan struct{} // closed to stop the current cache
+	namespaces []string
+	since      map[string]time.Time // when we took over each namespace after the first build
+	watches    []func(cache.Cache) error
+}
+
+func newShardCache(s *shards, filter *Filter, reader client.Reader, newCache func([]string) (cache.Cache, error), log logr.Logger) *shardCache {
+	c := &shardCache{
+		shards:   s,
+		filter:   filter,
+		reader:   reader,
+		newCache: newCache,
+		log:      log,
+		changed:  make(chan struct{}, 1),
+		since:    make(map[string]time.Time),
+	}
+	s.onChange = func() {
+		select {
+		case c.changed <- struct{}{}:
+		default: // already signalled
+		}
+	}
+	return c
+}
+
+// The namespaces whose Events and Pods we should cache. Events about cluster-scoped objects, e.g. Nodes,
+// are kept in the default namespace, so whoever owns those needs it too; the shard predicate sorts them out.
+func (c *shardCache) wanted(ctx context.Context) ([]string, error) {
+	var list corev1.NamespaceList
+	if err := c.reader.List(ctx, &list); err != nil {
+		return nil, errors.Wrap(err, "unable to list namespaces")
+	}
+	var namespaces []string
+	for _, ns := range list.Items {
+		name := ns.Name
+		if !allowed(c.filter.IncludeNamespaces, c.filter.ExcludeNamespaces, name) {
+			continue
+		}
+		if c.shards.owns(name) || (name == metav1.NamespaceDefault && c.shards.owns("")) {
+			namespaces = append(namespaces, name)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Build a cache for the namespaces we own now, if that has changed, and move everything watching over to it.
+func (c *shardCache) rebuild(ctx context.Context) error {
+	namespaces, err := c.wanted(ctx)
+	if err != nil {
+		return err
+	}
+	c.RLock()
+	same := c.current != nil && equalStrings(c.namespaces, namespaces)
+	c.RUnlock()
+	if same {
+		return nil
+	}
+	c.log.Info("caching namespaces", "namespaces", namespaces)
+	newCache, err := c.newCache(namespaces)
+	if err != nil {
+		return errors.Wrap(err, "unable to create cache")
+	}
+	// Hook everything up before the new cache starts, so it hears about every object in it
+	c.RLock()
+	watches := append([]func(cache.Cache) error(nil), c.watches...)
+	c.RUnlock()
+	for _, watch := range watches {
+		if err := watch(newCache); err != nil {
+			return err
+		}
+	}
+	stop := make(chan struct{})
+	go func() {
+		if err := newCache.Start(stop); err != nil {
+			c.log.Error(err, "shard cache")
+		}
+	}()
+	if !newCache.WaitForCacheSync(stop) {
+		close(stop)
+		return errors.New("shard cache did not sync")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, watch := range c.watches[len(watches):] { // added while we were waiting
+		if err := watch(newCache); err != nil {
+			close(stop)
+			return err
+		}
+	}
+	now := mtime.Now()
+	previous := make(map[string]bool, len(c.namespaces))
+	for _, ns := range c.namespaces {
+		previous[ns] = true
+	}
+	since := make(map[string]time.Time, len(namespaces))
+	for _, ns := range namespaces {
+		switch {
+		case previous[ns]:
+			if t, found := c.since[ns]; found {
+				since[ns] = t
+			}
+		case c.current != nil: // not the first build, so we are taking it over from another replica
+			since[ns] = now
+		}
+	}
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.current, c.stop, c.namespaces, c.since = newCache, stop, namespaces, since
+	shardNamespacesGauge.Set(float64(len(namespaces)))
+	return nil
+}
+
+// When we took over the namespace from another replica; zero if it has been ours since we started.
+func (c *shardCache) ownedSince(namespace string) time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.since[namespace]
+}
+
+// Call watch on the current cache, if any, and on each one we build after.
+func (c *shardCache) watch(watch func(cache.Cache) error) error {
+	c.Lock()
+	defer c.Unlock()
+	c.watches = append(c.watches, watch)
+	if c.current == nil {
+		return nil
+	}
+	return watch(c.current)
+}
+
+// A controller-runtime Source for objects of one kind, from whichever cache is current.
+func (c *shardCache) source(obj runtime.Object) ctrlsource.Source {
+	return ctrlsource.Func(func(h handler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+		return c.watch(func(current cache.Cache) error {
+			informer, err := current.GetInformer(context.Background(), obj)
+			if err != nil {
+				return err
+			}
+			return (&ctrlsource.Informer{Informer: informer}).Start(h, q, prct...)
+		})
+	})
+}
+
+// Get implements client.Reader, from the current cache.
+func (c *shardCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	c.RLock()
+	defer c.RUnlock()
+	if c.current == nil {
+		return errors.New("shard cache not started")
+	}
+	return c.current.Get(ctx, key, obj)
+}
+
+// List implements client.Reader, from the current cache.
+func (c *shardCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	c.RLock()
+	defer c.RUnlock()
+	if c.current == nil {
+		return errors.New("shard cache not started")
+	}
+	return c.current.List(ctx, list, opts...)
+}
+
+// Runs on every replica, rebuilding the cache when the ring changes, or namespaces come and go.
+func (c *shardCache) NeedLeaderElection() bool {
+	return false
+}
+
+func (c *shardCache) Start(stop <-chan struct{}) error {
+	if err := c.rebuild(context.Background()); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(shardNamespaceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.changed:
+		case <-ticker.C:
+		case <-stop:
+			c.Lock()
+			if c.stop != nil {
+				close(c.stop)
+				c.stop = nil
+			}
+			c.Unlock()
+			return nil
+		}
+		if err := c.rebuild(context.Background()); err != nil {
+			c.log.Error(err, "rebuilding shard cache")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestShardCacheFollowsRing(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	names := []string{"default", "kube-system", "team-a", "team-b", "team-c", "team-d", "team-e", "team-f"}
+	var objs []runtime.Object
+	for _, name := range names {
+		objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, objs...)
+	log := zap.New(zap.UseDevMode(true))
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime.NowForce(start)
+	defer mtime.NowReset()
+
+	replica := func(name string) *shards {
+		return newShards(Sharding{Identity: name, Namespace: "kspan", Group: "kspan"}, fakeClient, fakeClient, log)
+	}
+	a, b := replica("kspan-a"), replica("kspan-b")
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(b.sync(ctx)).To(o.Succeed())
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+
+	var (
+		built  [][]string
+		caches []*informertest.FakeInformers
+	)
+	newCache := func(namespaces []string) (cache.Cache, error) {
+		built = append(built, namespaces)
+		c := &informertest.FakeInformers{Scheme: scheme}
+		caches = append(caches, c)
+		return c, nil
+	}
+	c := newShardCache(a, &Filter{ExcludeNamespaces: []string{"kube-system"}}, fakeClient, newCache, log)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	g.Expect(c.source(&corev1.Event{}).Start(&handler.EnqueueRequestForObject{}, queue, a.predicate())).To(o.Succeed())
+
+	// Only the namespaces a owns are cached
+	g.Expect(c.rebuild(ctx)).To(o.Succeed())
+	g.Expect(built).To(o.HaveLen(1))
+	var taken, kept string
+	for _, ns := range names {
+		owned := ns != "kube-system" && (a.owns(ns) || (ns == "default" && a.owns("")))
+		if owned {
+			g.Expect(built[0]).To(o.ContainElement(ns))
+			kept = ns
+		} else {
+			g.Expect(built[0]).NotTo(o.ContainElement(ns))
+			if ns != "kube-system" && ns != "default" {
+				taken = ns
+			}
+		}
+	}
+	g.Expect(taken).NotTo(o.BeEmpty(), "b should own something")
+	g.Expect(kept).NotTo(o.BeEmpty(), "a should own something")
+	// Nothing changed, so nothing is rebuilt
+	g.Expect(c.rebuild(ctx)).To(o.Succeed())
+	g.Expect(built).To(o.HaveLen(1))
+
+	// b stops renewing; the ring changes, which tells the cache to rebuild with everything
+	takeover := start.Add(defaultShardLeaseDuration + time.Second)
+	mtime.NowForce(takeover)
+	g.Expect(a.sync(ctx)).To(o.Succeed())
+	g.Expect(c.changed).To(o.Receive())
+	g.Expect(c.rebuild(ctx)).To(o.Succeed())
+	g.Expect(built).To(o.HaveLen(2))
+	g.Expect(built[1]).To(o.Equal([]string{"default", "team-a", "team-b", "team-c", "team-d", "team-e", "team-f"}))
+	g.Expect(c.ownedSince(taken)).To(o.Equal(takeover))
+	g.Expect(c.ownedSince(kept).IsZero()).To(o.BeTrue())
+
+	// The new cache replays what it holds, so an Event that was given to b is queued here now
+	informer, err := caches[1].FakeInformerFor(&corev1.Event{})
+	g.Expect(err).NotTo(o.HaveOccurred())
+	mkEvent := func(namespace, name string, at time.Time) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: namespace, Name: name},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: namespace, Name: "x"},
+			LastTimestamp:  metav1.NewTime(at),
+		}
+	}
+	unfinished := mkEvent(taken, "x.1", takeover.Add(-time.Second))
+	informer.Add(unfinished)
+	g.Expect(queue.Len()).To(o.Equal(1))
+	item, _ := queue.Get()
+	g.Expect(item).To(o.Equal(reconcile.Request{NamespacedName: types.NamespacedName{Namespace: taken, Name: "x.1"}}))
+	queue.Done(item)
+
+	// Of what is replayed, we take on only what b may not have finished
+	_, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+	r.shardCache = c
+	r.startTime = start.Add(-time.Hour)
+	g.Expect(r.tooOld(unfinished)).To(o.BeFalse())
+	g.Expect(r.tooOld(mkEvent(taken, "x.2", takeover.Add(-time.Minute)))).To(o.BeTrue())
+	// while in a namespace we had all along, the same time is not too old
+	g.Expect(r.tooOld(mkEvent(kept, "x.3", takeover.Add(-time.Minute)))).To(o.BeFalse())
+}
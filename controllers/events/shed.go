@@ -0,0 +1,71 @@
+package events
+
+import (
+	"fmt"
+	"math/rand"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// How many events we hold waiting to be mapped, if not configured
+const defaultPendingLimit = 5000
+
+// ShedPolicy says which pending event to drop when the queue is full
+type ShedPolicy string
+
+const (
+	ShedOldest ShedPolicy = "oldest"       // the one that has waited longest
+	ShedNormal ShedPolicy = "normal-first" // the oldest Normal event; Warnings only if there are no Normal events
+	ShedSample ShedPolicy = "sample"       // one at random, so what we keep is a fair sample of the storm
+)
+
+// ParseShedPolicy checks s is one of the policies; blank means the default.
+func ParseShedPolicy(s string) (ShedPolicy, error) {
+	switch p := ShedPolicy(s); p {
+	case "":
+		return ShedOldest, nil
+	case ShedOldest, ShedNormal, ShedSample:
+		return p, nil
+	}
+	return "", fmt.Errorf("shed policy %q must be one of %s, %s, %s", s, ShedOldest, ShedNormal, ShedSample)
+}
+
+// Add an event to the pending queue, shedding if it is full; returns false if the event itself was shed.
+// Caller must hold the lock.
+func (r *EventWatcher) addPending(event *corev1.Event) bool {
+	r.pending = append(r.pending, event)
+	return !r.shedPending()[event]
+}
+
+// Bring the pending queue down to the limit, and return what was shed. Caller must hold the lock,
+// on the correlation goroutine.
+func (r *EventWatcher) shedPending() map[*corev1.Event]bool {
+	shed := make(map[*corev1.Event]bool)
+	for len(r.pending) > r.PendingLimit {
+		i := r.chooseShed()
+		ev := r.pending[i]
+		r.pending = append(r.pending[:i], r.pending[i+1:]...)
+		delete(r.pendingEntries, ev)
+		shed[ev] = true
+		shedEventsNum.WithLabelValues(string(r.ShedPolicy), ev.Type).Inc()
+		_, windowName := r.recent.windows.forEvent(ev)
+		windowEventsNum.WithLabelValues(windowName, "dropped").Inc()
+	}
+	pendingDepth.Set(float64(len(r.pending)))
+	return shed
+}
+
+// Index of the pending event to drop; the queue is oldest first.
+func (r *EventWatcher) chooseShed() int {
+	switch r.ShedPolicy {
+	case ShedNormal:
+		for i, ev := range r.pending {
+			if ev.Type != corev1.EventTypeWarning {
+				return i
+			}
+		}
+	case ShedSample:
+		return rand.Intn(len(r.pending))
+	}
+	return 0
+}
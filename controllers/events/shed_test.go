@@ -0,0 +1,65 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPendingShedding(t *testing.T) {
+	g := o.NewWithT(t)
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Events for pods we can't find, so they wait in pending; every third is a Warning
+	mkEvent := func(i int) *corev1.Event {
+		eventType := corev1.EventTypeNormal
+		if i%3 == 0 {
+			eventType = corev1.EventTypeWarning
+		}
+		name := fmt.Sprintf("evicted-%d", i)
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: name + ".event", UID: types.UID(name)},
+			InvolvedObject: corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "default", Name: name},
+			Reason:         "Evicted",
+			Source:         corev1.EventSource{Component: "kubelet"},
+			Type:           eventType,
+			LastTimestamp:  metav1.NewTime(start.Add(time.Duration(i) * time.Second)),
+		}
+	}
+
+	for _, policy := range []ShedPolicy{ShedOldest, ShedNormal, ShedSample} {
+		ctx, r, _, _ := newTestEventWatcher()
+		r.PendingLimit = 10
+		r.ShedPolicy = policy
+		for i := 0; i < 30; i++ {
+			g.Expect(r.handleEvent(ctx, mkEvent(i))).To(o.Succeed())
+		}
+		g.Expect(r.pending).To(o.HaveLen(10), string(policy))
+		// We only note what is still pending, including when the event just added is the one shed
+		g.Expect(r.pendingEntries).To(o.HaveLen(10), string(policy))
+		for _, ev := range r.pending {
+			g.Expect(r.pendingEntries).To(o.HaveKey(ev), string(policy))
+		}
+
+		switch policy {
+		case ShedOldest:
+			g.Expect(r.pending[0].Name).To(o.Equal("evicted-20.event"))
+			g.Expect(r.pending[9].Name).To(o.Equal("evicted-29.event"))
+		case ShedNormal:
+			// Only Warnings are left, and once there are only Warnings the oldest go first
+			for _, ev := range r.pending {
+				g.Expect(ev.Type).To(o.Equal(corev1.EventTypeWarning))
+			}
+			g.Expect(r.pending[9].Name).To(o.Equal("evicted-27.event"))
+		}
+		r.stop()
+	}
+
+	_, err := ParseShedPolicy("newest")
+	g.Expect(err).To(o.HaveOccurred())
+}
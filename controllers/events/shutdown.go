@@ -0,0 +1,105 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// Ticks to send out and throw away whatever has been held long enough, until stopped; then sends
+// out everything. Runs on every replica, so a standby keeps its state trimmed too.
+type tickerRunnable struct {
+	r *EventWatcher
+}
+
+func (t tickerRunnable) NeedLeaderElection() bool {
+	return false
+}
+
+func (t tickerRunnable) Start(stop <-chan struct{}) error {
+	r := t.r
+	ticker := time.NewTicker(r.recent.windows.tickInterval())
+	defer ticker.Stop()
+	ctx := context.Background()
+	for {
+		select {
+		case <-ticker.C:
+			fresh := r.prefetchPending(ctx, r.olderPendingThreshold(mtime.Now()))
+			if err := r.correlate(ctx, func() { r.updatePendingObjects(fresh); r.tick(ctx) }); err != nil {
+				return err
+			}
+		case <-stop:
+			r.shutdown()
+			return nil
+		}
+	}
+}
+
+// shutdown sends everything we are holding, saves a last checkpoint if configured, and stops.
+// Anything not done within ShutdownTimeout is lost. The flush may still be running past the deadline,
+// if the Exporter ignores it, so Flushed is only closed once the correlation goroutine has returned.
+func (r *EventWatcher) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.ShutdownTimeout)
+	defer cancel()
+	err := r.correlate(ctx, func() { r.flushAll(ctx) })
+	if err != nil {
+		r.Log.Error(err, "unable to send everything before shutdown")
+	}
+	if err := r.flushLogs(ctx); err != nil {
+		r.Log.Error(err, "unable to send all logs before shutdown")
+	}
+	r.flushSelfTracing(ctx)
+	// After the flush, so a restart doesn't send the same spans again
+	if err == nil && r.checkpointStore != nil && r.isLeader() {
+		if err := r.saveCheckpoint(ctx, r.checkpointStore); err != nil {
+			r.Log.Error(err, "checkpoint")
+		}
+	}
+	r.stop()
+	go func() {
+		<-r.correlatorDone
+		close(r.flushed)
+	}()
+}
+
+// Map pending events as well as we can, and send every span we are holding, whatever its age.
+func (r *EventWatcher) flushAll(ctx context.Context) {
+	r.Lock()
+	pending := len(r.pending)
+	r.Unlock()
+	r.Log.Info("flushing before shutdown", "pending", pending)
+
+	// Everything we hold happened before now; allow for cut-offs being moved back for longer windows
+	threshold := r.now().Add(time.Minute + r.recent.windows.longest())
+	if r.reorder != nil {
+		r.releaseReordered(threshold)
+	}
+	err := r.checkOlderPending(ctx, threshold)
+	if err != nil {
+		r.Log.Error(err, "from checkOlderPending")
+	}
+	// Past the deadline, whatever is left will not be sent
+	if ctx.Err() != nil {
+		return
+	}
+	if r.CollapseRepeats {
+		r.flushSeries(ctx, threshold)
+	}
+	r.flushOutgoing(ctx, threshold)
+	if ctx.Err() != nil {
+		return
+	}
+	if r.TailSampling { // decide on everything held, now nothing more will join
+		r.flushTailTraces(ctx, r.now().Add(r.recent.windows.longestExpire()))
+	}
+}
+
+// Flushed returns a channel that is closed once the watcher has sent what it was holding after being stopped,
+// or given up at ShutdownTimeout, and nothing is using the Exporter any more. Wait for it before shutting
+// down the Exporter; if it is not closed, the Exporter is stuck in a flush, and shutting it down is not safe.
+func (r *EventWatcher) Flushed() <-chan struct{} {
+	return r.flushed
+}
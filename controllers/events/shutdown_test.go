@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+)
+
+func TestShutdownFlushes(t *testing.T) {
+	g := o.NewWithT(t)
+
+	ctx, r, exporter := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() { stopped <- tickerRunnable{r: r}.Start(stop) }()
+
+	events := rolloutEvents(t)
+	var err error
+	g.Expect(r.correlate(ctx, func() { err = handleEvents(ctx, r, events) })).To(o.Succeed())
+	g.Expect(err).NotTo(o.HaveOccurred())
+	g.Expect(r.pending).NotTo(o.BeEmpty())
+	g.Expect(exporter.SpanSnapshot).To(o.BeEmpty())
+
+	// Stopping sends everything, including the events still pending
+	close(stop)
+	g.Eventually(stopped).Should(o.Receive(o.BeNil()))
+	g.Eventually(r.Flushed()).Should(o.BeClosed())
+	g.Expect(r.pending).To(o.BeEmpty())
+	g.Expect(r.outgoing.byRef).To(o.BeEmpty())
+	g.Expect(exporter.dump()).To(o.HaveLen(len(rolloutTrace)))
+
+	// and nothing else is handled after that
+	g.Expect(r.correlate(ctx, func() {})).To(o.Equal(errStopped))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, _, _ := newTestEventWatcher()
+	defer r.stop()
+	r.ShutdownTimeout = 50 * time.Millisecond
+
+	// Something is taking a long time on the correlation goroutine
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	go func() { _ = r.correlate(ctx, func() { close(busy); <-release }) }()
+	<-busy
+
+	start := time.Now()
+	r.shutdown()
+	g.Expect(time.Since(start)).To(o.BeNumerically("<", time.Second))
+	// Not flushed while anything might still use the Exporter
+	g.Consistently(r.Flushed(), 100*time.Millisecond).ShouldNot(o.BeClosed())
+	close(release)
+	g.Eventually(r.Flushed()).Should(o.BeClosed())
+}
+
+// blocks sending until released, whatever the context says
+type stuckExporter struct {
+	fakeExporter
+	release   chan struct{}
+	deadlines chan bool // whether each call had a deadline
+}
+
+func (s *stuckExporter) ExportSpans(ctx context.Context, spans []*tracesdk.SpanSnapshot) error {
+	_, hasDeadline := ctx.Deadline()
+	s.deadlines <- hasDeadline
+	<-s.release
+	return s.fakeExporter.ExportSpans(ctx, spans)
+}
+
+// Shutdown gives up at the deadline even when the flush itself is what is slow,
+// and says it has flushed only once the flush is no longer using the Exporter.
+func TestShutdownDeadlineSlowFlush(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx, r, _ := newRolloutTestEventWatcher(t)
+	defer r.stop()
+	r.ShutdownTimeout = 50 * time.Millisecond
+	handleRolloutEvents(t, ctx, r)
+	exporter := &stuckExporter{release: make(chan struct{}), deadlines: make(chan bool, 100)}
+	r.Exporter = exporter
+
+	start := time.Now()
+	r.shutdown()
+	g.Expect(time.Since(start)).To(o.BeNumerically("<", time.Second))
+	g.Expect(exporter.deadlines).To(o.Receive(o.BeTrue()))
+	g.Consistently(r.Flushed(), 100*time.Millisecond).ShouldNot(o.BeClosed())
+
+	// The flush stops at the first export that returns after the deadline
+	close(exporter.release)
+	g.Eventually(r.Flushed()).Should(o.BeClosed())
+	g.Expect(exporter.deadlines).To(o.BeEmpty())
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultRecentWindow = time.Second * 5
+	defaultExpireAfter  = time.Minute * 5
+)
+
+// Window controls how kspan correlates events
+type Window struct {
+	Recent time.Duration // events within this window are considered likely to belong together
+	Expire time.Duration // how long to keep events in the recent cache
+}
+
+// Windows holds the default correlation window, and overrides for particular
+// source components (e.g. "cluster-autoscaler") or involved-object kinds (e.g. "PersistentVolumeClaim").
+// A source override takes precedence over a kind override.
+type Windows struct {
+	Default  Window
+	BySource map[string]Window
+	ByKind   map[string]Window
+}
+
+// fill in defaults for anything not set
+func (w Windows) withDefaults() Windows {
+	if w.Default.Recent == 0 {
+		w.Default.Recent = defaultRecentWindow
+	}
+	if w.Default.Expire == 0 {
+		w.Default.Expire = defaultExpireAfter
+	}
+	fill := func(m map[string]Window) map[string]Window {
+		ret := make(map[string]Window, len(m))
+		for k, v := range m {
+			if v.Recent == 0 {
+				v.Recent = w.Default.Recent
+			}
+			if v.Expire == 0 {
+				v.Expire = w.Default.Expire
+			}
+			ret[k] = v
+		}
+		return ret
+	}
+	w.BySource = fill(w.BySource)
+	w.ByKind = fill(w.ByKind)
+	return w
+}
+
+// Returns the window to use for an event, and a name for it to use in metrics.
+func (w Windows) forEvent(event *corev1.Event) (Window, string) {
+	return w.forSource(eventSource(event).name, event.InvolvedObject.Kind)
+}
+
+// The window for something done by source to an object of this kind; source may be blank.
+func (w Windows) forSource(source, kind string) (Window, string) {
+	if win, found := w.BySource[source]; found {
+		return win, "source:" + source
+	}
+	return w.forKind(kind)
+}
+
+func (w Windows) forKind(kind string) (Window, string) {
+	if win, found := w.ByKind[kind]; found {
+		return win, "kind:" + kind
+	}
+	return w.Default, "default"
+}
+
+// The ticker needs to run more often than the shortest window, otherwise things will be too old.
+func (w Windows) tickInterval() time.Duration {
+	shortest := w.Default.Recent
+	for _, m := range []map[string]Window{w.BySource, w.ByKind} {
+		for _, win := range m {
+			if win.Recent < shortest {
+				shortest = win.Recent
+			}
+		}
+	}
+	return shortest / 2
+}
+
+// The longest any event might wait for related ones.
+func (w Windows) longest() time.Duration {
+	longest := w.Default.Recent
+	for _, m := range []map[string]Window{w.BySource, w.ByKind} {
+		for _, win := range m {
+			if win.Recent > longest {
+				longest = win.Recent
+			}
+		}
+	}
+	return longest
+}
+
+// The longest any event is kept in the recent store.
+func (w Windows) longestExpire() time.Duration {
+	longest := w.Default.Expire
+	for _, m := range []map[string]Window{w.BySource, w.ByKind} {
+		for _, win := range m {
+			if win.Expire > longest {
+				longest = win.Expire
+			}
+		}
+	}
+	return longest
+}
+
+// Callers compute cut-off times from the default window; move the cut-off back for a longer window, or forward for a shorter one.
+func (w Windows) adjust(threshold time.Time, win Window) time.Time {
+	return threshold.Add(w.Default.Recent - win.Recent)
+}
+
+// ParseWindows parses a list like "Pod=30s,PersistentVolumeClaim=2m:10m" into a map;
+// each entry gives the recent window and optionally the expiry time, separated by a colon.
+func ParseWindows(s string) (map[string]Window, error) {
+	ret := make(map[string]Window)
+	if s == "" {
+		return ret, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("window %q must be of the form name=recent[:expire]", item)
+		}
+		durations := strings.Split(parts[1], ":")
+		if len(durations) > 2 {
+			return nil, fmt.Errorf("window %q must be of the form name=recent[:expire]", item)
+		}
+		var win Window
+		var err error
+		if win.Recent, err = time.ParseDuration(durations[0]); err != nil {
+			return nil, fmt.Errorf("window %q: %v", item, err)
+		}
+		if len(durations) == 2 {
+			if win.Expire, err = time.ParseDuration(durations[1]); err != nil {
+				return nil, fmt.Errorf("window %q: %v", item, err)
+			}
+		}
+		ret[parts[0]] = win
+	}
+	return ret, nil
+}
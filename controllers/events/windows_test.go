@@ -0,0 +1,162 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/weaveworks-experiments/kspan/pkg/mtime"
+)
+
+func TestParseWindows(t *testing.T) {
+	g := o.NewWithT(t)
+
+	tests := []struct {
+		spec    string
+		want    map[string]Window
+		wantErr bool
+	}{
+		{spec: "", want: map[string]Window{}},
+		{spec: "Pod=30s", want: map[string]Window{"Pod": {Recent: 30 * time.Second}}},
+		{spec: "Pod=30s,PersistentVolumeClaim=2m:10m", want: map[string]Window{
+			"Pod":                   {Recent: 30 * time.Second},
+			"PersistentVolumeClaim": {Recent: 2 * time.Minute, Expire: 10 * time.Minute},
+		}},
+		{spec: "Pod", wantErr: true},
+		{spec: "Pod=soon", wantErr: true},
+		{spec: "Pod=1s:2s:3s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseWindows(tt.spec)
+		if tt.wantErr {
+			g.Expect(err).To(o.HaveOccurred(), tt.spec)
+			continue
+		}
+		g.Expect(err).NotTo(o.HaveOccurred(), tt.spec)
+		g.Expect(got).To(o.Equal(tt.want), tt.spec)
+	}
+}
+
+func TestWindowsForEvent(t *testing.T) {
+	g := o.NewWithT(t)
+	w := Windows{
+		ByKind:   map[string]Window{"Pod": {Recent: 30 * time.Second}},
+		BySource: map[string]Window{"cluster-autoscaler": {Recent: time.Minute, Expire: time.Hour}},
+	}.withDefaults()
+
+	event := func(kind, source string) *corev1.Event {
+		return &corev1.Event{
+			InvolvedObject: corev1.ObjectReference{Kind: kind},
+			Source:         corev1.EventSource{Component: source},
+		}
+	}
+	win, name := w.forEvent(event("Deployment", "deployment-controller"))
+	g.Expect(name).To(o.Equal("default"))
+	g.Expect(win).To(o.Equal(Window{Recent: defaultRecentWindow, Expire: defaultExpireAfter}))
+	win, name = w.forEvent(event("Pod", "kubelet"))
+	g.Expect(name).To(o.Equal("kind:Pod"))
+	g.Expect(win).To(o.Equal(Window{Recent: 30 * time.Second, Expire: defaultExpireAfter}))
+	win, name = w.forEvent(event("Pod", "cluster-autoscaler"))
+	g.Expect(name).To(o.Equal("source:cluster-autoscaler"))
+	g.Expect(win).To(o.Equal(Window{Recent: time.Minute, Expire: time.Hour}))
+
+	g.Expect(w.tickInterval()).To(o.Equal(defaultRecentWindow / 2))
+}
+
+func TestLongerWindowKeepsEventsPending(t *testing.T) {
+	g := o.NewWithT(t)
+
+	threshold := rolloutThreshold(t)
+	ctx, r, exporter, _ := newConfiguredTestEventWatcher(func(r *EventWatcher) {
+		r.Windows = Windows{ByKind: map[string]Window{"Pod": {Recent: 30 * time.Second}}}
+	}, rolloutObjects(t)...)
+	defer r.stop()
+	defer mtime.NowReset()
+	g.Expect(r.recent.windows.tickInterval()).To(o.Equal(defaultRecentWindow / 2))
+
+	handleRolloutEvents(t, ctx, r)
+	// With the default window everything would be mapped by now; Pod events are given longer.
+	mtime.NowForce(threshold.Add(defaultRecentWindow))
+	r.tick(ctx)
+	g.Expect(r.pending).To(o.HaveLen(5))
+	for _, ev := range r.pending {
+		g.Expect(ev.InvolvedObject.Kind).To(o.Equal("Pod"))
+	}
+
+	mtime.NowForce(threshold.Add(30 * time.Second))
+	r.tick(ctx)
+	g.Expect(r.pending).To(o.BeEmpty())
+	r.flushOutgoing(ctx, threshold.Add(time.Minute))
+	// Killing is now mapped after the ReplicaSet event that deleted the Pod, rather than alongside it.
+	g.Expect(exporter.dump()).To(o.Equal([]string{
+		"0: kubectl Deployment.Update ",
+		"1: deployment-controller Deployment.ScalingReplicaSet (0) Scaled up replica set hello-world-6b9d85fbd6 to 1",
+		"2: replicaset-controller ReplicaSet.SuccessfulCreate (1) Created pod: hello-world-6b9d85fbd6-klpv2",
+		"3: default-scheduler Pod.Scheduled (2) Successfully assigned default/hello-world-6b9d85fbd6-klpv2 to kind-control-plane",
+		"4: kubelet Pod.Pulled (2) Container image \"nginx:1.19.2-alpine\" already present on machine",
+		"5: kubelet Pod.Created (2) Created container hello-world",
+		"6: kubelet Pod.Started (2) Started container hello-world",
+		"7: deployment-controller Deployment.ScalingReplicaSet (0) Scaled down replica set hello-world-7ff854f459 to 0",
+		"8: replicaset-controller ReplicaSet.SuccessfulDelete (7) Deleted pod: hello-world-7ff854f459-kl4hq",
+		"9: kubelet Pod.Killing (8) Stopping container hello-world",
+	}))
+}
+
+func TestSourceWindowAppliesToRecentActivity(t *testing.T) {
+	g := o.NewWithT(t)
+	autoscaler := Window{Recent: time.Minute, Expire: time.Hour}
+	ctx, r, exporter, _ := newConfiguredTestEventWatcher(func(r *EventWatcher) {
+		r.Windows = Windows{BySource: map[string]Window{"cluster-autoscaler": autoscaler}}
+	})
+	defer r.stop()
+	defer mtime.NowReset()
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime.NowForce(start)
+
+	sc := func(i byte) trace.SpanContext {
+		return trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{i}})
+	}
+	scaled := actionReference{object: objectReference{Kind: "Node", Name: "node-1"}}
+	started := actionReference{object: objectReference{Kind: "Node", Name: "node-2"}}
+	r.recent.store(scaled, "cluster-autoscaler", sc(1), sc(2))
+	r.recent.store(started, "kubelet", sc(1), sc(3))
+
+	// Activity from the autoscaler is still recent when the default window has passed
+	mtime.NowForce(start.Add(30 * time.Second))
+	c, found := r.recent.candidate(scaled, ruleSibling, false)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(c.window).To(o.Equal(autoscaler))
+	g.Expect(c.score).To(o.Equal(relationWeights[ruleSibling] * partialMatchWeight))
+	c, found = r.recent.candidate(started, ruleSibling, false)
+	g.Expect(found).To(o.BeTrue())
+	g.Expect(c.score).To(o.BeNumerically("<", relationWeights[ruleSibling]*partialMatchWeight))
+
+	// and is kept for its own expiry time, even after being used
+	r.recent.choose([]candidate{c})
+	mtime.NowForce(start.Add(defaultExpireAfter + time.Minute))
+	r.recent.expire()
+	_, found = r.recent.peek(scaled)
+	g.Expect(found).To(o.BeTrue())
+	_, found = r.recent.peek(started)
+	g.Expect(found).To(o.BeFalse())
+
+	// Spans from the autoscaler are held for its window before being sent
+	for i, source := range []string{"cluster-autoscaler", "kubelet"} {
+		r.emitSpan(ctx, objectReference{Kind: "Node", Name: source}, &tracesdk.SpanSnapshot{
+			SpanContext: sc(byte(10 + i)),
+			Name:        source,
+			StartTime:   start,
+			EndTime:     start,
+			Resource:    r.getResource(ctx, eventSource(&corev1.Event{Source: corev1.EventSource{Component: source}})),
+		})
+	}
+	r.flushOutgoing(ctx, start.Add(10*time.Second))
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(1))
+	g.Expect(exporter.SpanSnapshot[0].Name).To(o.Equal("kubelet"))
+	r.flushOutgoing(ctx, start.Add(2*time.Minute))
+	g.Expect(exporter.SpanSnapshot).To(o.HaveLen(2))
+}
@@ -22,6 +22,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
@@ -30,14 +31,19 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 	tracesdk "go.opentelemetry.io/otel/sdk/export/trace"
 	"google.golang.org/grpc/credentials"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/metadata"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/weaveworks-experiments/kspan/controllers/events"
+	"github.com/weaveworks-experiments/kspan/pkg/otlplog"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -58,18 +64,7 @@ func setupOTLP(ctx context.Context, addr string, headers string, secured bool) (
 	var exp *otlp.Exporter
 	var err error
 
-	headersMap := make(map[string]string)
-	if headers != "" {
-		ha := strings.Split(headers, ",")
-		for _, h := range ha {
-			parts := strings.Split(h, "=")
-			if len(parts) != 2 {
-				setupLog.Error(errors.New("Error parsing OTLP header"), "header parts length is not 2", "header", h)
-				continue
-			}
-			headersMap[parts[0]] = parts[1]
-		}
-	}
+	headersMap := parseHeaders(headers)
 
 	if secured {
 		exp, err = otlp.NewExporter(
@@ -98,39 +93,318 @@ func setupOTLP(ctx context.Context, addr string, headers string, secured bool) (
 	return exp, err
 }
 
+func setupOTLPLogs(ctx context.Context, addr string, headers string, secured bool) (*otlplog.Exporter, error) {
+	setupLog.Info("Setting up OTLP log Exporter", "addr", addr)
+
+	var creds credentials.TransportCredentials
+	if secured {
+		creds = credentials.NewClientTLSFromCert(nil, "")
+	}
+	return otlplog.NewExporter(ctx, addr, parseHeaders(headers), creds)
+}
+
+// A flag that can be given more than once
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *repeatedFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func parseHeaders(headers string) map[string]string {
+	headersMap := make(map[string]string)
+	if headers != "" {
+		ha := strings.Split(headers, ",")
+		for _, h := range ha {
+			parts := strings.Split(h, "=")
+			if len(parts) != 2 {
+				setupLog.Error(errors.New("Error parsing OTLP header"), "header parts length is not 2", "header", h)
+				continue
+			}
+			headersMap[parts[0]] = parts[1]
+		}
+	}
+	return headersMap
+}
+
 func main() {
 	var metricsAddr string
 	var otlpAddr string
 	var otlpHeaders string
 	var otlpSecured bool
 	var captureFile string
+	var containerSpans bool
+	var collapseRepeats bool
+	var repeatQuietPeriod time.Duration
+	var messages string
+	var clusterName string
+	var legacyAttributes bool
+	var nodeLabels string
+	var resourceCacheSize int
+	var resourceCacheTTL time.Duration
+	var projectLabels, projectAnnotations string
+	var projectFromOwners bool
+	var redactions repeatedFlag
+	var sampleRate float64
+	var sampleRatesByNamespace, sampleRatesByKind, sampleRatesBySource string
+	var tailSampling bool
+	var includeNamespaces, excludeNamespaces, includeReasons, excludeReasons string
+	var includeSources, excludeSources, includeKinds, excludeKinds string
+	var objectSelector string
+	var pendingLimit int
+	var shedPolicy string
+	var leaderElection bool
+	var leaderElectionID, leaderElectionNamespace string
+	var sharding bool
+	var shardGroup, shardLeaseNamespace string
+	var shardLeaseDuration time.Duration
+	var checkpointFile, checkpointConfigMap string
+	var checkpointInterval time.Duration
+	var redisAddr, redisPrefix string
+	var redisTimeout time.Duration
+	var backfill time.Duration
+	var metadataCache bool
+	var workers int
+	var reorderWindow time.Duration
+	var shutdownTimeout time.Duration
+	var selfTracingAddr string
+	var recentWindow, expireAfter time.Duration
+	var windowsByKind, windowsBySource string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&otlpAddr, "otlp-addr", "otlp-collector.default:55680", "Address to send traces to")
 	flag.StringVar(&otlpHeaders, "otlp-headers", "", "Add headers key/values pairs to OTLP communication")
 	flag.BoolVar(&otlpSecured, "otlp-secured", false, "Use TLS for OTLP export")
 	flag.StringVar(&captureFile, "capture-to", "", "Write out all updates received to this file")
+	flag.BoolVar(&containerSpans, "container-spans", false, "Watch Pods and make spans for container start-up and termination")
+	flag.BoolVar(&collapseRepeats, "collapse-repeats", false, "Make one span for an event that repeats, with a span event for each repeat")
+	flag.DurationVar(&repeatQuietPeriod, "repeat-quiet-period", 5*time.Minute, "With --collapse-repeats, send the span once the event has not repeated for this long")
+	flag.StringVar(&messages, "messages", "attribute", "Where to put Event messages: attribute, span-event, or log (sent as OTLP log records to --otlp-addr)")
+	flag.StringVar(&clusterName, "cluster-name", "", "Name of the cluster, to add as k8s.cluster.name")
+	flag.BoolVar(&legacyAttributes, "legacy-attributes", false, "Also add the attribute keys used before kspan followed the OpenTelemetry conventions, e.g. kind, reason, eventID")
+	flag.StringVar(&nodeLabels, "node-labels", "", "Comma-separated labels to copy from the Node onto resources for kubelet etc., e.g. topology.kubernetes.io/zone")
+	flag.IntVar(&resourceCacheSize, "resource-cache-size", 1000, "Maximum number of resources (one per component and host) to cache")
+	flag.DurationVar(&resourceCacheTTL, "resource-cache-ttl", 10*time.Minute, "How long to cache a resource, e.g. before looking at node labels again")
+	flag.StringVar(&projectLabels, "project-labels", "", "Labels to copy onto spans, e.g. app.kubernetes.io/name=app,team (default attribute name k8s.label.<key>)")
+	flag.StringVar(&projectAnnotations, "project-annotations", "", "Annotations to copy onto spans, e.g. cost-center (default attribute name k8s.annotation.<key>)")
+	flag.BoolVar(&projectFromOwners, "project-from-owners", false, "Take projected labels and annotations from owners of the object when it doesn't have them")
+	flag.Var(&redactions, "redact", "Redaction rule, mask|drop:regex|key:<expression>, e.g. mask:regex:password=\\S+ or drop:key:k8s.annotation.*; may be repeated")
+	flag.Float64Var(&sampleRate, "sample-rate", 1, "Fraction of traces to send, from 0 to 1")
+	flag.StringVar(&sampleRatesByNamespace, "sample-rates-by-namespace", "", "Override sample rate by namespace of the object that started the trace, e.g. kube-system=0.1")
+	flag.StringVar(&sampleRatesByKind, "sample-rates-by-kind", "", "Override sample rate by kind of the object that started the trace, e.g. Deployment=0.5")
+	flag.StringVar(&sampleRatesBySource, "sample-rates-by-source", "", "Override sample rate by source component of the trace, e.g. flux=1")
+	flag.BoolVar(&tailSampling, "tail-sampling", false, "Hold each trace until nothing more can join it, then send it if sampled or if it has a Warning event or error")
+	flag.StringVar(&includeNamespaces, "include-namespaces", "", "Comma-separated namespaces to watch; default all")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "", "Comma-separated namespaces to ignore")
+	flag.StringVar(&includeReasons, "include-reasons", "", "Comma-separated Event reasons to make spans from; default all")
+	flag.StringVar(&excludeReasons, "exclude-reasons", "", "Comma-separated Event reasons to ignore, e.g. Pulling,Pulled")
+	flag.StringVar(&includeSources, "include-sources", "", "Comma-separated source components to make spans from; default all")
+	flag.StringVar(&excludeSources, "exclude-sources", "", "Comma-separated source components to ignore, e.g. kubelet")
+	flag.StringVar(&includeKinds, "include-kinds", "", "Comma-separated involved-object kinds to make spans from; default all")
+	flag.StringVar(&excludeKinds, "exclude-kinds", "", "Comma-separated involved-object kinds to ignore")
+	flag.StringVar(&objectSelector, "object-selector", "", "Only make spans from Events whose involved object matches this label selector, e.g. app.kubernetes.io/part-of=shop")
+	flag.IntVar(&pendingLimit, "pending-limit", 5000, "Maximum number of events to hold waiting to be mapped to a trace")
+	flag.StringVar(&shedPolicy, "pending-shed-policy", "oldest", "Which event to drop when --pending-limit is reached: oldest, normal-first, or sample")
+	flag.BoolVar(&leaderElection, "enable-leader-election", false, "Elect one replica to send spans; the others watch Events so they are ready to take over")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "kspan-leader", "Name of the ConfigMap used for leader election")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "Namespace for leader election; default is the one kspan runs in")
+	flag.BoolVar(&sharding, "sharding", false, "Split namespaces between the replicas in --shard-group, each handling only its own")
+	flag.StringVar(&shardGroup, "shard-group", "kspan", "Name of the group of replicas sharing namespaces")
+	flag.StringVar(&shardLeaseNamespace, "shard-lease-namespace", "kspan", "Namespace for the Leases that track replicas in the shard group")
+	flag.DurationVar(&shardLeaseDuration, "shard-lease-duration", 15*time.Second, "How long before a replica that stops renewing its Lease has its namespaces handed to the others")
+	flag.StringVar(&checkpointFile, "checkpoint-file", "", "Save state to this file periodically, and restore it at startup")
+	flag.StringVar(&checkpointConfigMap, "checkpoint-configmap", "", "Save state to this ConfigMap, as namespace/name, periodically, and restore it at startup")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 30*time.Second, "How often to save state")
+	flag.StringVar(&redisAddr, "redis-addr", "", "Keep recent activity in Redis at this address, to share it between replicas; password from $REDIS_PASSWORD")
+	flag.StringVar(&redisPrefix, "redis-prefix", "kspan:recent:", "Prefix for the keys kspan puts in Redis")
+	flag.DurationVar(&redisTimeout, "redis-timeout", 200*time.Millisecond, "Give up on a call to Redis after this long, and carry on without it")
+	flag.DurationVar(&backfill, "backfill", 0, "At startup, make spans from Events up to this long ago that are still in the API server, e.g. 1h")
+	flag.BoolVar(&metadataCache, "metadata-cache", true, "Look up owners through informers that only hold object metadata, instead of fetching whole objects")
+	flag.IntVar(&workers, "workers", 4, "How many Events to fetch, with the objects they refer to, at once")
+	flag.DurationVar(&reorderWindow, "reorder-window", 0, "Hold Events up to this long after they arrive, to put those that arrive out of order back in order, e.g. 1s; off by default")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to spend sending the spans kspan is holding when it is stopped")
+	flag.StringVar(&selfTracingAddr, "self-tracing-otlp-addr", "", "Address to send traces of kspan's own work to, e.g. to see which lookups it made for an Event; empty to turn off")
+	flag.DurationVar(&recentWindow, "recent-window", 5*time.Second, "Events within this time of each other are considered likely to belong together")
+	flag.DurationVar(&expireAfter, "expire-after", 5*time.Minute, "How long to remember recent events")
+	flag.StringVar(&windowsByKind, "windows-by-kind", "", "Override windows by involved-object kind, e.g. Pod=30s,PersistentVolumeClaim=2m:10m (recent[:expire])")
+	flag.StringVar(&windowsBySource, "windows-by-source", "", "Override windows by source component, e.g. cluster-autoscaler=1m (recent[:expire])")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	var err error
+	windows := events.Windows{Default: events.Window{Recent: recentWindow, Expire: expireAfter}}
+	windows.ByKind, err = events.ParseWindows(windowsByKind)
+	if err != nil {
+		setupLog.Error(err, "unable to parse windows-by-kind")
+		os.Exit(1)
+	}
+	windows.BySource, err = events.ParseWindows(windowsBySource)
+	if err != nil {
+		setupLog.Error(err, "unable to parse windows-by-source")
+		os.Exit(1)
+	}
+	projections, err := events.ParseProjections(projectLabels, false)
+	if err != nil {
+		setupLog.Error(err, "unable to parse project-labels")
+		os.Exit(1)
+	}
+	annotationProjections, err := events.ParseProjections(projectAnnotations, true)
+	if err != nil {
+		setupLog.Error(err, "unable to parse project-annotations")
+		os.Exit(1)
+	}
+	projections = append(projections, annotationProjections...)
+	var redactionRules []events.RedactionRule
+	for _, s := range redactions {
+		rule, err := events.ParseRedactionRule(s)
+		if err != nil {
+			setupLog.Error(err, "unable to parse redact")
+			os.Exit(1)
+		}
+		redactionRules = append(redactionRules, rule)
+	}
+	sampling := &events.SampleRates{Default: sampleRate}
+	sampling.ByNamespace, err = events.ParseSampleRates(sampleRatesByNamespace)
+	if err != nil {
+		setupLog.Error(err, "unable to parse sample-rates-by-namespace")
+		os.Exit(1)
+	}
+	sampling.ByKind, err = events.ParseSampleRates(sampleRatesByKind)
+	if err != nil {
+		setupLog.Error(err, "unable to parse sample-rates-by-kind")
+		os.Exit(1)
+	}
+	sampling.BySource, err = events.ParseSampleRates(sampleRatesBySource)
+	if err != nil {
+		setupLog.Error(err, "unable to parse sample-rates-by-source")
+		os.Exit(1)
+	}
+	filter := events.Filter{
+		IncludeNamespaces: splitList(includeNamespaces),
+		ExcludeNamespaces: splitList(excludeNamespaces),
+		IncludeReasons:    splitList(includeReasons),
+		ExcludeReasons:    splitList(excludeReasons),
+		IncludeSources:    splitList(includeSources),
+		ExcludeSources:    splitList(excludeSources),
+		IncludeKinds:      splitList(includeKinds),
+		ExcludeKinds:      splitList(excludeKinds),
+	}
+	if objectSelector != "" {
+		filter.ObjectSelector, err = labels.Parse(objectSelector)
+		if err != nil {
+			setupLog.Error(err, "unable to parse object-selector")
+			os.Exit(1)
+		}
+	}
+	shed, err := events.ParseShedPolicy(shedPolicy)
+	if err != nil {
+		setupLog.Error(err, "unable to parse pending-shed-policy")
+		os.Exit(1)
+	}
+	var shardConfig *events.Sharding
+	if sharding {
+		identity, err := os.Hostname() // the pod name, in Kubernetes
+		if err != nil {
+			setupLog.Error(err, "unable to get identity for sharding")
+			os.Exit(1)
+		}
+		shardConfig = &events.Sharding{
+			Identity:      identity,
+			Namespace:     shardLeaseNamespace,
+			Group:         shardGroup,
+			LeaseDuration: shardLeaseDuration,
+		}
+	}
+	var checkpoint *events.Checkpoint
+	switch {
+	case checkpointFile != "":
+		checkpoint = &events.Checkpoint{File: checkpointFile, Interval: checkpointInterval}
+	case checkpointConfigMap != "":
+		parts := strings.Split(checkpointConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			setupLog.Error(errors.New("must be namespace/name"), "unable to parse checkpoint-configmap")
+			os.Exit(1)
+		}
+		checkpoint = &events.Checkpoint{ConfigMap: types.NamespacedName{Namespace: parts[0], Name: parts[1]}, Interval: checkpointInterval}
+	}
+	var redisStore *events.RedisStore
+	if redisAddr != "" {
+		redisStore = &events.RedisStore{Addr: redisAddr, Password: os.Getenv("REDIS_PASSWORD"), Prefix: redisPrefix, Timeout: redisTimeout}
+	}
+	messageMode, err := events.ParseMessageMode(messages)
+	if err != nil {
+		setupLog.Error(err, "unable to parse messages")
+		os.Exit(1)
+	}
+
 	ctx := context.Background()
+	// Set if the watcher is still flushing when we exit, so its exporters are not shut down under it
+	abandoned := false
 	spanExporter, err := setupOTLP(ctx, otlpAddr, otlpHeaders, otlpSecured)
 	if err != nil {
 		setupLog.Error(err, "unable to set up tracing")
 		os.Exit(1)
 	}
 	defer func() {
+		if abandoned {
+			return
+		}
 		err := spanExporter.Shutdown(ctx)
 		if err != nil {
 			setupLog.Error(err, "unable to gracefully shutdown exporter")
 		}
 	}()
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	var logExporter events.LogExporter
+	if messageMode == events.MessageLog {
+		exp, err := setupOTLPLogs(ctx, otlpAddr, otlpHeaders, otlpSecured)
+		if err != nil {
+			setupLog.Error(err, "unable to set up log export")
+			os.Exit(1)
+		}
+		logExporter = exp
+		defer func() {
+			if abandoned {
+				return
+			}
+			if err := exp.Shutdown(ctx); err != nil {
+				setupLog.Error(err, "unable to gracefully shutdown log exporter")
+			}
+		}()
+	}
+
+	var selfExporter tracesdk.SpanExporter
+	if selfTracingAddr != "" {
+		selfExporter, err = setupOTLP(ctx, selfTracingAddr, otlpHeaders, otlpSecured)
+		if err != nil {
+			setupLog.Error(err, "unable to set up self-tracing")
+			os.Exit(1)
+		}
+		// The watcher shuts it down, after sending the last of its spans
+	}
+
+	options := ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
-	})
+
+		LeaderElection:          leaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: leaderElectionNamespace,
+	}
+	if len(filter.IncludeNamespaces) > 0 { // only cache Events and Pods in the namespaces we want
+		options.NewCache = cache.MultiNamespacedCacheBuilder(filter.IncludeNamespaces)
+	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
@@ -144,12 +418,51 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	if err = (&events.EventWatcher{
+	var metadataClient metadata.Interface
+	if metadataCache && capture == nil { // capture needs whole objects
+		metadataClient, err = metadata.NewForConfig(mgr.GetConfig())
+		if err != nil {
+			setupLog.Error(err, "unable to create metadata client")
+			os.Exit(1)
+		}
+	}
+	watcher := &events.EventWatcher{
 		Client:   mgr.GetClient(),
 		Log:      ctrl.Log,
 		Exporter: spanExporter,
 		Capture:  capture,
-	}).SetupWithManager(mgr); err != nil {
+
+		ContainerSpans:    containerSpans,
+		Windows:           windows,
+		CollapseRepeats:   collapseRepeats,
+		RepeatQuietPeriod: repeatQuietPeriod,
+		Messages:          messageMode,
+		LogExporter:       logExporter,
+		ClusterName:       clusterName,
+		LegacyAttributes:  legacyAttributes,
+		NodeLabels:        splitList(nodeLabels),
+		ResourceCacheSize: resourceCacheSize,
+		ResourceCacheTTL:  resourceCacheTTL,
+		Projections:       projections,
+		ProjectFromOwners: projectFromOwners,
+		Redactions:        redactionRules,
+		Sampling:          sampling,
+		TailSampling:      tailSampling,
+		Filter:            filter,
+		PendingLimit:      pendingLimit,
+		ShedPolicy:        shed,
+		LeaderElection:    leaderElection,
+		Sharding:          shardConfig,
+		Checkpoint:        checkpoint,
+		RedisStore:        redisStore,
+		Backfill:          backfill,
+		Metadata:          metadataClient,
+		Workers:           workers,
+		ReorderWindow:     reorderWindow,
+		ShutdownTimeout:   shutdownTimeout,
+		SelfExporter:      selfExporter,
+	}
+	if err = watcher.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Events")
 		os.Exit(1)
 	}
@@ -169,4 +482,12 @@ func main() {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	// The manager doesn't wait for its runnables to stop; give the watcher time to send what it
+	// was holding before the deferred exporter shutdowns run.
+	select {
+	case <-watcher.Flushed():
+	case <-time.After(shutdownTimeout):
+		setupLog.Info("timed out waiting for spans to be sent; leaving the exporters as they are")
+		abandoned = true
+	}
 }
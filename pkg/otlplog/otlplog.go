@@ -0,0 +1,152 @@
+// Package otlplog sends log records to an OpenTelemetry collector over OTLP/gRPC.
+// The OpenTelemetry Go SDK we use has no logs support, so this is the minimum kspan needs.
+package otlplog
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// Severity of a log record; the values are from the OTLP spec.
+type Severity int32
+
+const (
+	SeverityInfo Severity = 9
+	SeverityWarn Severity = 13
+)
+
+// Record is one log entry, optionally correlated with a span.
+type Record struct {
+	Time         time.Time
+	SpanContext  trace.SpanContext
+	Severity     Severity
+	SeverityText string
+	Name         string
+	Body         string
+	Attributes   []attribute.KeyValue
+	Resource     *resource.Resource
+}
+
+// Exporter sends records to a collector.
+type Exporter struct {
+	conn    *grpc.ClientConn
+	client  collogs.LogsServiceClient
+	headers map[string]string
+}
+
+// NewExporter connects to addr; if creds is nil the connection is not secured.
+// Like the trace exporter, it does not wait for the connection to come up.
+func NewExporter(ctx context.Context, addr string, headers map[string]string, creds credentials.TransportCredentials) (*Exporter, error) {
+	opt := grpc.WithInsecure()
+	if creds != nil {
+		opt = grpc.WithTransportCredentials(creds)
+	}
+	conn, err := grpc.DialContext(ctx, addr, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		conn:    conn,
+		client:  collogs.NewLogsServiceClient(conn),
+		headers: headers,
+	}, nil
+}
+
+// ExportLogs sends the records in one request.
+func (e *Exporter) ExportLogs(ctx context.Context, records []*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if len(e.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.headers))
+	}
+	_, err := e.client.Export(ctx, &collogs.ExportLogsServiceRequest{
+		ResourceLogs: toResourceLogs(records),
+	})
+	return err
+}
+
+// Shutdown closes the connection.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return e.conn.Close()
+}
+
+// Group records by resource, keeping the order they came in.
+func toResourceLogs(records []*Record) []*logspb.ResourceLogs {
+	var ret []*logspb.ResourceLogs
+	byResource := make(map[*resource.Resource]*logspb.InstrumentationLibraryLogs)
+	for _, rec := range records {
+		ill, found := byResource[rec.Resource]
+		if !found {
+			ill = &logspb.InstrumentationLibraryLogs{
+				InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: "kspan"},
+			}
+			byResource[rec.Resource] = ill
+			ret = append(ret, &logspb.ResourceLogs{
+				Resource:                   toResource(rec.Resource),
+				InstrumentationLibraryLogs: []*logspb.InstrumentationLibraryLogs{ill},
+			})
+		}
+		ill.Logs = append(ill.Logs, toLogRecord(rec))
+	}
+	return ret
+}
+
+func toLogRecord(rec *Record) *logspb.LogRecord {
+	ret := &logspb.LogRecord{
+		TimeUnixNano:   uint64(rec.Time.UnixNano()),
+		SeverityNumber: logspb.SeverityNumber(rec.Severity),
+		SeverityText:   rec.SeverityText,
+		Name:           rec.Name,
+		Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: rec.Body}},
+		Attributes:     toKeyValues(rec.Attributes),
+	}
+	if rec.SpanContext.HasTraceID() {
+		traceID := rec.SpanContext.TraceID()
+		ret.TraceId = traceID[:]
+	}
+	if rec.SpanContext.HasSpanID() {
+		spanID := rec.SpanContext.SpanID()
+		ret.SpanId = spanID[:]
+	}
+	return ret
+}
+
+func toResource(res *resource.Resource) *resourcepb.Resource {
+	if res == nil {
+		return nil
+	}
+	return &resourcepb.Resource{Attributes: toKeyValues(res.Attributes())}
+}
+
+func toKeyValues(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	ret := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		ret = append(ret, &commonpb.KeyValue{Key: string(kv.Key), Value: toAnyValue(kv.Value)})
+	}
+	return ret
+}
+
+func toAnyValue(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.Emit()}}
+	}
+}
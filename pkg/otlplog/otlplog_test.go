@@ -0,0 +1,81 @@
+package otlplog
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	o "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// collects requests sent to it
+type fakeCollector struct {
+	collogs.UnimplementedLogsServiceServer
+	requests chan *collogs.ExportLogsServiceRequest
+	headers  chan metadata.MD
+}
+
+func (f *fakeCollector) Export(ctx context.Context, req *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.headers <- md
+	f.requests <- req
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+func TestExportLogs(t *testing.T) {
+	g := o.NewWithT(t)
+	ctx := context.Background()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).NotTo(o.HaveOccurred())
+	collector := &fakeCollector{
+		requests: make(chan *collogs.ExportLogsServiceRequest, 1),
+		headers:  make(chan metadata.MD, 1),
+	}
+	server := grpc.NewServer()
+	collogs.RegisterLogsServiceServer(server, collector)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	exp, err := NewExporter(ctx, lis.Addr().String(), map[string]string{"api-key": "secret"}, nil)
+	g.Expect(err).NotTo(o.HaveOccurred())
+	defer func() { _ = exp.Shutdown(ctx) }()
+
+	kubelet := resource.NewWithAttributes(attribute.String("service.name", "kubelet"))
+	scheduler := resource.NewWithAttributes(attribute.String("service.name", "default-scheduler"))
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1, 2, 3},
+		SpanID:  trace.SpanID{4, 5, 6},
+	})
+	now := time.Unix(1606478645, 0)
+	records := []*Record{
+		{Time: now, SpanContext: sc, Severity: SeverityInfo, Name: "Pod.Pulled", Body: "pulled", Resource: kubelet,
+			Attributes: []attribute.KeyValue{attribute.Int64("count", 3)}},
+		{Time: now, SpanContext: sc, Severity: SeverityWarn, Name: "Pod.FailedScheduling", Body: "no nodes", Resource: scheduler},
+		{Time: now, SpanContext: sc, Severity: SeverityInfo, Name: "Pod.Started", Body: "started", Resource: kubelet},
+	}
+	g.Expect(exp.ExportLogs(ctx, records)).To(o.Succeed())
+
+	var req *collogs.ExportLogsServiceRequest
+	g.Eventually(collector.requests).Should(o.Receive(&req))
+	g.Expect(<-collector.headers).To(o.HaveKeyWithValue("api-key", []string{"secret"}))
+
+	// Grouped by resource, in the order first seen
+	g.Expect(req.ResourceLogs).To(o.HaveLen(2))
+	g.Expect(req.ResourceLogs[0].Resource.Attributes[0].Value.GetStringValue()).To(o.Equal("kubelet"))
+	kubeletLogs := req.ResourceLogs[0].InstrumentationLibraryLogs[0].Logs
+	g.Expect(kubeletLogs).To(o.HaveLen(2))
+	g.Expect(kubeletLogs[0].Body.GetStringValue()).To(o.Equal("pulled"))
+	g.Expect(kubeletLogs[0].TraceId).To(o.Equal([]byte{1, 2, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	g.Expect(kubeletLogs[0].SpanId).To(o.Equal([]byte{4, 5, 6, 0, 0, 0, 0, 0}))
+	g.Expect(kubeletLogs[0].TimeUnixNano).To(o.Equal(uint64(now.UnixNano())))
+	g.Expect(kubeletLogs[0].Attributes[0].Value.GetIntValue()).To(o.Equal(int64(3)))
+	g.Expect(req.ResourceLogs[1].InstrumentationLibraryLogs[0].Logs[0].SeverityNumber).To(o.BeEquivalentTo(SeverityWarn))
+}